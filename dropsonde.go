@@ -13,13 +13,16 @@ package dropsonde
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cloudfoundry/dropsonde/emitter"
 	"github.com/cloudfoundry/dropsonde/envelope_sender"
 	"github.com/cloudfoundry/dropsonde/envelopes"
+	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/dropsonde/instrumented_handler"
 	"github.com/cloudfoundry/dropsonde/instrumented_round_tripper"
 	"github.com/cloudfoundry/dropsonde/log_sender"
@@ -28,6 +31,7 @@ import (
 	"github.com/cloudfoundry/dropsonde/metricbatcher"
 	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/dropsonde/runtime_stats"
+	"github.com/cloudfoundry/dropsonde/sampling"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -39,6 +43,8 @@ type EventEmitter interface {
 
 var (
 	DefaultEmitter EventEmitter = &NullEventEmitter{}
+
+	httpSampler sampling.Sampler
 )
 
 const (
@@ -57,14 +63,35 @@ const (
 // The destination variable sets the host and port to
 // which metrics are sent. It is optional, and defaults to DefaultDestination.
 func Initialize(destination string, origin ...string) error {
-	emitter, err := createDefaultEmitter(strings.Join(origin, originDelimiter), destination)
+	return InitializeWithOptions(destination, origin)
+}
+
+// InitializeWithOptions behaves like Initialize, and additionally applies the
+// given options to the default emitter.
+func InitializeWithOptions(destination string, origin []string, opts ...Option) error {
+	conf := &config{tags: make(map[string]string)}
+	if BuildSHA != "" {
+		conf.tags["build_sha"] = BuildSHA
+	}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	defaultEmitter, err := createDefaultEmitter(strings.Join(origin, originDelimiter), destination, conf)
 	if err != nil {
 		DefaultEmitter = &NullEventEmitter{}
 		return err
 	}
 
-	DefaultEmitter = emitter
-	initialize()
+	DefaultEmitter = defaultEmitter
+	httpSampler = conf.httpSampler
+	batcher := initialize(conf)
+	if conf.dropSummary {
+		batcher.AddConsistentlyEmittedMetrics(emitter.DropCounterNames()...)
+	}
+	if conf.bufferSize > 0 && !conf.dropSummary {
+		batcher.AddConsistentlyEmittedMetrics(emitter.BufferedDropCounterName)
+	}
 
 	return nil
 }
@@ -73,7 +100,8 @@ func Initialize(destination string, origin ...string) error {
 // creating one.
 func InitializeWithEmitter(emitter EventEmitter) {
 	DefaultEmitter = emitter
-	initialize()
+	httpSampler = nil
+	initialize(&config{})
 }
 
 // AutowiredEmitter exposes the emitter used by Dropsonde after its initialization.
@@ -81,30 +109,84 @@ func AutowiredEmitter() EventEmitter {
 	return DefaultEmitter
 }
 
+// DescribeEmitter describes each stage of the emitter chain behind
+// AutowiredEmitter, with its configuration and live state, for diagnostics.
+// The result can be serialized as JSON; sensitive values are redacted.
+func DescribeEmitter() []emitter.StageDescription {
+	return emitter.DescribeChain(DefaultEmitter)
+}
+
 // InstrumentedHandler returns a Handler pre-configured to emit HTTP server
-// request metrics to AutowiredEmitter.
-func InstrumentedHandler(handler http.Handler) http.Handler {
-	return instrumented_handler.InstrumentedHandler(handler, DefaultEmitter)
+// request metrics to AutowiredEmitter, sampled by any WithHTTPSampler option.
+// See instrumented_handler for the meaning of the options.
+func InstrumentedHandler(handler http.Handler, opts ...factories.HttpStartStopOption) http.Handler {
+	return instrumented_handler.InstrumentedHandler(handler, httpEmitter(), opts...)
 }
 
 // InstrumentedRoundTripper returns a RoundTripper pre-configured to emit
-// HTTP client request metrics to AutowiredEmitter.
+// HTTP client request metrics to AutowiredEmitter, sampled by any
+// WithHTTPSampler option.
 func InstrumentedRoundTripper(roundTripper http.RoundTripper) http.RoundTripper {
-	return instrumented_round_tripper.InstrumentedRoundTripper(roundTripper, DefaultEmitter)
+	return instrumented_round_tripper.InstrumentedRoundTripper(roundTripper, httpEmitter())
 }
 
-func initialize() {
+func httpEmitter() EventEmitter {
+	return sampled(DefaultEmitter, httpSampler)
+}
+
+func sampled(eventEmitter EventEmitter, sampler sampling.Sampler) EventEmitter {
+	if sampler == nil {
+		return eventEmitter
+	}
+	return sampling.NewEmitter(eventEmitter, sampler)
+}
+
+// ValidateDestination reports whether destination is a well-formed address
+// for the default UDP transport: a host and numeric port, without a scheme,
+// that resolves to an IPv4 address. It does not send anything, so it can be
+// used to check configuration before calling Initialize.
+func ValidateDestination(destination string) error {
+	if len(destination) == 0 {
+		return errors.New("Invalid dropsonde destination: destination is empty")
+	}
+	if strings.Contains(destination, "://") {
+		return fmt.Errorf("Invalid dropsonde destination %q: expected host:port without a scheme", destination)
+	}
+
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return fmt.Errorf("Invalid dropsonde destination %q: %v", destination, err)
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("Invalid dropsonde destination %q: missing host", destination)
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+		return fmt.Errorf("Invalid dropsonde destination %q: port must be a number between 1 and 65535", destination)
+	}
+
+	if _, err := net.ResolveUDPAddr("udp4", destination); err != nil {
+		return fmt.Errorf("Invalid dropsonde destination %q: %v", destination, err)
+	}
+	return nil
+}
+
+func initialize(conf *config) *metricbatcher.MetricBatcher {
 	emitter := AutowiredEmitter()
 	sender := metric_sender.NewMetricSender(emitter)
 	batcher := metricbatcher.New(sender, defaultBatchInterval)
 	metrics.Initialize(sender, batcher)
-	logs.Initialize(log_sender.NewLogSender(AutowiredEmitter()))
+	logs.Initialize(log_sender.NewLogSender(sampled(AutowiredEmitter(), conf.logSampler)))
 	envelopes.Initialize(envelope_sender.NewEnvelopeSender(emitter))
-	go runtime_stats.NewRuntimeStats(DefaultEmitter, statsInterval).Run(nil)
+	runtimeStats := runtime_stats.NewRuntimeStats(DefaultEmitter, statsInterval)
+	for _, collector := range conf.collectors {
+		runtimeStats.AddCollector(collector)
+	}
+	go runtimeStats.Run(nil)
 	http.DefaultTransport = InstrumentedRoundTripper(http.DefaultTransport)
+	return batcher
 }
 
-func createDefaultEmitter(origin, destination string) (EventEmitter, error) {
+func createDefaultEmitter(origin, destination string, conf *config) (EventEmitter, error) {
 	if len(origin) == 0 {
 		return nil, errors.New("Failed to initialize dropsonde: origin variable not set")
 	}
@@ -118,7 +200,24 @@ func createDefaultEmitter(origin, destination string) (EventEmitter, error) {
 		return nil, fmt.Errorf("Failed to initialize dropsonde: %v", err.Error())
 	}
 
-	return emitter.NewEventEmitter(udpEmitter, origin), nil
+	var byteEmitter emitter.ByteEmitter = udpEmitter
+	if conf.emitTimeout > 0 {
+		byteEmitter = emitter.NewTimeoutEmitter(udpEmitter, conf.emitTimeout)
+	}
+	if conf.bufferSize > 0 {
+		byteEmitter = emitter.NewBufferedEmitter(byteEmitter, conf.bufferSize)
+	}
+
+	eventEmitter := emitter.NewEventEmitter(byteEmitter, origin)
+	for key, value := range conf.tags {
+		eventEmitter.SetDefaultTag(key, value)
+	}
+	eventEmitter.SetMetricPrefix(conf.metricPrefix)
+	eventEmitter.SetPanicRecovery(conf.recoverPanic)
+	eventEmitter.SetClockOffset(conf.clockOffset, conf.offsetEvents)
+	eventEmitter.SetSerializer(conf.serializer)
+
+	return sampled(eventEmitter, conf.sampler), nil
 }
 
 // NullEventEmitter is used when no event emission is desired. See
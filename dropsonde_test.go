@@ -19,6 +19,45 @@ var _ = Describe("Autowire", func() {
 		})
 	})
 
+	Describe("ValidateDestination", func() {
+		It("accepts host:port addresses", func() {
+			Expect(dropsonde.ValidateDestination("localhost:3457")).To(Succeed())
+			Expect(dropsonde.ValidateDestination("127.0.0.1:3457")).To(Succeed())
+		})
+
+		It("rejects an empty address", func() {
+			Expect(dropsonde.ValidateDestination("")).To(MatchError(ContainSubstring("destination is empty")))
+		})
+
+		It("rejects an address without a port", func() {
+			Expect(dropsonde.ValidateDestination("localhost")).To(MatchError(ContainSubstring("missing port")))
+		})
+
+		It("rejects an address with a scheme", func() {
+			Expect(dropsonde.ValidateDestination("udp://localhost:3457")).To(MatchError(ContainSubstring("without a scheme")))
+		})
+
+		It("rejects an address without a host", func() {
+			Expect(dropsonde.ValidateDestination(":3457")).To(MatchError(ContainSubstring("missing host")))
+		})
+
+		It("rejects a non-numeric port", func() {
+			Expect(dropsonde.ValidateDestination("localhost:metron")).To(MatchError(ContainSubstring("port must be a number")))
+		})
+
+		It("rejects a port out of range", func() {
+			Expect(dropsonde.ValidateDestination("localhost:70000")).To(MatchError(ContainSubstring("port must be a number")))
+		})
+
+		It("rejects a zero port", func() {
+			Expect(dropsonde.ValidateDestination("localhost:0")).To(MatchError(ContainSubstring("port must be a number")))
+		})
+
+		It("rejects a host without an IPv4 address", func() {
+			Expect(dropsonde.ValidateDestination("[::1]:3457")).To(MatchError(ContainSubstring("Invalid dropsonde destination")))
+		})
+	})
+
 	Describe("CreateDefaultEmitter", func() {
 		Context("with origin missing", func() {
 			It("returns a NullEventEmitter", func() {
@@ -17,9 +17,12 @@ package dropsonde_unmarshaller
 
 import (
 	"fmt"
+	"log"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/cloudfoundry/dropsonde/emitter"
 	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
@@ -27,6 +30,10 @@ import (
 
 var metricNames map[events.Envelope_EventType]string
 
+// maxWarnedVersions bounds the unexpected schema versions an unmarshaller
+// remembers having warned about, since senders choose them.
+const maxWarnedVersions = 16
+
 func init() {
 	metricNames = make(map[events.Envelope_EventType]string)
 	for eventType, eventName := range events.Envelope_EventType_name {
@@ -40,6 +47,10 @@ func init() {
 // A DropsondeUnmarshaller is an self-instrumenting tool for converting Protocol
 // Buffer-encoded dropsonde messages to Envelope instances.
 type DropsondeUnmarshaller struct {
+	expectedSchemaVersion string
+
+	lock           sync.Mutex
+	warnedVersions map[string]bool
 }
 
 // NewDropsondeUnmarshaller instantiates a DropsondeUnmarshaller.
@@ -60,6 +71,39 @@ func (u *DropsondeUnmarshaller) Run(inputChan <-chan []byte, outputChan chan<- *
 	}
 }
 
+// A RawEnvelope pairs a decoded Envelope with the exact bytes it was decoded
+// from, so that relays can forward the original message unchanged.
+type RawEnvelope struct {
+	Envelope *events.Envelope
+	Raw      []byte
+}
+
+// RunRaw behaves like Run, but emits each Envelope together with a copy of
+// the message it was decoded from. The copy is taken so that the producer is
+// free to reuse its read buffer.
+func (u *DropsondeUnmarshaller) RunRaw(inputChan <-chan []byte, outputChan chan<- *RawEnvelope) {
+	for message := range inputChan {
+		rawEnvelope, err := u.UnmarshallRawMessage(message)
+		if err != nil {
+			continue
+		}
+		outputChan <- rawEnvelope
+	}
+}
+
+// UnmarshallRawMessage unmarshalls the message and returns the Envelope along
+// with a copy of the message bytes.
+func (u *DropsondeUnmarshaller) UnmarshallRawMessage(message []byte) (*RawEnvelope, error) {
+	envelope, err := u.UnmarshallMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, len(message))
+	copy(raw, message)
+	return &RawEnvelope{Envelope: envelope, Raw: raw}, nil
+}
+
 func (u *DropsondeUnmarshaller) UnmarshallMessage(message []byte) (*events.Envelope, error) {
 	envelope := &events.Envelope{}
 	err := proto.Unmarshal(message, envelope)
@@ -71,10 +115,53 @@ func (u *DropsondeUnmarshaller) UnmarshallMessage(message []byte) (*events.Envel
 	if err := u.incrementReceiveCount(envelope.GetEventType()); err != nil {
 		return nil, err
 	}
+	u.checkSchemaVersion(envelope)
 
 	return envelope, nil
 }
 
+// SetExpectedSchemaVersion makes the unmarshaller check the schema version
+// that senders record with emitter.SchemaVersionEmitter. Envelopes carrying
+// any other version, or none, are still returned, but are counted, and the
+// first envelope seen with each unexpected version is logged as a warning.
+// Once 16 unexpected versions have been logged, further ones are only
+// counted. An empty version disables the check, which is the default. It
+// must be called before the unmarshaller is used.
+func (u *DropsondeUnmarshaller) SetExpectedSchemaVersion(version string) {
+	u.expectedSchemaVersion = version
+	u.warnedVersions = make(map[string]bool)
+}
+
+func (u *DropsondeUnmarshaller) checkSchemaVersion(envelope *events.Envelope) {
+	if u.expectedSchemaVersion == "" {
+		return
+	}
+
+	version, ok := envelope.GetTags()[emitter.SchemaVersionTag]
+	if ok && version == u.expectedSchemaVersion {
+		return
+	}
+	metrics.BatchIncrementCounter("dropsondeUnmarshaller.schemaVersionMismatches")
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.warnedVersions[version] || len(u.warnedVersions) > maxWarnedVersions {
+		return
+	}
+	if len(u.warnedVersions) == maxWarnedVersions {
+		u.warnedVersions[version] = true
+		log.Printf("dropsondeUnmarshaller: received more than %d unexpected schema versions, no longer logging them\n", maxWarnedVersions)
+		return
+	}
+	u.warnedVersions[version] = true
+
+	received := "no schema version"
+	if ok {
+		received = fmt.Sprintf("schema version %q", version)
+	}
+	log.Printf("dropsondeUnmarshaller: expected schema version %q, received %s from %s\n", u.expectedSchemaVersion, received, envelope.GetOrigin())
+}
+
 func (u *DropsondeUnmarshaller) incrementReceiveCount(eventType events.Envelope_EventType) error {
 	var err error
 	switch eventType {
@@ -1,6 +1,11 @@
 package dropsonde_unmarshaller_test
 
 import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
 	"github.com/cloudfoundry/dropsonde/dropsonde_unmarshaller"
 	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/dropsonde/metrics"
@@ -52,6 +57,98 @@ var _ = Describe("DropsondeUnmarshaller", func() {
 		})
 	})
 
+	Context("UnmarshallRawMessage", func() {
+		BeforeEach(func() {
+			unmarshaller = dropsonde_unmarshaller.NewDropsondeUnmarshaller()
+		})
+
+		It("returns the envelope with the original bytes", func() {
+			input := &events.Envelope{
+				Origin:      proto.String("fake-origin-3"),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: factories.NewValueMetric("value-name", 1.0, "units"),
+			}
+			message, _ := proto.Marshal(input)
+			original := append([]byte(nil), message...)
+
+			output, err := unmarshaller.UnmarshallRawMessage(message)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(output.Envelope).To(Equal(input))
+			Expect(output.Raw).To(Equal(original))
+		})
+
+		It("copies the bytes so the input buffer can be reused", func() {
+			input := &events.Envelope{
+				Origin:      proto.String("fake-origin-3"),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: factories.NewValueMetric("value-name", 1.0, "units"),
+			}
+			message, _ := proto.Marshal(input)
+			original := append([]byte(nil), message...)
+
+			output, _ := unmarshaller.UnmarshallRawMessage(message)
+			for i := range message {
+				message[i] = 0
+			}
+
+			Expect(output.Raw).To(Equal(original))
+			var decoded events.Envelope
+			Expect(proto.Unmarshal(output.Raw, &decoded)).To(Succeed())
+			Expect(&decoded).To(Equal(input))
+		})
+
+		It("handles bad input gracefully", func() {
+			output, err := unmarshaller.UnmarshallRawMessage(make([]byte, 4))
+			Expect(output).To(BeNil())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("RunRaw", func() {
+		var rawOutputChan chan *dropsonde_unmarshaller.RawEnvelope
+
+		BeforeEach(func() {
+			inputChan = make(chan []byte, 10)
+			rawOutputChan = make(chan *dropsonde_unmarshaller.RawEnvelope, 10)
+			runComplete = make(chan struct{})
+			unmarshaller = dropsonde_unmarshaller.NewDropsondeUnmarshaller()
+
+			go func() {
+				unmarshaller.RunRaw(inputChan, rawOutputChan)
+				close(runComplete)
+			}()
+		})
+
+		AfterEach(func() {
+			close(inputChan)
+			Eventually(runComplete).Should(BeClosed())
+		})
+
+		It("emits envelopes with their raw bytes", func() {
+			envelope := &events.Envelope{
+				Origin:      proto.String("fake-origin-3"),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: factories.NewValueMetric("value-name", 1.0, "units"),
+			}
+			message, _ := proto.Marshal(envelope)
+			original := append([]byte(nil), message...)
+
+			inputChan <- message
+			var output *dropsonde_unmarshaller.RawEnvelope
+			Eventually(rawOutputChan).Should(Receive(&output))
+
+			Expect(output.Envelope).To(Equal(envelope))
+			Expect(output.Raw).To(Equal(original))
+		})
+
+		It("does not emit messages that fail to unmarshal", func() {
+			inputChan <- []byte{1, 2, 3}
+
+			Consistently(rawOutputChan).ShouldNot(Receive())
+		})
+	})
+
 	Context("Run", func() {
 		BeforeEach(func() {
 			inputChan = make(chan []byte, 10)
@@ -84,6 +181,85 @@ var _ = Describe("DropsondeUnmarshaller", func() {
 		})
 	})
 
+	Context("SetExpectedSchemaVersion", func() {
+		var logs *bytes.Buffer
+
+		BeforeEach(func() {
+			logs = new(bytes.Buffer)
+			log.SetOutput(logs)
+
+			unmarshaller = dropsonde_unmarshaller.NewDropsondeUnmarshaller()
+			unmarshaller.SetExpectedSchemaVersion("2")
+		})
+
+		AfterEach(func() {
+			log.SetOutput(GinkgoWriter)
+		})
+
+		var messageWithVersion = func(tags map[string]string) []byte {
+			message, err := proto.Marshal(&events.Envelope{
+				Origin:      proto.String("fake-origin"),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: factories.NewValueMetric("value-name", 1.0, "units"),
+				Tags:        tags,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return message
+		}
+
+		It("accepts envelopes with the expected version silently", func() {
+			envelope, err := unmarshaller.UnmarshallMessage(messageWithVersion(map[string]string{"schema_version": "2"}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(envelope.GetTags()).To(HaveKeyWithValue("schema_version", "2"))
+
+			Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(With("dropsondeUnmarshaller.valueMetricReceived")))
+			Expect(mockBatcher.BatchIncrementCounterCalled).To(HaveLen(1))
+			Expect(logs.Len()).To(BeZero())
+		})
+
+		It("counts every mismatch and warns once per unexpected version", func() {
+			for i := 0; i < 2; i++ {
+				_, err := unmarshaller.UnmarshallMessage(messageWithVersion(map[string]string{"schema_version": "1"}))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			_, err := unmarshaller.UnmarshallMessage(messageWithVersion(nil))
+			Expect(err).ToNot(HaveOccurred())
+
+			var mismatches int
+			for len(mockBatcher.BatchIncrementCounterInput.Name) > 0 {
+				if <-mockBatcher.BatchIncrementCounterInput.Name == "dropsondeUnmarshaller.schemaVersionMismatches" {
+					mismatches++
+				}
+			}
+			Expect(mismatches).To(Equal(3))
+
+			Expect(logs.String()).To(ContainSubstring(`expected schema version "2", received schema version "1" from fake-origin`))
+			Expect(logs.String()).To(ContainSubstring(`expected schema version "2", received no schema version from fake-origin`))
+			Expect(strings.Count(logs.String(), "expected schema version")).To(Equal(2))
+		})
+
+		It("stops warning once it has warned about 16 versions", func() {
+			for i := 0; i < 20; i++ {
+				_, err := unmarshaller.UnmarshallMessage(messageWithVersion(map[string]string{"schema_version": fmt.Sprintf("v%d", i)}))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(strings.Count(logs.String(), "received schema version")).To(Equal(16))
+			Expect(logs.String()).To(ContainSubstring("received more than 16 unexpected schema versions"))
+			Expect(logs.String()).ToNot(ContainSubstring(`"v16"`))
+		})
+
+		It("does not check versions by default", func() {
+			unmarshaller = dropsonde_unmarshaller.NewDropsondeUnmarshaller()
+
+			_, err := unmarshaller.UnmarshallMessage(messageWithVersion(map[string]string{"schema_version": "1"}))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(mockBatcher.BatchIncrementCounterCalled).To(HaveLen(1))
+			Expect(logs.Len()).To(BeZero())
+		})
+	})
+
 	Context("metrics", func() {
 		BeforeEach(func() {
 			inputChan = make(chan []byte, 1000)
@@ -0,0 +1,97 @@
+package emitter
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// AmqpChannel is the subset of an AMQP channel used by AmqpEmitter. It is
+// typically a thin adapter over a RabbitMQ client channel that publishes
+// body as the message payload.
+type AmqpChannel interface {
+	Publish(exchange, routingKey string, body []byte) error
+}
+
+// AmqpRoutingKeyFunc picks the routing key for an envelope.
+type AmqpRoutingKeyFunc func(*events.Envelope) string
+
+// AmqpConfig configures an AmqpEmitter.
+type AmqpConfig struct {
+	Exchange string
+
+	// Serializer defaults to ProtoSerializer.
+	Serializer EnvelopeSerializer
+
+	// RoutingKey defaults to RoutingKeyByEventType.
+	RoutingKey AmqpRoutingKeyFunc
+}
+
+// AmqpEmitter publishes each envelope as a message to an AMQP exchange.
+// Failed publishes are counted and returned; to buffer them for a later
+// retry, wrap the emitter in a DeadLetterEmitter.
+type AmqpEmitter struct {
+	channel AmqpChannel
+	origin  string
+	config  AmqpConfig
+}
+
+func NewAmqpEmitter(channel AmqpChannel, origin string, config AmqpConfig) *AmqpEmitter {
+	if config.Serializer == nil {
+		config.Serializer = ProtoSerializer
+	}
+	if config.RoutingKey == nil {
+		config.RoutingKey = RoutingKeyByEventType
+	}
+	return &AmqpEmitter{channel: channel, origin: origin, config: config}
+}
+
+// RoutingKeyByEventType routes envelopes by their event type, for example
+// "HttpStartStop" or "LogMessage".
+func RoutingKeyByEventType(envelope *events.Envelope) string {
+	return envelope.GetEventType().String()
+}
+
+func (e *AmqpEmitter) Origin() string {
+	return e.origin
+}
+
+func (e *AmqpEmitter) Emit(event events.Event) error {
+	envelope, err := Wrap(event, e.origin)
+	if err != nil {
+		return fmt.Errorf("Wrap: %v", err)
+	}
+
+	return e.EmitEnvelope(envelope)
+}
+
+func (e *AmqpEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	body, err := e.config.Serializer(envelope)
+	if err != nil {
+		return fmt.Errorf("Serialize: %v", err)
+	}
+
+	err = e.channel.Publish(e.config.Exchange, e.config.RoutingKey(envelope), body)
+	if err != nil {
+		metrics.BatchIncrementCounter("amqpEmitter.publishErrors")
+		return fmt.Errorf("Publish: %v", err)
+	}
+	return nil
+}
+
+// Close closes the channel if it implements io.Closer.
+func (e *AmqpEmitter) Close() {
+	if closer, ok := e.channel.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (e *AmqpEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"origin":   e.origin,
+		"exchange": e.config.Exchange,
+		"channel":  fmt.Sprintf("%T", e.channel),
+	}, nil, nil)
+}
@@ -0,0 +1,120 @@
+package emitter_test
+
+import (
+	"errors"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/envelopes"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AmqpEmitter", func() {
+	var (
+		channel     *fakeAmqpChannel
+		mockBatcher *mockMetricBatcher
+	)
+
+	BeforeEach(func() {
+		channel = &fakeAmqpChannel{}
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+	})
+
+	It("publishes proto-encoded envelopes to the exchange, routed by event type", func() {
+		amqpEmitter := emitter.NewAmqpEmitter(channel, "origin", emitter.AmqpConfig{Exchange: "dropsonde"})
+		Expect(amqpEmitter.Origin()).To(Equal("origin"))
+
+		Expect(amqpEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		Expect(amqpEmitter.Emit(factories.NewCounterEvent("counter", 1))).To(Succeed())
+
+		Expect(channel.messages).To(HaveLen(2))
+		Expect(channel.messages[0].exchange).To(Equal("dropsonde"))
+		Expect(channel.messages[0].routingKey).To(Equal("ValueMetric"))
+		Expect(channel.messages[1].routingKey).To(Equal("CounterEvent"))
+
+		envelope := new(events.Envelope)
+		Expect(proto.Unmarshal(channel.messages[0].body, envelope)).To(Succeed())
+		Expect(envelope.GetOrigin()).To(Equal("origin"))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("metric"))
+	})
+
+	It("uses the configured routing key function and serializer", func() {
+		amqpEmitter := emitter.NewAmqpEmitter(channel, "origin", emitter.AmqpConfig{
+			Exchange:   "dropsonde",
+			Serializer: emitter.JSONSerializer,
+			RoutingKey: func(envelope *events.Envelope) string {
+				return "metrics." + envelope.GetValueMetric().GetName()
+			},
+		})
+
+		Expect(amqpEmitter.Emit(factories.NewValueMetric("cpu", 1, "percent"))).To(Succeed())
+
+		Expect(channel.messages[0].routingKey).To(Equal("metrics.cpu"))
+		envelope, err := envelopes.FromJSON(channel.messages[0].body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("cpu"))
+	})
+
+	It("counts and returns publish errors", func() {
+		channel.err = errors.New("channel closed")
+		amqpEmitter := emitter.NewAmqpEmitter(channel, "origin", emitter.AmqpConfig{Exchange: "dropsonde"})
+
+		err := amqpEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))
+		Expect(err).To(MatchError("Publish: channel closed"))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("amqpEmitter.publishErrors"),
+		))
+	})
+
+	It("buffers failed publishes when wrapped in a DeadLetterEmitter", func() {
+		channel.err = errors.New("channel closed")
+		deadLetterEmitter := emitter.NewDeadLetterEmitter(emitter.NewAmqpEmitter(channel, "origin", emitter.AmqpConfig{Exchange: "dropsonde"}), 10)
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).ToNot(Succeed())
+
+		channel.err = nil
+		Expect(deadLetterEmitter.ReplayDeadLetters()).To(Equal(1))
+		Expect(channel.messages).To(HaveLen(1))
+	})
+
+	It("closes channels that can be closed", func() {
+		closer := &closingAmqpChannel{}
+		emitter.NewAmqpEmitter(closer, "origin", emitter.AmqpConfig{}).Close()
+
+		Expect(closer.closed).To(BeTrue())
+	})
+})
+
+type amqpMessage struct {
+	exchange, routingKey string
+	body                 []byte
+}
+
+type fakeAmqpChannel struct {
+	err      error
+	messages []amqpMessage
+}
+
+func (c *fakeAmqpChannel) Publish(exchange, routingKey string, body []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.messages = append(c.messages, amqpMessage{exchange: exchange, routingKey: routingKey, body: body})
+	return nil
+}
+
+type closingAmqpChannel struct {
+	fakeAmqpChannel
+	closed bool
+}
+
+func (c *closingAmqpChannel) Close() error {
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,265 @@
+package emitter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// ErrBufferClosed is returned by a BufferedEmitter for emits made after it
+// has been closed.
+var ErrBufferClosed = errors.New("buffered emitter: closed")
+
+// BufferedDropCounterName is the batched counter that counts messages a
+// BufferedEmitter discarded from its full buffer. It is the DropOverflow drop
+// counter, so it also counts envelopes discarded by other full buffers.
+const BufferedDropCounterName = dropCounterPrefix + string(DropOverflow)
+
+// BufferedOverflowSignalName is the CounterEvent a BufferedEmitter writes to
+// signal that it discarded messages, when enabled with SetOverflowSignal.
+const BufferedOverflowSignalName = "bufferedEmitter.overflow"
+
+// BufferedEmitter wraps a ByteEmitter so that emits never block the caller.
+// Messages are queued in a bounded ring buffer and written by a dedicated
+// goroutine. When the buffer is full the oldest message is discarded and
+// counted, so that a slow downstream costs data rather than latency.
+type BufferedEmitter struct {
+	innerEmitter ByteEmitter
+
+	lock     sync.Mutex
+	ready    *sync.Cond
+	messages [][]byte
+	enqueued []time.Time
+	head     int
+	count    int
+	writing  bool
+	idle     chan struct{}
+	closed   bool
+	done     chan struct{}
+
+	waitTimerName string
+
+	signalOrigin string
+	signalWindow time.Duration
+	lastSignal   time.Time
+	unsignaled   uint64
+}
+
+// NewBufferedEmitter creates a BufferedEmitter that buffers at most capacity
+// messages, and starts its flush goroutine. A capacity below one is treated
+// as one.
+func NewBufferedEmitter(byteEmitter ByteEmitter, capacity int) *BufferedEmitter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	e := &BufferedEmitter{
+		innerEmitter: byteEmitter,
+		messages:     make([][]byte, capacity),
+		done:         make(chan struct{}),
+	}
+	e.ready = sync.NewCond(&e.lock)
+
+	go e.run()
+	return e
+}
+
+// SetQueueWaitTimer configures the emitter to record how long each message
+// waited in the buffer, from Emit until the flush goroutine takes it, as a
+// sample of the named timer. Samples go to metrics.BatchTimer, so they are
+// only reported, as one summary per batch interval, when the metric batcher
+// aggregates timers; the emitter never sends an envelope per message about
+// its own messages. An empty name disables the timer, which is the default.
+// It must be called before the emitter is used.
+func (e *BufferedEmitter) SetQueueWaitTimer(name string) {
+	e.waitTimerName = name
+	e.enqueued = nil
+	if name != "" {
+		e.enqueued = make([]time.Time, len(e.messages))
+	}
+}
+
+// SetOverflowSignal configures the emitter to write a CounterEvent named
+// BufferedOverflowSignalName, from the given origin, when it discards
+// messages from its full buffer, so that monitoring can alert on saturation
+// without scraping the drop counters. Its delta is the number of messages
+// discarded since the previous signal. The signal is written at most once per
+// window, by the flush goroutine ahead of the next message; it bypasses the
+// buffer, so it is never itself discarded or counted, and errors writing it
+// are ignored. Discards made while the signal is held back are carried into
+// the next one, and any left when the emitter is closed are signalled before
+// the inner emitter is closed. A window of zero or less disables the signal,
+// which is the default. It must be called before the emitter is used.
+func (e *BufferedEmitter) SetOverflowSignal(origin string, window time.Duration) {
+	e.signalOrigin = origin
+	e.signalWindow = window
+}
+
+// Emit queues a copy of data to be written by the flush goroutine and
+// returns immediately. Errors from the inner emitter cannot be returned to
+// the caller, so they are counted as "bufferedEmitter.emitErrors" instead.
+func (e *BufferedEmitter) Emit(data []byte) error {
+	message := make([]byte, len(data))
+	copy(message, data)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrBufferClosed
+	}
+	if e.count == len(e.messages) {
+		e.pop()
+		CountDrop(DropOverflow)
+		if e.signalWindow > 0 {
+			e.unsignaled++
+		}
+	}
+	tail := (e.head + e.count) % len(e.messages)
+	e.messages[tail] = message
+	if e.enqueued != nil {
+		e.enqueued[tail] = time.Now()
+	}
+	e.count++
+	e.ready.Signal()
+	return nil
+}
+
+// Buffered returns the number of messages waiting to be written.
+func (e *BufferedEmitter) Buffered() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.count
+}
+
+// Drain waits until every message buffered so far has been written to the
+// inner emitter. It returns ctx.Err() if ctx is done first. Drain does not
+// stop the emitter accepting messages; wrap it in a QuiescingEmitter to wind
+// emission down.
+func (e *BufferedEmitter) Drain(ctx context.Context) error {
+	e.lock.Lock()
+	if e.count == 0 && !e.writing {
+		e.lock.Unlock()
+		return nil
+	}
+	if e.idle == nil {
+		e.idle = make(chan struct{})
+	}
+	idle := e.idle
+	e.lock.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting messages, waits for the buffered ones to be written
+// and closes the inner emitter.
+func (e *BufferedEmitter) Close() {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return
+	}
+	e.closed = true
+	e.ready.Signal()
+	e.lock.Unlock()
+
+	<-e.done
+	e.innerEmitter.Close()
+}
+
+func (e *BufferedEmitter) run() {
+	defer close(e.done)
+
+	for {
+		e.lock.Lock()
+		e.writing = false
+		if e.count == 0 && e.idle != nil {
+			close(e.idle)
+			e.idle = nil
+		}
+		for e.count == 0 && !e.closed {
+			e.ready.Wait()
+		}
+		if e.count == 0 {
+			discarded := e.takeUnsignaled(true)
+			e.lock.Unlock()
+			e.signalOverflow(discarded)
+			return
+		}
+		message := e.messages[e.head]
+		if e.enqueued != nil {
+			metrics.BatchTimer(e.waitTimerName, time.Since(e.enqueued[e.head]))
+		}
+		e.pop()
+		e.writing = true
+		discarded := e.takeUnsignaled(false)
+		e.lock.Unlock()
+
+		e.signalOverflow(discarded)
+		if err := e.innerEmitter.Emit(message); err != nil {
+			metrics.BatchIncrementCounter("bufferedEmitter.emitErrors")
+		}
+	}
+}
+
+// takeUnsignaled returns the number of discards to signal now, if any, and
+// resets it. Unless force is set, it returns zero when a signal was written
+// less than a window ago. It must be called with the lock held.
+func (e *BufferedEmitter) takeUnsignaled(force bool) uint64 {
+	if e.unsignaled == 0 {
+		return 0
+	}
+	now := time.Now()
+	if !force && now.Sub(e.lastSignal) < e.signalWindow {
+		return 0
+	}
+	discarded := e.unsignaled
+	e.unsignaled = 0
+	e.lastSignal = now
+	return discarded
+}
+
+func (e *BufferedEmitter) signalOverflow(discarded uint64) {
+	if discarded == 0 {
+		return
+	}
+	envelope, err := Wrap(&events.CounterEvent{
+		Name:  proto.String(BufferedOverflowSignalName),
+		Delta: proto.Uint64(discarded),
+	}, e.signalOrigin)
+	if err != nil {
+		return
+	}
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return
+	}
+	e.innerEmitter.Emit(data)
+}
+
+func (e *BufferedEmitter) pop() {
+	e.messages[e.head] = nil
+	e.head = (e.head + 1) % len(e.messages)
+	e.count--
+}
+
+func (e *BufferedEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"capacity":               len(e.messages),
+		"queue_wait_timer":       e.waitTimerName,
+		"overflow_signal_window": e.signalWindow.String(),
+	}, map[string]interface{}{
+		"buffered": e.Buffered(),
+	}, e.innerEmitter)
+}
@@ -0,0 +1,240 @@
+package emitter_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BufferedEmitter", func() {
+	var (
+		mockBatcher  *mockMetricBatcher
+		innerEmitter *blockingByteEmitter
+	)
+
+	BeforeEach(func() {
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+
+		innerEmitter = &blockingByteEmitter{
+			FakeByteEmitter: fake.NewFakeByteEmitter(),
+			started:         make(chan struct{}, 10),
+			release:         make(chan struct{}),
+		}
+	})
+
+	It("returns without waiting for the inner emitter", func() {
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+
+		Expect(bufferedEmitter.Emit([]byte("message"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+		Expect(innerEmitter.GetMessages()).To(BeEmpty())
+
+		close(innerEmitter.release)
+		Eventually(innerEmitter.GetMessages).Should(Equal([][]byte{[]byte("message")}))
+	})
+
+	It("writes a copy of the data", func() {
+		close(innerEmitter.release)
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+
+		data := []byte("message")
+		Expect(bufferedEmitter.Emit(data)).To(Succeed())
+		copy(data, "changed")
+
+		Eventually(innerEmitter.GetMessages).Should(Equal([][]byte{[]byte("message")}))
+	})
+
+	It("discards and counts the oldest messages when the buffer is full", func() {
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 2)
+
+		Expect(bufferedEmitter.Emit([]byte("first"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+		Expect(bufferedEmitter.Emit([]byte("second"))).To(Succeed())
+		Expect(bufferedEmitter.Emit([]byte("third"))).To(Succeed())
+		Expect(bufferedEmitter.Emit([]byte("fourth"))).To(Succeed())
+		Expect(bufferedEmitter.Buffered()).To(Equal(2))
+
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("droppedEnvelopes.overflow"),
+		))
+		Expect(emitter.BufferedDropCounterName).To(Equal("droppedEnvelopes.overflow"))
+		Expect(mockBatcher.BatchIncrementCounterCalled).To(HaveLen(1))
+
+		close(innerEmitter.release)
+		Eventually(innerEmitter.GetMessages).Should(Equal([][]byte{
+			[]byte("first"),
+			[]byte("third"),
+			[]byte("fourth"),
+		}))
+	})
+
+	It("signals discarded messages at most once per window", func() {
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 1)
+		bufferedEmitter.SetOverflowSignal("origin", time.Hour)
+
+		Expect(bufferedEmitter.Emit([]byte("first"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+		Expect(bufferedEmitter.Emit([]byte("second"))).To(Succeed())
+		Expect(bufferedEmitter.Emit([]byte("third"))).To(Succeed())
+
+		innerEmitter.release <- struct{}{}
+		Eventually(innerEmitter.started).Should(Receive())
+		innerEmitter.release <- struct{}{}
+		Eventually(innerEmitter.started).Should(Receive())
+		Expect(bufferedEmitter.Emit([]byte("fourth"))).To(Succeed())
+		Expect(bufferedEmitter.Emit([]byte("fifth"))).To(Succeed())
+
+		innerEmitter.release <- struct{}{}
+		Eventually(innerEmitter.started).Should(Receive())
+		innerEmitter.release <- struct{}{}
+		Eventually(innerEmitter.GetMessages).Should(HaveLen(4))
+		Consistently(innerEmitter.GetMessages).Should(HaveLen(4))
+
+		messages := innerEmitter.GetMessages()
+		Expect(messages[0]).To(Equal([]byte("first")))
+		Expect(overflowSignal(messages[1])).To(Equal(uint64(1)))
+		Expect(messages[2]).To(Equal([]byte("third")))
+		Expect(messages[3]).To(Equal([]byte("fifth")))
+		Expect(mockBatcher.BatchIncrementCounterCalled).To(HaveLen(2))
+
+		close(innerEmitter.release)
+		bufferedEmitter.Close()
+
+		messages = innerEmitter.GetMessages()
+		Expect(messages).To(HaveLen(5))
+		Expect(overflowSignal(messages[4])).To(Equal(uint64(1)))
+	})
+
+	It("records how long messages waited in the buffer", func() {
+		timingBatcher := newTimingMetricBatcher()
+		metrics.Initialize(nil, timingBatcher)
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+		bufferedEmitter.SetQueueWaitTimer("bufferedEmitter.queueWait")
+
+		Expect(bufferedEmitter.Emit([]byte("first"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+		Expect(bufferedEmitter.Emit([]byte("second"))).To(Succeed())
+		time.Sleep(50 * time.Millisecond)
+		close(innerEmitter.release)
+
+		Eventually(timingBatcher.BatchTimerInput.Name).Should(Receive(Equal("bufferedEmitter.queueWait")))
+		Eventually(timingBatcher.BatchTimerInput.Name).Should(Receive(Equal("bufferedEmitter.queueWait")))
+		Expect(timingBatcher.BatchTimerInput.Duration).To(Receive())
+		var secondWait time.Duration
+		Expect(timingBatcher.BatchTimerInput.Duration).To(Receive(&secondWait))
+		Expect(secondWait).To(BeNumerically(">=", 50*time.Millisecond))
+	})
+
+	It("does not record wait times by default", func() {
+		timingBatcher := newTimingMetricBatcher()
+		metrics.Initialize(nil, timingBatcher)
+		close(innerEmitter.release)
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+
+		Expect(bufferedEmitter.Emit([]byte("message"))).To(Succeed())
+
+		Eventually(innerEmitter.GetMessages).Should(HaveLen(1))
+		Consistently(timingBatcher.BatchTimerInput.Name).ShouldNot(Receive())
+	})
+
+	It("counts errors from the inner emitter", func() {
+		innerEmitter.ReturnError = errors.New("connection refused")
+		close(innerEmitter.release)
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+
+		Expect(bufferedEmitter.Emit([]byte("message"))).To(Succeed())
+
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("bufferedEmitter.emitErrors"),
+		))
+	})
+
+	It("writes buffered messages before closing the inner emitter", func() {
+		close(innerEmitter.release)
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+
+		Expect(bufferedEmitter.Emit([]byte("first"))).To(Succeed())
+		Expect(bufferedEmitter.Emit([]byte("second"))).To(Succeed())
+		bufferedEmitter.Close()
+
+		Expect(innerEmitter.GetMessages()).To(HaveLen(2))
+		Expect(innerEmitter.IsClosed()).To(BeTrue())
+	})
+
+	It("drains once every buffered message is written", func() {
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+		Expect(bufferedEmitter.Drain(context.Background())).To(Succeed())
+
+		Expect(bufferedEmitter.Emit([]byte("first"))).To(Succeed())
+		Expect(bufferedEmitter.Emit([]byte("second"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+
+		drained := make(chan error, 1)
+		go func() { drained <- bufferedEmitter.Drain(context.Background()) }()
+		Consistently(drained).ShouldNot(Receive())
+
+		close(innerEmitter.release)
+
+		Eventually(drained).Should(Receive(BeNil()))
+		Expect(innerEmitter.GetMessages()).To(HaveLen(2))
+	})
+
+	It("stops draining when the context is done", func() {
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+		Expect(bufferedEmitter.Emit([]byte("stuck"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+		defer close(innerEmitter.release)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		Expect(bufferedEmitter.Drain(ctx)).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("rejects emits after it is closed", func() {
+		bufferedEmitter := emitter.NewBufferedEmitter(innerEmitter, 10)
+		bufferedEmitter.Close()
+
+		Expect(bufferedEmitter.Emit([]byte("late"))).To(MatchError(emitter.ErrBufferClosed))
+	})
+})
+
+// timingMetricBatcher is a mockMetricBatcher that also aggregates timers.
+type timingMetricBatcher struct {
+	*mockMetricBatcher
+	BatchTimerInput struct {
+		Name     chan string
+		Duration chan time.Duration
+	}
+}
+
+func newTimingMetricBatcher() *timingMetricBatcher {
+	m := &timingMetricBatcher{mockMetricBatcher: newMockMetricBatcher()}
+	m.BatchTimerInput.Name = make(chan string, 100)
+	m.BatchTimerInput.Duration = make(chan time.Duration, 100)
+	return m
+}
+
+func (m *timingMetricBatcher) BatchTimer(name string, duration time.Duration) {
+	m.BatchTimerInput.Name <- name
+	m.BatchTimerInput.Duration <- duration
+}
+
+func overflowSignal(data []byte) uint64 {
+	var envelope events.Envelope
+	Expect(proto.Unmarshal(data, &envelope)).To(Succeed())
+	Expect(envelope.GetOrigin()).To(Equal("origin"))
+	Expect(envelope.GetCounterEvent().GetName()).To(Equal(emitter.BufferedOverflowSignalName))
+	return envelope.GetCounterEvent().GetDelta()
+}
@@ -0,0 +1,88 @@
+package emitter
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaos is returned by a ChaosEmitter when it injects an emit failure.
+var ErrChaos = errors.New("chaos emitter: injected failure")
+
+// ChaosConfig controls the faults a ChaosEmitter injects. Probabilities are
+// in the range [0, 1] and are evaluated independently for each emit.
+type ChaosConfig struct {
+	// DelayProbability is the chance an emit is delayed by Delay before it is
+	// otherwise handled.
+	DelayProbability float64
+	Delay            time.Duration
+
+	// DropProbability is the chance an emit is silently discarded.
+	DropProbability float64
+
+	// ErrorProbability is the chance an emit is discarded and ErrChaos is
+	// returned.
+	ErrorProbability float64
+}
+
+// ChaosEmitter wraps a ByteEmitter and injects latency, loss and errors to
+// simulate a flaky downstream.
+//
+// It is intended for testing the resilience of emitter chains and must not
+// be used in production.
+type ChaosEmitter struct {
+	innerEmitter ByteEmitter
+	config       ChaosConfig
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewChaosEmitter creates a ChaosEmitter. Emitters created with the same seed
+// and config make the same sequence of decisions.
+func NewChaosEmitter(byteEmitter ByteEmitter, config ChaosConfig, seed int64) *ChaosEmitter {
+	return &ChaosEmitter{
+		innerEmitter: byteEmitter,
+		config:       config,
+		rand:         rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (e *ChaosEmitter) Emit(data []byte) error {
+	e.lock.Lock()
+	delay := e.roll(e.config.DelayProbability)
+	drop := e.roll(e.config.DropProbability)
+	fail := e.roll(e.config.ErrorProbability)
+	e.lock.Unlock()
+
+	if delay {
+		time.Sleep(e.config.Delay)
+	}
+
+	switch {
+	case drop:
+		return nil
+	case fail:
+		return ErrChaos
+	default:
+		return e.innerEmitter.Emit(data)
+	}
+}
+
+func (e *ChaosEmitter) Close() {
+	e.innerEmitter.Close()
+}
+
+func (e *ChaosEmitter) roll(probability float64) bool {
+	return e.rand.Float64() < probability
+}
+
+func (e *ChaosEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"delay_probability": e.config.DelayProbability,
+		"delay":             e.config.Delay.String(),
+		"drop_probability":  e.config.DropProbability,
+		"error_probability": e.config.ErrorProbability,
+	}, nil, e.innerEmitter)
+}
@@ -0,0 +1,96 @@
+package emitter_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ChaosEmitter", func() {
+	const emits = 10000
+
+	var innerEmitter *fake.FakeByteEmitter
+
+	BeforeEach(func() {
+		innerEmitter = fake.NewFakeByteEmitter()
+	})
+
+	emitMany := func(chaosEmitter *emitter.ChaosEmitter) (errs int) {
+		for i := 0; i < emits; i++ {
+			if err := chaosEmitter.Emit([]byte("hello")); err != nil {
+				Expect(err).To(Equal(emitter.ErrChaos))
+				errs++
+			}
+		}
+		return errs
+	}
+
+	It("passes everything through with a zero config", func() {
+		chaosEmitter := emitter.NewChaosEmitter(innerEmitter, emitter.ChaosConfig{}, 1)
+
+		Expect(emitMany(chaosEmitter)).To(BeZero())
+		Expect(innerEmitter.GetMessages()).To(HaveLen(emits))
+	})
+
+	It("drops emits at the configured rate", func() {
+		chaosEmitter := emitter.NewChaosEmitter(innerEmitter, emitter.ChaosConfig{DropProbability: 0.3}, 1)
+
+		Expect(emitMany(chaosEmitter)).To(BeZero())
+		Expect(float64(emits - len(innerEmitter.GetMessages()))).To(BeNumerically("~", 0.3*emits, 0.02*emits))
+	})
+
+	It("fails emits at the configured rate", func() {
+		chaosEmitter := emitter.NewChaosEmitter(innerEmitter, emitter.ChaosConfig{ErrorProbability: 0.2}, 1)
+
+		errs := emitMany(chaosEmitter)
+		Expect(float64(errs)).To(BeNumerically("~", 0.2*emits, 0.02*emits))
+		Expect(innerEmitter.GetMessages()).To(HaveLen(emits - errs))
+	})
+
+	It("applies drops and errors independently", func() {
+		config := emitter.ChaosConfig{DropProbability: 0.5, ErrorProbability: 0.5}
+		chaosEmitter := emitter.NewChaosEmitter(innerEmitter, config, 1)
+
+		errs := emitMany(chaosEmitter)
+		Expect(float64(errs)).To(BeNumerically("~", 0.25*emits, 0.02*emits))
+		Expect(float64(len(innerEmitter.GetMessages()))).To(BeNumerically("~", 0.25*emits, 0.02*emits))
+	})
+
+	It("delays emits by the configured duration", func() {
+		config := emitter.ChaosConfig{DelayProbability: 1, Delay: 20 * time.Millisecond}
+		chaosEmitter := emitter.NewChaosEmitter(innerEmitter, config, 1)
+
+		start := time.Now()
+		Expect(chaosEmitter.Emit([]byte("hello"))).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", 20*time.Millisecond))
+		Expect(innerEmitter.GetMessages()).To(HaveLen(1))
+	})
+
+	It("makes the same decisions for the same seed", func() {
+		config := emitter.ChaosConfig{DropProbability: 0.5}
+		otherEmitter := fake.NewFakeByteEmitter()
+
+		first := emitter.NewChaosEmitter(innerEmitter, config, 7)
+		second := emitter.NewChaosEmitter(otherEmitter, config, 7)
+		for i := 0; i < 100; i++ {
+			data := []byte{byte(i)}
+			first.Emit(data)
+			second.Emit(data)
+		}
+
+		Expect(innerEmitter.GetMessages()).ToNot(BeEmpty())
+		Expect(innerEmitter.GetMessages()).To(Equal(otherEmitter.GetMessages()))
+	})
+
+	It("closes the inner emitter", func() {
+		chaosEmitter := emitter.NewChaosEmitter(innerEmitter, emitter.ChaosConfig{}, 1)
+
+		chaosEmitter.Close()
+
+		Expect(innerEmitter.IsClosed()).To(BeTrue())
+	})
+})
@@ -0,0 +1,140 @@
+package emitter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// EnvelopeEmitter emits envelopes, as EventEmitter does.
+type EnvelopeEmitter interface {
+	EmitEnvelope(*events.Envelope) error
+	Origin() string
+}
+
+const defaultMaxReplayAttempts = 5
+
+// DeadLetterEmitter wraps an EnvelopeEmitter and keeps the envelopes it
+// fails to emit in a bounded buffer, so that they can be replayed with
+// ReplayDeadLetters once the downstream has recovered. When the buffer is
+// full the oldest dead letter is discarded and counted. Envelopes rejected
+// for being too large to ever send are not kept.
+type DeadLetterEmitter struct {
+	innerEmitter      EnvelopeEmitter
+	letters           *envelopeQueue
+	maxReplayAttempts int
+}
+
+// NewDeadLetterEmitter creates a DeadLetterEmitter that keeps at most
+// capacity dead letters.
+func NewDeadLetterEmitter(innerEmitter EnvelopeEmitter, capacity int) *DeadLetterEmitter {
+	return &DeadLetterEmitter{
+		innerEmitter:      innerEmitter,
+		letters:           newEnvelopeQueue(capacity),
+		maxReplayAttempts: defaultMaxReplayAttempts,
+	}
+}
+
+// SetMaxReplayAttempts sets how many replays may fail for a dead letter
+// before it is abandoned, so that an envelope that can never be emitted does
+// not stay buffered forever. It defaults to 5; values below one are treated
+// as one. It must be called before the emitter is used.
+func (e *DeadLetterEmitter) SetMaxReplayAttempts(attempts int) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	e.maxReplayAttempts = attempts
+}
+
+func (e *DeadLetterEmitter) Origin() string {
+	return e.innerEmitter.Origin()
+}
+
+func (e *DeadLetterEmitter) Emit(event events.Event) error {
+	envelope, err := Wrap(event, e.innerEmitter.Origin())
+	if err != nil {
+		return fmt.Errorf("Wrap: %v", err)
+	}
+
+	return e.EmitEnvelope(envelope)
+}
+
+// EmitEnvelope emits envelope, keeping it as a dead letter if that fails.
+// The envelope is stamped with the current time if it has no timestamp, so
+// that a replay reports when it was originally emitted.
+func (e *DeadLetterEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	if envelope.Timestamp == nil {
+		stamped := *envelope
+		stamped.Timestamp = proto.Int64(time.Now().UnixNano())
+		envelope = &stamped
+	}
+
+	err := e.innerEmitter.EmitEnvelope(envelope)
+	if err != nil && !isTooLarge(err) {
+		e.keep(envelope)
+	}
+	return err
+}
+
+// ReplayDeadLetters re-emits each dead letter once, oldest first, and returns
+// how many were replayed along with the last error. Dead letters that fail
+// again stay buffered for a later replay, behind the others, unless they have
+// failed the maximum number of replays; those are abandoned and counted. The
+// buffer is not locked while dead letters are emitted, so emits that fail
+// during a replay are still kept. Dead letters that no longer fit once the
+// replay ends are discarded and counted.
+func (e *DeadLetterEmitter) ReplayDeadLetters() (int, error) {
+	var (
+		replayed int
+		lastErr  error
+	)
+	overflow := e.letters.each(func(letter *queuedEnvelope) bool {
+		err := e.innerEmitter.EmitEnvelope(letter.envelope)
+		if err == nil {
+			replayed++
+			return false
+		}
+
+		lastErr = err
+		letter.attempts++
+		if letter.attempts >= e.maxReplayAttempts || isTooLarge(err) {
+			metrics.BatchIncrementCounter("deadLetterEmitter.abandonedEnvelopes")
+			return false
+		}
+		return true
+	})
+	for range overflow {
+		e.countDiscard()
+	}
+	return replayed, lastErr
+}
+
+// DeadLetters returns the number of envelopes waiting to be replayed.
+func (e *DeadLetterEmitter) DeadLetters() int {
+	return e.letters.len()
+}
+
+// keep buffers envelope as a dead letter, discarding the oldest one if the
+// buffer is full.
+func (e *DeadLetterEmitter) keep(envelope *events.Envelope) {
+	if e.letters.push(&queuedEnvelope{envelope: envelope}) {
+		e.countDiscard()
+	}
+}
+
+func (e *DeadLetterEmitter) countDiscard() {
+	metrics.BatchIncrementCounter("deadLetterEmitter.discardedEnvelopes")
+	CountDrop(DropOverflow)
+}
+
+func (e *DeadLetterEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"capacity":            e.letters.capacity(),
+		"max_replay_attempts": e.maxReplayAttempts,
+	}, map[string]interface{}{
+		"dead_letters": e.DeadLetters(),
+	}, e.innerEmitter)
+}
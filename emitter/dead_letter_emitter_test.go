@@ -0,0 +1,267 @@
+package emitter_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DeadLetterEmitter", func() {
+	var (
+		downstream        *flakyEnvelopeEmitter
+		mockBatcher       *mockMetricBatcher
+		deadLetterEmitter *emitter.DeadLetterEmitter
+	)
+
+	BeforeEach(func() {
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+
+		downstream = &flakyEnvelopeEmitter{FakeEventEmitter: fake.NewFakeEventEmitter("origin")}
+		deadLetterEmitter = emitter.NewDeadLetterEmitter(downstream, 3)
+	})
+
+	var metricNames = func() []string {
+		var names []string
+		for _, envelope := range downstream.GetEnvelopes() {
+			names = append(names, envelope.GetValueMetric().GetName())
+		}
+		return names
+	}
+
+	It("passes envelopes through while the downstream is healthy", func() {
+		Expect(deadLetterEmitter.Origin()).To(Equal("origin"))
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Expect(metricNames()).To(Equal([]string{"metric"}))
+		Expect(deadLetterEmitter.DeadLetters()).To(BeZero())
+	})
+
+	It("replays envelopes dropped while the downstream was failing", func() {
+		downstream.err = errors.New("connection refused")
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("first", 1, "unit"))).To(MatchError("connection refused"))
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("second", 1, "unit"))).To(MatchError("connection refused"))
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(2))
+
+		downstream.err = nil
+		Expect(deadLetterEmitter.ReplayDeadLetters()).To(Equal(2))
+
+		Expect(metricNames()).To(Equal([]string{"first", "second"}))
+		Expect(deadLetterEmitter.DeadLetters()).To(BeZero())
+	})
+
+	It("preserves the original timestamps of replayed envelopes", func() {
+		downstream.err = errors.New("connection refused")
+		originalTime := time.Now().Add(-time.Minute).UnixNano()
+		envelope := &events.Envelope{
+			Origin:      proto.String("origin"),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			Timestamp:   proto.Int64(originalTime),
+			ValueMetric: factories.NewValueMetric("stamped", 1, "unit"),
+		}
+		deadLetterEmitter.EmitEnvelope(envelope)
+		deadLetterEmitter.EmitEnvelope(&events.Envelope{
+			Origin:      proto.String("origin"),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			ValueMetric: factories.NewValueMetric("unstamped", 1, "unit"),
+		})
+		failedAt := time.Now().UnixNano()
+
+		time.Sleep(10 * time.Millisecond)
+		downstream.err = nil
+		Expect(deadLetterEmitter.ReplayDeadLetters()).To(Equal(2))
+
+		replayed := downstream.GetEnvelopes()
+		Expect(replayed[0].GetTimestamp()).To(Equal(originalTime))
+		Expect(replayed[1].GetTimestamp()).To(BeNumerically("<=", failedAt))
+	})
+
+	It("keeps the remaining dead letters when a replay fails", func() {
+		downstream.err = errors.New("connection refused")
+		deadLetterEmitter.Emit(factories.NewValueMetric("first", 1, "unit"))
+		deadLetterEmitter.Emit(factories.NewValueMetric("second", 1, "unit"))
+
+		downstream.failAfter(1, errors.New("connection reset"))
+		replayed, err := deadLetterEmitter.ReplayDeadLetters()
+		Expect(err).To(MatchError("connection reset"))
+		Expect(replayed).To(Equal(1))
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(1))
+
+		downstream.failAfter(0, nil)
+		Expect(deadLetterEmitter.ReplayDeadLetters()).To(Equal(1))
+		Expect(metricNames()).To(Equal([]string{"first", "second"}))
+	})
+
+	It("discards and counts the oldest dead letters when full", func() {
+		downstream.err = errors.New("connection refused")
+		for i := 0; i < 5; i++ {
+			deadLetterEmitter.Emit(factories.NewValueMetric(fmt.Sprintf("metric-%d", i), 1, "unit"))
+		}
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(3))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("deadLetterEmitter.discardedEnvelopes"),
+		))
+		Expect(mockBatcher.BatchIncrementCounterInput).To(BeCalled(
+			With("droppedEnvelopes.overflow"),
+		))
+		Expect(mockBatcher.BatchIncrementCounterCalled).To(HaveLen(4))
+
+		downstream.err = nil
+		Expect(deadLetterEmitter.ReplayDeadLetters()).To(Equal(3))
+		Expect(metricNames()).To(Equal([]string{"metric-2", "metric-3", "metric-4"}))
+	})
+
+	It("does not keep envelopes that are too large to send", func() {
+		downstream.err = &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.EMSGSIZE)}
+
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("huge", 1, "unit"))).ToNot(Succeed())
+		Expect(deadLetterEmitter.DeadLetters()).To(BeZero())
+	})
+
+	It("keeps messages that merely mention the size error", func() {
+		downstream.err = fmt.Errorf("proxy said: %v", syscall.EMSGSIZE)
+
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).ToNot(Succeed())
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(1))
+	})
+
+	It("replays past a dead letter that keeps failing", func() {
+		downstream.err = errors.New("connection refused")
+		deadLetterEmitter.Emit(factories.NewValueMetric("poison", 1, "unit"))
+		deadLetterEmitter.Emit(factories.NewValueMetric("healthy", 1, "unit"))
+
+		downstream.err = nil
+		downstream.rejectName = "poison"
+		replayed, err := deadLetterEmitter.ReplayDeadLetters()
+		Expect(err).To(MatchError("rejected"))
+		Expect(replayed).To(Equal(1))
+		Expect(metricNames()).To(Equal([]string{"healthy"}))
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(1))
+	})
+
+	It("keeps accepting dead letters while a replay is emitting", func() {
+		stalling := &stallingEnvelopeEmitter{
+			FakeEventEmitter: fake.NewFakeEventEmitter("origin"),
+			started:          make(chan struct{}, 1),
+			release:          make(chan struct{}),
+		}
+		deadLetterEmitter := emitter.NewDeadLetterEmitter(stalling, 3)
+		Expect(deadLetterEmitter.Emit(factories.NewValueMetric("slow", 1, "unit"))).To(HaveOccurred())
+
+		stalling.stallOn("slow")
+		replayed := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			deadLetterEmitter.ReplayDeadLetters()
+			close(replayed)
+		}()
+		Eventually(stalling.started).Should(Receive())
+
+		emitted := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			deadLetterEmitter.Emit(factories.NewValueMetric("meanwhile", 1, "unit"))
+			close(emitted)
+		}()
+		Eventually(emitted).Should(BeClosed())
+		Expect(replayed).ToNot(BeClosed())
+
+		close(stalling.release)
+		Eventually(replayed).Should(BeClosed())
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(2))
+	})
+
+	It("abandons dead letters that fail every allowed replay", func() {
+		deadLetterEmitter.SetMaxReplayAttempts(2)
+		downstream.err = errors.New("connection refused")
+		deadLetterEmitter.Emit(factories.NewValueMetric("poison", 1, "unit"))
+
+		downstream.err = nil
+		downstream.rejectName = "poison"
+		deadLetterEmitter.ReplayDeadLetters()
+		Expect(deadLetterEmitter.DeadLetters()).To(Equal(1))
+		deadLetterEmitter.ReplayDeadLetters()
+
+		Expect(deadLetterEmitter.DeadLetters()).To(BeZero())
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("deadLetterEmitter.abandonedEnvelopes"),
+		))
+	})
+})
+
+type flakyEnvelopeEmitter struct {
+	*fake.FakeEventEmitter
+	err        error
+	successes  int
+	laterErr   error
+	rejectName string
+}
+
+// failAfter lets n more envelopes through and then fails with err, or keeps
+// letting envelopes through if err is nil.
+func (f *flakyEnvelopeEmitter) failAfter(n int, err error) {
+	f.err = nil
+	f.successes = n
+	f.laterErr = err
+}
+
+func (f *flakyEnvelopeEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	if f.laterErr != nil {
+		if f.successes == 0 {
+			return f.laterErr
+		}
+		f.successes--
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if f.rejectName != "" && envelope.GetValueMetric().GetName() == f.rejectName {
+		return errors.New("rejected")
+	}
+	return f.FakeEventEmitter.EmitEnvelope(envelope)
+}
+
+// stallingEnvelopeEmitter fails every emit, and blocks emits of the named
+// envelope until released.
+type stallingEnvelopeEmitter struct {
+	*fake.FakeEventEmitter
+	started chan struct{}
+	release chan struct{}
+
+	lock      sync.Mutex
+	stallName string
+}
+
+func (s *stallingEnvelopeEmitter) stallOn(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stallName = name
+}
+
+func (s *stallingEnvelopeEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	s.lock.Lock()
+	stall := s.stallName != "" && envelope.GetValueMetric().GetName() == s.stallName
+	s.lock.Unlock()
+
+	if stall {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return errors.New("connection refused")
+}
@@ -0,0 +1,88 @@
+package emitter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StageDescription describes one stage of an emitter chain for diagnostics.
+// It is JSON-serializable.
+type StageDescription struct {
+	// Type is the Go type of the stage, such as "*emitter.UDPEmitter".
+	Type string `json:"type"`
+	// Config holds the settings the stage was built with.
+	Config map[string]interface{} `json:"config,omitempty"`
+	// State holds live values that change as the stage is used.
+	State map[string]interface{} `json:"state,omitempty"`
+}
+
+// A Describer can describe itself, followed by the stages it wraps.
+type Describer interface {
+	Describe() []StageDescription
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveWords mark config keys, and tag keys within them, whose values are
+// replaced by "[REDACTED]" in descriptions.
+var sensitiveWords = []string{"secret", "password", "token", "key", "cert", "credential"}
+
+// DescribeChain describes the emitter chain starting at stage, which may be
+// any emitter. Stages that do not implement Describer are described by their
+// type alone and end the chain.
+func DescribeChain(stage interface{}) []StageDescription {
+	if describer, ok := stage.(Describer); ok {
+		return describer.Describe()
+	}
+	return []StageDescription{{Type: fmt.Sprintf("%T", stage)}}
+}
+
+// DescribeStage builds the description of a stage that wraps inner, which may
+// be nil for the last stage of a chain. Sensitive config values are redacted.
+func DescribeStage(stage interface{}, config, state map[string]interface{}, inner interface{}) []StageDescription {
+	description := []StageDescription{{
+		Type:   fmt.Sprintf("%T", stage),
+		Config: redact(config),
+		State:  state,
+	}}
+	if inner != nil {
+		description = append(description, DescribeChain(inner)...)
+	}
+	return description
+}
+
+func redact(config map[string]interface{}) map[string]interface{} {
+	if config == nil {
+		return nil
+	}
+
+	safe := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		if isSensitive(key) {
+			safe[key] = redacted
+			continue
+		}
+		if tags, ok := value.(map[string]string); ok {
+			safeTags := make(map[string]string, len(tags))
+			for tagKey, tagValue := range tags {
+				if isSensitive(tagKey) {
+					tagValue = redacted
+				}
+				safeTags[tagKey] = tagValue
+			}
+			value = safeTags
+		}
+		safe[key] = value
+	}
+	return safe
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range sensitiveWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package emitter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DescribeChain", func() {
+	var types = func(description []emitter.StageDescription) []string {
+		var names []string
+		for _, stage := range description {
+			names = append(names, stage.Type)
+		}
+		return names
+	}
+
+	It("describes each stage of the chain in order", func() {
+		byteEmitter := emitter.NewTimeoutEmitter(emitter.NewWriterEmitter(new(bytes.Buffer), emitter.NewlineFramer{}), time.Second)
+		eventEmitter := emitter.NewEventEmitter(byteEmitter, "origin")
+		eventEmitter.SetMetricPrefix("myapp.")
+		deadLetterEmitter := emitter.NewDeadLetterEmitter(eventEmitter, 5)
+
+		description := emitter.DescribeChain(deadLetterEmitter)
+
+		Expect(types(description)).To(Equal([]string{
+			"*emitter.DeadLetterEmitter",
+			"*emitter.EventEmitter",
+			"*emitter.TimeoutEmitter",
+			"*emitter.WriterEmitter",
+		}))
+		Expect(description[0].Config).To(HaveKeyWithValue("capacity", 5))
+		Expect(description[0].State).To(HaveKeyWithValue("dead_letters", 0))
+		Expect(description[1].Config).To(HaveKeyWithValue("origin", "origin"))
+		Expect(description[1].Config).To(HaveKeyWithValue("metric_prefix", "myapp."))
+		Expect(description[2].Config).To(HaveKeyWithValue("timeout", "1s"))
+		Expect(description[3].Config).To(HaveKeyWithValue("framer", "emitter.NewlineFramer"))
+	})
+
+	It("reports live state", func() {
+		quiescingEmitter := emitter.NewQuiescingEmitter(fake.NewFakeByteEmitter())
+		Expect(emitter.DescribeChain(quiescingEmitter)[0].State).To(HaveKeyWithValue("quiescing", false))
+
+		quiescingEmitter.Quiesce(context.Background())
+		Expect(emitter.DescribeChain(quiescingEmitter)[0].State).To(HaveKeyWithValue("quiescing", true))
+	})
+
+	It("describes stages that cannot describe themselves by type", func() {
+		description := emitter.DescribeChain(emitter.NewEventEmitter(fake.NewFakeByteEmitter(), "origin"))
+
+		Expect(types(description)).To(Equal([]string{"*emitter.EventEmitter", "*fake.FakeByteEmitter"}))
+		Expect(description[1].Config).To(BeNil())
+	})
+
+	It("redacts sensitive values", func() {
+		eventEmitter := emitter.NewEventEmitter(fake.NewFakeByteEmitter(), "origin")
+		eventEmitter.SetDefaultTag("deployment", "cf")
+		eventEmitter.SetDefaultTag("api_key", "s3cr3t")
+		eventEmitter.SetDefaultTag("auth_token", "t0k3n")
+
+		description := emitter.DescribeChain(eventEmitter)
+
+		Expect(description[0].Config["default_tags"]).To(Equal(map[string]string{
+			"deployment": "cf",
+			"api_key":    "[REDACTED]",
+			"auth_token": "[REDACTED]",
+		}))
+
+		stage := emitter.DescribeStage(eventEmitter, map[string]interface{}{
+			"client_cert": "-----BEGIN CERTIFICATE-----",
+			"password":    "hunter2",
+			"address":     "localhost:3457",
+		}, nil, nil)
+		Expect(stage[0].Config).To(Equal(map[string]interface{}{
+			"client_cert": "[REDACTED]",
+			"password":    "[REDACTED]",
+			"address":     "localhost:3457",
+		}))
+	})
+
+	It("can be serialized as JSON", func() {
+		eventEmitter := emitter.NewEventEmitter(emitter.NewChaosEmitter(fake.NewFakeByteEmitter(), emitter.ChaosConfig{DropProbability: 0.5}, 1), "origin")
+		eventEmitter.SetDefaultTag("secret", "s3cr3t")
+
+		data, err := json.Marshal(emitter.DescribeChain(eventEmitter))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"type":"*emitter.ChaosEmitter"`))
+		Expect(string(data)).To(ContainSubstring(`"drop_probability":0.5`))
+		Expect(string(data)).ToNot(ContainSubstring("s3cr3t"))
+	})
+})
@@ -0,0 +1,49 @@
+package emitter
+
+import "github.com/cloudfoundry/dropsonde/metrics"
+
+// A DropReason classifies why an envelope was dropped before reaching its
+// destination.
+type DropReason string
+
+const (
+	// DropOversized envelopes were too large for the transport.
+	DropOversized DropReason = "oversized"
+	// DropTimeout envelopes were abandoned after a transport took too long.
+	DropTimeout DropReason = "timeout"
+	// DropOverflow envelopes were discarded from a full buffer.
+	DropOverflow DropReason = "overflow"
+	// DropSampled envelopes were deliberately left out by a sampler.
+	DropSampled DropReason = "sampled"
+	// DropUnserializable envelopes could not be encoded by a custom
+	// serializer.
+	DropUnserializable DropReason = "unserializable"
+)
+
+// DropReasons lists every DropReason, in a stable order.
+var DropReasons = []DropReason{DropOversized, DropTimeout, DropOverflow, DropSampled, DropUnserializable}
+
+const dropCounterPrefix = "droppedEnvelopes."
+
+// CounterName returns the name of the batched counter that counts drops for
+// this reason, such as "droppedEnvelopes.timeout".
+func (r DropReason) CounterName() string {
+	return dropCounterPrefix + string(r)
+}
+
+// DropCounterNames returns the counter names of every DropReason. Registering
+// them with a metric batcher's AddConsistentlyEmittedMetrics turns the drop
+// counts into a periodic summary that is emitted even when nothing was
+// dropped.
+func DropCounterNames() []string {
+	names := make([]string, 0, len(DropReasons))
+	for _, reason := range DropReasons {
+		names = append(names, reason.CounterName())
+	}
+	return names
+}
+
+// CountDrop counts one dropped envelope under the given reason.
+func CountDrop(reason DropReason) {
+	metrics.BatchIncrementCounter(reason.CounterName())
+}
@@ -0,0 +1,107 @@
+package emitter_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/metric_sender"
+	"github.com/cloudfoundry/dropsonde/metricbatcher"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/dropsonde/sampling"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drop summary", func() {
+	var sink *fake.FakeEventEmitter
+
+	BeforeEach(func() {
+		sink = fake.NewFakeEventEmitter("origin")
+		batcher := metricbatcher.New(metric_sender.NewMetricSender(sink), 10*time.Millisecond)
+		batcher.AddConsistentlyEmittedMetrics(emitter.DropCounterNames()...)
+		metrics.Initialize(nil, batcher)
+	})
+
+	AfterEach(func() {
+		metrics.Initialize(nil, nil)
+	})
+
+	var dropCounts = func() map[string]uint64 {
+		counts := make(map[string]uint64)
+		for _, envelope := range sink.GetEnvelopes() {
+			name := envelope.GetCounterEvent().GetName()
+			if strings.HasPrefix(name, "droppedEnvelopes.") {
+				counts[name] += envelope.GetCounterEvent().GetDelta()
+			}
+		}
+		return counts
+	}
+
+	It("names a counter for each reason", func() {
+		Expect(emitter.DropCounterNames()).To(Equal([]string{
+			"droppedEnvelopes.oversized",
+			"droppedEnvelopes.timeout",
+			"droppedEnvelopes.overflow",
+			"droppedEnvelopes.sampled",
+			"droppedEnvelopes.unserializable",
+		}))
+	})
+
+	It("periodically emits zero counts when nothing is dropped", func() {
+		Eventually(dropCounts).Should(Equal(map[string]uint64{
+			"droppedEnvelopes.oversized":      0,
+			"droppedEnvelopes.timeout":        0,
+			"droppedEnvelopes.overflow":       0,
+			"droppedEnvelopes.sampled":        0,
+			"droppedEnvelopes.unserializable": 0,
+		}))
+	})
+
+	It("counts drops by reason", func() {
+		listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		udpEmitter, err := emitter.NewUdpEmitter(listener.LocalAddr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer udpEmitter.Close()
+		Expect(udpEmitter.Emit(make([]byte, 70000))).ToNot(Succeed())
+
+		blocking := &blockingByteEmitter{
+			FakeByteEmitter: fake.NewFakeByteEmitter(),
+			started:         make(chan struct{}, 10),
+			release:         make(chan struct{}),
+		}
+		defer close(blocking.release)
+		Expect(emitter.NewTimeoutEmitter(blocking, 10*time.Millisecond).Emit([]byte("slow"))).To(MatchError(emitter.ErrTimeout))
+
+		failing := &flakyEnvelopeEmitter{FakeEventEmitter: fake.NewFakeEventEmitter("origin"), err: errors.New("down")}
+		deadLetterEmitter := emitter.NewDeadLetterEmitter(failing, 1)
+		deadLetterEmitter.Emit(factories.NewValueMetric("first", 1, "unit"))
+		deadLetterEmitter.Emit(factories.NewValueMetric("second", 1, "unit"))
+		deadLetterEmitter.Emit(factories.NewValueMetric("third", 1, "unit"))
+
+		sampledEmitter := sampling.NewEmitter(fake.NewFakeEventEmitter("origin"), sampling.NewRateSampler(0, 1))
+		Expect(sampledEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		serializingEmitter := emitter.NewEventEmitter(fake.NewFakeByteEmitter(), "origin")
+		serializingEmitter.SetSerializer(func(*events.Envelope) ([]byte, error) {
+			return nil, errors.New("unsupported")
+		})
+		Expect(serializingEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).ToNot(Succeed())
+
+		Eventually(dropCounts).Should(Equal(map[string]uint64{
+			"droppedEnvelopes.oversized":      1,
+			"droppedEnvelopes.timeout":        1,
+			"droppedEnvelopes.overflow":       2,
+			"droppedEnvelopes.sampled":        1,
+			"droppedEnvelopes.unserializable": 1,
+		}))
+	})
+})
@@ -0,0 +1,125 @@
+package emitter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// queuedEnvelope is an envelope waiting in an envelopeQueue, with the
+// bookkeeping its owner needs to decide when to give up on it.
+type queuedEnvelope struct {
+	envelope *events.Envelope
+	attempts int
+	expires  time.Time
+}
+
+// envelopeQueue is a bounded FIFO queue of envelopes awaiting another emit
+// attempt, shared by the emitters that retry envelopes. It is safe for
+// concurrent use.
+type envelopeQueue struct {
+	lock    sync.Mutex
+	entries []*queuedEnvelope
+	head    int
+	count   int
+}
+
+func newEnvelopeQueue(capacity int) *envelopeQueue {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &envelopeQueue{entries: make([]*queuedEnvelope, capacity)}
+}
+
+// offer appends entry unless the queue is full, and reports whether it did.
+func (q *envelopeQueue) offer(entry *queuedEnvelope) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.count == len(q.entries) {
+		return false
+	}
+	q.append(entry)
+	return true
+}
+
+// push appends entry, discarding the oldest entry if the queue is full. It
+// reports whether an entry was discarded, which is entry itself for a queue
+// without capacity.
+func (q *envelopeQueue) push(entry *queuedEnvelope) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.entries) == 0 {
+		return true
+	}
+	discarded := q.count == len(q.entries)
+	if discarded {
+		q.pop()
+	}
+	q.append(entry)
+	return discarded
+}
+
+// each removes the entries queued when it is called and calls retry once for
+// each of them, oldest first. The queue is unlocked while retry runs, so that
+// emits made by it do not block other users of the queue. Entries for which
+// retry returns true are queued again, behind any entries added meanwhile.
+// Those that no longer fit are returned, for the caller to dispose of.
+func (q *envelopeQueue) each(retry func(*queuedEnvelope) bool) []*queuedEnvelope {
+	q.lock.Lock()
+	taken := make([]*queuedEnvelope, 0, q.count)
+	for q.count > 0 {
+		taken = append(taken, q.entries[q.head])
+		q.pop()
+	}
+	q.lock.Unlock()
+
+	var kept []*queuedEnvelope
+	for _, entry := range taken {
+		if retry(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var overflow []*queuedEnvelope
+	for _, entry := range kept {
+		if q.count == len(q.entries) {
+			overflow = append(overflow, entry)
+			continue
+		}
+		q.append(entry)
+	}
+	return overflow
+}
+
+// len returns the number of queued entries.
+func (q *envelopeQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.count
+}
+
+// capacity returns the most entries the queue holds.
+func (q *envelopeQueue) capacity() int {
+	return len(q.entries)
+}
+
+func (q *envelopeQueue) append(entry *queuedEnvelope) {
+	q.entries[(q.head+q.count)%len(q.entries)] = entry
+	q.count++
+}
+
+func (q *envelopeQueue) pop() {
+	q.entries[q.head] = nil
+	q.head = (q.head + 1) % len(q.entries)
+	q.count--
+}
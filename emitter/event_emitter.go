@@ -2,7 +2,10 @@ package emitter
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
 )
@@ -13,14 +16,79 @@ type ByteEmitter interface {
 }
 
 type EventEmitter struct {
-	innerEmitter ByteEmitter
-	origin       string
+	innerEmitter  ByteEmitter
+	origin        string
+	defaultTags   map[string]string
+	metricPrefix  string
+	maxTags       int
+	maxTagBytes   int
+	protectedTags map[string]bool
+	recoverPanics bool
+	clockOffset   time.Duration
+	offsetPayload bool
+	serializer    EnvelopeSerializer
 }
 
 func NewEventEmitter(byteEmitter ByteEmitter, origin string) *EventEmitter {
 	return &EventEmitter{innerEmitter: byteEmitter, origin: origin}
 }
 
+// SetDefaultTag adds a tag to every emitted envelope that does not already
+// carry a tag with the same key. It must be called before the emitter is
+// used.
+func (e *EventEmitter) SetDefaultTag(key, value string) {
+	if e.defaultTags == nil {
+		e.defaultTags = make(map[string]string)
+	}
+	e.defaultTags[key] = value
+}
+
+// SetMetricPrefix prepends prefix to the name of every emitted ValueMetric
+// and CounterEvent. An empty prefix leaves names unchanged. It must be called
+// before the emitter is used.
+func (e *EventEmitter) SetMetricPrefix(prefix string) {
+	e.metricPrefix = prefix
+}
+
+// SetTagLimits caps the number of tags, and their total size in bytes (keys
+// plus values), on each emitted envelope. A limit of zero disables it. The
+// protected tags are always kept; the remaining tags are kept in key order
+// until a limit is reached and the rest are trimmed and counted. It must be
+// called before the emitter is used.
+func (e *EventEmitter) SetTagLimits(maxTags, maxTagBytes int, protected ...string) {
+	e.maxTags = maxTags
+	e.maxTagBytes = maxTagBytes
+	e.protectedTags = make(map[string]bool, len(protected))
+	for _, key := range protected {
+		e.protectedTags[key] = true
+	}
+}
+
+// SetPanicRecovery controls whether a panic while marshaling or emitting a
+// single envelope is recovered, counted and returned as an error instead of
+// crashing the process. It is off by default so that such bugs surface during
+// development. It must be called before the emitter is used.
+func (e *EventEmitter) SetPanicRecovery(enabled bool) {
+	e.recoverPanics = enabled
+}
+
+// SetClockOffset shifts the timestamp of every emitted envelope by offset,
+// which may be negative, to correct for a skewed host clock. When payloads is
+// true, the timestamps carried by HttpStartStop and LogMessage events are
+// shifted too. It must be called before the emitter is used.
+func (e *EventEmitter) SetClockOffset(offset time.Duration, payloads bool) {
+	e.clockOffset = offset
+	e.offsetPayload = payloads
+}
+
+// SetSerializer replaces the protobuf encoding of emitted envelopes with
+// serializer, so that the inner emitter receives a custom wire format.
+// Envelopes the serializer fails to encode are counted as dropped with
+// DropUnserializable. It must be called before the emitter is used.
+func (e *EventEmitter) SetSerializer(serializer EnvelopeSerializer) {
+	e.serializer = serializer
+}
+
 func (e *EventEmitter) Origin() string {
 	return e.origin
 }
@@ -34,7 +102,39 @@ func (e *EventEmitter) Emit(event events.Event) error {
 	return e.EmitEnvelope(envelope)
 }
 
-func (e *EventEmitter) EmitEnvelope(envelope *events.Envelope) error {
+func (e *EventEmitter) EmitEnvelope(envelope *events.Envelope) (err error) {
+	if e.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				metrics.BatchIncrementCounter("eventEmitter.recoveredPanics")
+				err = fmt.Errorf("recovered panic: %v", r)
+			}
+		}()
+	}
+
+	envelope = e.prefixMetricName(envelope)
+	envelope = e.offsetTimestamps(envelope)
+
+	tags, added := e.addDefaultTags(envelope.GetTags())
+	tags, trimmed := e.trimTags(tags)
+	if trimmed > 0 {
+		metrics.BatchAddCounter("eventEmitter.trimmedTags", uint64(trimmed))
+	}
+	if added || trimmed > 0 {
+		taggedEnvelope := *envelope
+		taggedEnvelope.Tags = tags
+		envelope = &taggedEnvelope
+	}
+
+	if e.serializer != nil {
+		data, err := e.serializer(envelope)
+		if err != nil {
+			CountDrop(DropUnserializable)
+			return fmt.Errorf("Serialize: %v", err)
+		}
+		return e.innerEmitter.Emit(data)
+	}
+
 	data, err := proto.Marshal(envelope)
 	if err != nil {
 		return fmt.Errorf("Marshal: %v", err)
@@ -46,3 +146,127 @@ func (e *EventEmitter) EmitEnvelope(envelope *events.Envelope) error {
 func (e *EventEmitter) Close() {
 	e.innerEmitter.Close()
 }
+
+func (e *EventEmitter) prefixMetricName(envelope *events.Envelope) *events.Envelope {
+	if e.metricPrefix == "" {
+		return envelope
+	}
+
+	switch {
+	case envelope.ValueMetric != nil:
+		metric := *envelope.ValueMetric
+		metric.Name = proto.String(e.metricPrefix + metric.GetName())
+		prefixed := *envelope
+		prefixed.ValueMetric = &metric
+		return &prefixed
+	case envelope.CounterEvent != nil:
+		counter := *envelope.CounterEvent
+		counter.Name = proto.String(e.metricPrefix + counter.GetName())
+		prefixed := *envelope
+		prefixed.CounterEvent = &counter
+		return &prefixed
+	}
+	return envelope
+}
+
+func (e *EventEmitter) offsetTimestamps(envelope *events.Envelope) *events.Envelope {
+	if e.clockOffset == 0 {
+		return envelope
+	}
+
+	shifted := *envelope
+	shifted.Timestamp = e.offsetTimestamp(envelope.Timestamp)
+	if !e.offsetPayload {
+		return &shifted
+	}
+
+	switch {
+	case envelope.HttpStartStop != nil:
+		httpStartStop := *envelope.HttpStartStop
+		httpStartStop.StartTimestamp = e.offsetTimestamp(httpStartStop.StartTimestamp)
+		httpStartStop.StopTimestamp = e.offsetTimestamp(httpStartStop.StopTimestamp)
+		shifted.HttpStartStop = &httpStartStop
+	case envelope.LogMessage != nil:
+		logMessage := *envelope.LogMessage
+		logMessage.Timestamp = e.offsetTimestamp(logMessage.Timestamp)
+		shifted.LogMessage = &logMessage
+	}
+	return &shifted
+}
+
+func (e *EventEmitter) offsetTimestamp(timestamp *int64) *int64 {
+	if timestamp == nil {
+		return nil
+	}
+	return proto.Int64(*timestamp + e.clockOffset.Nanoseconds())
+}
+
+func (e *EventEmitter) addDefaultTags(tags map[string]string) (map[string]string, bool) {
+	if len(e.defaultTags) == 0 {
+		return tags, false
+	}
+
+	merged := make(map[string]string, len(tags)+len(e.defaultTags))
+	for key, value := range e.defaultTags {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	return merged, true
+}
+
+func (e *EventEmitter) trimTags(tags map[string]string) (map[string]string, int) {
+	if e.maxTags <= 0 && e.maxTagBytes <= 0 {
+		return tags, 0
+	}
+
+	kept := make(map[string]string, len(tags))
+	var count, size int
+	var unprotected []string
+	for key, value := range tags {
+		if !e.protectedTags[key] {
+			unprotected = append(unprotected, key)
+			continue
+		}
+		kept[key] = value
+		count++
+		size += len(key) + len(value)
+	}
+	sort.Strings(unprotected)
+
+	var trimmed int
+	for _, key := range unprotected {
+		tagSize := len(key) + len(tags[key])
+		if (e.maxTags > 0 && count >= e.maxTags) || (e.maxTagBytes > 0 && size+tagSize > e.maxTagBytes) {
+			trimmed++
+			continue
+		}
+		kept[key] = tags[key]
+		count++
+		size += tagSize
+	}
+
+	return kept, trimmed
+}
+
+func (e *EventEmitter) Describe() []StageDescription {
+	protected := make([]string, 0, len(e.protectedTags))
+	for key := range e.protectedTags {
+		protected = append(protected, key)
+	}
+	sort.Strings(protected)
+
+	return DescribeStage(e, map[string]interface{}{
+		"origin":         e.origin,
+		"default_tags":   e.defaultTags,
+		"metric_prefix":  e.metricPrefix,
+		"max_tags":       e.maxTags,
+		"max_tag_bytes":  e.maxTagBytes,
+		"protected_tags": protected,
+		"recover_panics": e.recoverPanics,
+		"clock_offset":   e.clockOffset.String(),
+		"offset_payload": e.offsetPayload,
+		"serializer":     e.serializer != nil,
+	}, nil, e.innerEmitter)
+}
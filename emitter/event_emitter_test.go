@@ -4,11 +4,16 @@ import (
 	"github.com/cloudfoundry/dropsonde/emitter"
 	"github.com/cloudfoundry/dropsonde/emitter/fake"
 	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
+	uuid "github.com/nu7hatch/gouuid"
 
+	"errors"
+	"net/http"
 	"time"
 
+	. "github.com/apoydence/eachers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -89,6 +94,357 @@ var _ = Describe("EventEmitter", func() {
 		})
 	})
 
+	Describe("SetDefaultTag", func() {
+		It("adds the tag without overriding tags set on the envelope", func() {
+			innerEmitter := fake.NewFakeByteEmitter()
+			eventEmitter := emitter.NewEventEmitter(innerEmitter, "fake-origin")
+			eventEmitter.SetDefaultTag("zone", "z1")
+			eventEmitter.SetDefaultTag("deployment", "cf")
+
+			testEnvelope := &events.Envelope{
+				Origin:      proto.String("fake-origin"),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: factories.NewValueMetric("metric-name", 2.0, "metric-unit"),
+				Tags:        map[string]string{"zone": "z2"},
+			}
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(innerEmitter.GetMessages()).To(HaveLen(1))
+			var envelope events.Envelope
+			Expect(proto.Unmarshal(innerEmitter.GetMessages()[0], &envelope)).To(Succeed())
+			Expect(envelope.GetTags()).To(Equal(map[string]string{
+				"zone":       "z2",
+				"deployment": "cf",
+			}))
+			Expect(testEnvelope.GetTags()).To(HaveLen(1))
+		})
+	})
+
+	Describe("SetMetricPrefix", func() {
+		var (
+			innerEmitter *fake.FakeByteEmitter
+			eventEmitter *emitter.EventEmitter
+		)
+
+		BeforeEach(func() {
+			innerEmitter = fake.NewFakeByteEmitter()
+			eventEmitter = emitter.NewEventEmitter(innerEmitter, "fake-origin")
+			eventEmitter.SetMetricPrefix("myapp.")
+		})
+
+		var lastEnvelope = func() *events.Envelope {
+			messages := innerEmitter.GetMessages()
+			Expect(messages).ToNot(BeEmpty())
+			var envelope events.Envelope
+			Expect(proto.Unmarshal(messages[len(messages)-1], &envelope)).To(Succeed())
+			return &envelope
+		}
+
+		It("prefixes value metric names without modifying the original", func() {
+			metric := factories.NewValueMetric("metric-name", 2.0, "metric-unit")
+			Expect(eventEmitter.Emit(metric)).To(Succeed())
+
+			Expect(lastEnvelope().GetValueMetric().GetName()).To(Equal("myapp.metric-name"))
+			Expect(metric.GetName()).To(Equal("metric-name"))
+		})
+
+		It("prefixes counter event names", func() {
+			Expect(eventEmitter.Emit(factories.NewCounterEvent("counter-name", 3))).To(Succeed())
+
+			Expect(lastEnvelope().GetCounterEvent().GetName()).To(Equal("myapp.counter-name"))
+		})
+
+		It("leaves other events alone", func() {
+			Expect(eventEmitter.Emit(factories.NewContainerMetric("app-id", 0, 1, 2, 3))).To(Succeed())
+
+			Expect(lastEnvelope().GetContainerMetric().GetApplicationId()).To(Equal("app-id"))
+		})
+	})
+
+	Describe("SetTagLimits", func() {
+		var (
+			mockBatcher  *mockMetricBatcher
+			innerEmitter *fake.FakeByteEmitter
+			eventEmitter *emitter.EventEmitter
+			testEnvelope *events.Envelope
+		)
+
+		BeforeEach(func() {
+			mockBatcher = newMockMetricBatcher()
+			metrics.Initialize(nil, mockBatcher)
+
+			innerEmitter = fake.NewFakeByteEmitter()
+			eventEmitter = emitter.NewEventEmitter(innerEmitter, "fake-origin")
+
+			testEnvelope = &events.Envelope{
+				Origin:    proto.String("fake-origin"),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("event-name"),
+					Value: proto.Float64(1.23),
+					Unit:  proto.String("some-unit"),
+				},
+				Tags: map[string]string{
+					"a":        "1",
+					"b":        "2",
+					"c":        "3",
+					"d":        "4",
+					"zone":     "z1",
+					"deployed": "cf",
+				},
+			}
+		})
+
+		var emittedTags = func() map[string]string {
+			Expect(innerEmitter.GetMessages()).To(HaveLen(1))
+			var envelope events.Envelope
+			Expect(proto.Unmarshal(innerEmitter.GetMessages()[0], &envelope)).To(Succeed())
+			return envelope.GetTags()
+		}
+
+		It("does not trim tags by default", func() {
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emittedTags()).To(HaveLen(6))
+			Expect(mockBatcher.BatchAddCounterCalled).ToNot(Receive())
+		})
+
+		It("trims tags beyond the maximum count, keeping protected tags", func() {
+			eventEmitter.SetTagLimits(3, 0, "zone")
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emittedTags()).To(Equal(map[string]string{
+				"zone": "z1",
+				"a":    "1",
+				"b":    "2",
+			}))
+			Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(
+				With("eventEmitter.trimmedTags", uint64(3)),
+			))
+		})
+
+		It("trims tags beyond the maximum total size, keeping protected tags", func() {
+			eventEmitter.SetTagLimits(0, 10, "deployed", "zone")
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emittedTags()).To(Equal(map[string]string{
+				"deployed": "cf",
+				"zone":     "z1",
+			}))
+			Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(
+				With("eventEmitter.trimmedTags", uint64(4)),
+			))
+		})
+
+		It("applies whichever limit is reached first", func() {
+			eventEmitter.SetTagLimits(4, 9, "zone")
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emittedTags()).To(Equal(map[string]string{
+				"zone": "z1",
+				"a":    "1",
+			}))
+		})
+
+		It("does not modify the caller's envelope", func() {
+			eventEmitter.SetTagLimits(1, 0)
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emittedTags()).To(HaveLen(1))
+			Expect(testEnvelope.GetTags()).To(HaveLen(6))
+		})
+	})
+
+	Describe("SetPanicRecovery", func() {
+		var (
+			mockBatcher  *mockMetricBatcher
+			innerEmitter *panickingByteEmitter
+			eventEmitter *emitter.EventEmitter
+		)
+
+		BeforeEach(func() {
+			mockBatcher = newMockMetricBatcher()
+			metrics.Initialize(nil, mockBatcher)
+
+			innerEmitter = &panickingByteEmitter{}
+			eventEmitter = emitter.NewEventEmitter(innerEmitter, "fake-origin")
+		})
+
+		It("propagates panics by default", func() {
+			Expect(func() {
+				eventEmitter.Emit(factories.NewValueMetric("name", 1, "unit"))
+			}).To(Panic())
+		})
+
+		It("recovers panics, counts them and keeps emitting", func() {
+			eventEmitter.SetPanicRecovery(true)
+
+			err := eventEmitter.Emit(factories.NewValueMetric("name", 1, "unit"))
+			Expect(err).To(MatchError("recovered panic: bad envelope"))
+			Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+				With("eventEmitter.recoveredPanics"),
+			))
+
+			innerEmitter.healthy = true
+			Expect(eventEmitter.Emit(factories.NewValueMetric("name", 1, "unit"))).To(Succeed())
+		})
+	})
+
+	Describe("SetClockOffset", func() {
+		var (
+			innerEmitter *fake.FakeByteEmitter
+			eventEmitter *emitter.EventEmitter
+		)
+
+		BeforeEach(func() {
+			innerEmitter = fake.NewFakeByteEmitter()
+			eventEmitter = emitter.NewEventEmitter(innerEmitter, "fake-origin")
+		})
+
+		var emitted = func() *events.Envelope {
+			Expect(innerEmitter.GetMessages()).To(HaveLen(1))
+			envelope := new(events.Envelope)
+			Expect(proto.Unmarshal(innerEmitter.GetMessages()[0], envelope)).To(Succeed())
+			return envelope
+		}
+
+		var logEnvelope = func() *events.Envelope {
+			return &events.Envelope{
+				Origin:     proto.String("fake-origin"),
+				EventType:  events.Envelope_LogMessage.Enum(),
+				Timestamp:  proto.Int64(1000000000),
+				LogMessage: factories.NewLogMessage(events.LogMessage_OUT, "hello", "app-id", "App"),
+			}
+		}
+
+		It("shifts envelope timestamps forward", func() {
+			eventEmitter.SetClockOffset(2*time.Second, false)
+
+			testEnvelope := logEnvelope()
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emitted().GetTimestamp()).To(Equal(int64(3000000000)))
+			Expect(testEnvelope.GetTimestamp()).To(Equal(int64(1000000000)))
+		})
+
+		It("shifts envelope timestamps backward", func() {
+			eventEmitter.SetClockOffset(-250*time.Millisecond, false)
+
+			Expect(eventEmitter.EmitEnvelope(logEnvelope())).To(Succeed())
+
+			Expect(emitted().GetTimestamp()).To(Equal(int64(750000000)))
+		})
+
+		It("leaves payload timestamps unchanged unless requested", func() {
+			eventEmitter.SetClockOffset(time.Second, false)
+
+			testEnvelope := logEnvelope()
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emitted().GetLogMessage().GetTimestamp()).To(Equal(testEnvelope.GetLogMessage().GetTimestamp()))
+		})
+
+		It("shifts log message timestamps when requested", func() {
+			eventEmitter.SetClockOffset(time.Second, true)
+
+			testEnvelope := logEnvelope()
+			original := testEnvelope.GetLogMessage().GetTimestamp()
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			Expect(emitted().GetLogMessage().GetTimestamp()).To(Equal(original + int64(time.Second)))
+			Expect(testEnvelope.GetLogMessage().GetTimestamp()).To(Equal(original))
+		})
+
+		It("shifts HTTP start and stop timestamps when requested", func() {
+			eventEmitter.SetClockOffset(-time.Second, true)
+
+			req, err := http.NewRequest("GET", "http://example.com/path", nil)
+			Expect(err).ToNot(HaveOccurred())
+			requestId, err := uuid.NewV4()
+			Expect(err).ToNot(HaveOccurred())
+			httpStartStop := factories.NewHttpStartStop(req, 200, 10, events.PeerType_Server, requestId)
+			httpStartStop.StartTimestamp = proto.Int64(3000000000)
+			httpStartStop.StopTimestamp = proto.Int64(4000000000)
+
+			testEnvelope := &events.Envelope{
+				Origin:        proto.String("fake-origin"),
+				EventType:     events.Envelope_HttpStartStop.Enum(),
+				Timestamp:     proto.Int64(5000000000),
+				HttpStartStop: httpStartStop,
+			}
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			envelope := emitted()
+			Expect(envelope.GetTimestamp()).To(Equal(int64(4000000000)))
+			Expect(envelope.GetHttpStartStop().GetStartTimestamp()).To(Equal(int64(2000000000)))
+			Expect(envelope.GetHttpStartStop().GetStopTimestamp()).To(Equal(int64(3000000000)))
+		})
+	})
+
+	Describe("SetSerializer", func() {
+		var (
+			mockBatcher  *mockMetricBatcher
+			innerEmitter *fake.FakeByteEmitter
+			eventEmitter *emitter.EventEmitter
+		)
+
+		BeforeEach(func() {
+			mockBatcher = newMockMetricBatcher()
+			metrics.Initialize(nil, mockBatcher)
+
+			innerEmitter = fake.NewFakeByteEmitter()
+			eventEmitter = emitter.NewEventEmitter(innerEmitter, "fake-origin")
+		})
+
+		It("sends the serializer's bytes to the inner emitter", func() {
+			eventEmitter.SetSerializer(func(envelope *events.Envelope) ([]byte, error) {
+				data, err := proto.Marshal(envelope)
+				if err != nil {
+					return nil, err
+				}
+				return append([]byte("HDR1"), data...), nil
+			})
+
+			testEnvelope := &events.Envelope{
+				Origin:      proto.String("fake-origin"),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				Timestamp:   proto.Int64(1),
+				ValueMetric: factories.NewValueMetric("metric-name", 2, "metric-unit"),
+			}
+			Expect(eventEmitter.EmitEnvelope(testEnvelope)).To(Succeed())
+
+			expected, err := proto.Marshal(testEnvelope)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(innerEmitter.GetMessages()).To(Equal([][]byte{append([]byte("HDR1"), expected...)}))
+		})
+
+		It("serializes envelopes after default tags are applied", func() {
+			var serialized *events.Envelope
+			eventEmitter.SetDefaultTag("deployment", "cf")
+			eventEmitter.SetSerializer(func(envelope *events.Envelope) ([]byte, error) {
+				serialized = envelope
+				return []byte("custom"), nil
+			})
+
+			Expect(eventEmitter.Emit(factories.NewValueMetric("metric-name", 2, "metric-unit"))).To(Succeed())
+
+			Expect(serialized.GetTags()).To(HaveKeyWithValue("deployment", "cf"))
+		})
+
+		It("counts serializer errors as drops", func() {
+			eventEmitter.SetSerializer(func(*events.Envelope) ([]byte, error) {
+				return nil, errors.New("unsupported")
+			})
+
+			err := eventEmitter.Emit(factories.NewValueMetric("metric-name", 2, "metric-unit"))
+			Expect(err).To(MatchError("Serialize: unsupported"))
+			Expect(innerEmitter.GetMessages()).To(BeEmpty())
+			Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+				With("droppedEnvelopes.unserializable"),
+			))
+		})
+	})
+
 	Describe("Close", func() {
 		It("closes the inner emitter", func() {
 			innerEmitter := fake.NewFakeByteEmitter()
@@ -99,3 +455,16 @@ var _ = Describe("EventEmitter", func() {
 		})
 	})
 })
+
+type panickingByteEmitter struct {
+	healthy bool
+}
+
+func (p *panickingByteEmitter) Emit([]byte) error {
+	if !p.healthy {
+		panic("bad envelope")
+	}
+	return nil
+}
+
+func (p *panickingByteEmitter) Close() {}
@@ -0,0 +1,153 @@
+package emitter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/envelope_extensions"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+const defaultKafkaBackoff = 100 * time.Millisecond
+
+// KafkaProducer is the subset of a Kafka client used by KafkaEmitter. Produce
+// should return once the message has been accepted according to the
+// producer's own delivery semantics.
+type KafkaProducer interface {
+	Produce(topic string, key, value []byte) error
+}
+
+// EnvelopeSerializer encodes an envelope as a message payload.
+type EnvelopeSerializer func(*events.Envelope) ([]byte, error)
+
+// KafkaKeyFunc picks the message key for an envelope. A nil key leaves
+// partitioning to the producer.
+type KafkaKeyFunc func(*events.Envelope) []byte
+
+// KafkaConfig configures a KafkaEmitter.
+type KafkaConfig struct {
+	Topic string
+
+	// Serializer defaults to ProtoSerializer.
+	Serializer EnvelopeSerializer
+
+	// Key defaults to producing every message without a key.
+	Key KafkaKeyFunc
+
+	// Retries is the number of additional attempts made after a failed
+	// produce.
+	Retries int
+
+	// Backoff is the wait before the first retry, doubled for each
+	// subsequent one. It defaults to 100ms.
+	Backoff time.Duration
+}
+
+// KafkaEmitter produces each envelope as a message on a Kafka topic.
+type KafkaEmitter struct {
+	producer KafkaProducer
+	origin   string
+	config   KafkaConfig
+}
+
+func NewKafkaEmitter(producer KafkaProducer, origin string, config KafkaConfig) *KafkaEmitter {
+	if config.Serializer == nil {
+		config.Serializer = ProtoSerializer
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultKafkaBackoff
+	}
+	return &KafkaEmitter{producer: producer, origin: origin, config: config}
+}
+
+// ProtoSerializer encodes envelopes in the protobuf wire format, as sent by
+// EventEmitter.
+func ProtoSerializer(envelope *events.Envelope) ([]byte, error) {
+	return proto.Marshal(envelope)
+}
+
+// JSONSerializer encodes envelopes as jsonpb JSON, the format read by
+// envelopes.FromJSON.
+func JSONSerializer(envelope *events.Envelope) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, envelope); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// KeyByOrigin keys messages by the envelope's origin.
+func KeyByOrigin(envelope *events.Envelope) []byte {
+	return []byte(envelope.GetOrigin())
+}
+
+// KeyByAppID keys messages by the envelope's application ID, so that all
+// events for one app land on the same partition. Envelopes without an app ID
+// are keyed by envelope_extensions.SystemAppId.
+func KeyByAppID(envelope *events.Envelope) []byte {
+	return []byte(envelope_extensions.GetAppId(envelope))
+}
+
+func (e *KafkaEmitter) Origin() string {
+	return e.origin
+}
+
+func (e *KafkaEmitter) Emit(event events.Event) error {
+	envelope, err := Wrap(event, e.origin)
+	if err != nil {
+		return fmt.Errorf("Wrap: %v", err)
+	}
+
+	return e.EmitEnvelope(envelope)
+}
+
+func (e *KafkaEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	data, err := e.config.Serializer(envelope)
+	if err != nil {
+		return fmt.Errorf("Serialize: %v", err)
+	}
+
+	var key []byte
+	if e.config.Key != nil {
+		key = e.config.Key(envelope)
+	}
+
+	backoff := e.config.Backoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = e.producer.Produce(e.config.Topic, key, data)
+		if err == nil {
+			return nil
+		}
+		metrics.BatchIncrementCounter("kafkaEmitter.produceErrors")
+		if attempt >= e.config.Retries {
+			return fmt.Errorf("Produce: %v", err)
+		}
+	}
+}
+
+// Close closes the producer if it implements io.Closer.
+func (e *KafkaEmitter) Close() {
+	if closer, ok := e.producer.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (e *KafkaEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"origin":   e.origin,
+		"topic":    e.config.Topic,
+		"retries":  e.config.Retries,
+		"backoff":  e.config.Backoff.String(),
+		"producer": fmt.Sprintf("%T", e.producer),
+	}, nil, nil)
+}
@@ -0,0 +1,164 @@
+package emitter_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/envelopes"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KafkaEmitter", func() {
+	var (
+		producer    *fakeKafkaProducer
+		mockBatcher *mockMetricBatcher
+	)
+
+	BeforeEach(func() {
+		producer = &fakeKafkaProducer{}
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+	})
+
+	It("produces proto-encoded envelopes to the configured topic", func() {
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{Topic: "firehose"})
+		Expect(kafkaEmitter.Origin()).To(Equal("origin"))
+
+		Expect(kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Expect(producer.messages).To(HaveLen(1))
+		Expect(producer.messages[0].topic).To(Equal("firehose"))
+		Expect(producer.messages[0].key).To(BeNil())
+
+		envelope := new(events.Envelope)
+		Expect(proto.Unmarshal(producer.messages[0].value, envelope)).To(Succeed())
+		Expect(envelope.GetOrigin()).To(Equal("origin"))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("metric"))
+	})
+
+	It("produces JSON-encoded envelopes when configured", func() {
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{
+			Topic:      "firehose",
+			Serializer: emitter.JSONSerializer,
+		})
+
+		Expect(kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		envelope, err := envelopes.FromJSON(producer.messages[0].value)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("metric"))
+	})
+
+	It("keys messages with the configured key function", func() {
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{
+			Topic: "firehose",
+			Key:   emitter.KeyByAppID,
+		})
+
+		Expect(kafkaEmitter.Emit(factories.NewContainerMetric("app-id", 0, 1, 2, 3))).To(Succeed())
+		Expect(kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Expect(producer.messages[0].key).To(Equal([]byte("app-id")))
+		Expect(producer.messages[1].key).To(Equal([]byte("system")))
+	})
+
+	It("keys messages by origin", func() {
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{
+			Topic: "firehose",
+			Key:   emitter.KeyByOrigin,
+		})
+
+		Expect(kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Expect(producer.messages[0].key).To(Equal([]byte("origin")))
+	})
+
+	It("counts produce errors and returns the last one", func() {
+		producer.errs = []error{errors.New("broker down")}
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{Topic: "firehose"})
+
+		err := kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))
+		Expect(err).To(MatchError("Produce: broker down"))
+		Expect(producer.messages).To(BeEmpty())
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("kafkaEmitter.produceErrors"),
+		))
+	})
+
+	It("retries failed produces up to the configured number of times", func() {
+		producer.errs = []error{errors.New("broker down"), errors.New("leader moved")}
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{
+			Topic:   "firehose",
+			Retries: 2,
+			Backoff: time.Millisecond,
+		})
+
+		Expect(kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Expect(producer.messages).To(HaveLen(1))
+		Expect(producer.attempts).To(Equal(3))
+		Expect(mockBatcher.BatchIncrementCounterCalled).To(HaveLen(2))
+	})
+
+	It("waits longer before each retry", func() {
+		producer.errs = []error{errors.New("broker down"), errors.New("leader moved")}
+		kafkaEmitter := emitter.NewKafkaEmitter(producer, "origin", emitter.KafkaConfig{
+			Topic:   "firehose",
+			Retries: 2,
+			Backoff: 20 * time.Millisecond,
+		})
+
+		start := time.Now()
+		Expect(kafkaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Expect(time.Since(start)).To(BeNumerically(">=", 60*time.Millisecond))
+		Expect(producer.attempts).To(Equal(3))
+	})
+
+	It("closes producers that can be closed", func() {
+		closer := &closingKafkaProducer{}
+		emitter.NewKafkaEmitter(closer, "origin", emitter.KafkaConfig{}).Close()
+
+		Expect(closer.closed).To(BeTrue())
+	})
+})
+
+type kafkaMessage struct {
+	topic      string
+	key, value []byte
+}
+
+type fakeKafkaProducer struct {
+	errs     []error
+	attempts int
+	messages []kafkaMessage
+}
+
+func (p *fakeKafkaProducer) Produce(topic string, key, value []byte) error {
+	p.attempts++
+	if len(p.errs) > 0 {
+		err := p.errs[0]
+		p.errs = p.errs[1:]
+		return err
+	}
+	p.messages = append(p.messages, kafkaMessage{topic: topic, key: key, value: value})
+	return nil
+}
+
+type closingKafkaProducer struct {
+	fakeKafkaProducer
+	closed bool
+}
+
+func (p *closingKafkaProducer) Close() error {
+	p.closed = true
+	return nil
+}
@@ -0,0 +1,359 @@
+package emitter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/envelope_extensions"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	kinesisMaxRecords     = 500
+	kinesisMaxBatchBytes  = 5 << 20
+	kinesisMaxRecordBytes = 1 << 20
+
+	// kinesisMaxQueuedBatches is how many full batches may wait for the
+	// flush goroutine.
+	kinesisMaxQueuedBatches = 4
+
+	defaultKinesisBackoff = 100 * time.Millisecond
+)
+
+// ErrKinesisThrottled should be returned by a KinesisClient, for a whole call
+// or for a single record, when Kinesis rejects it for exceeding the stream's
+// provisioned throughput. Only throttled records are retried.
+var ErrKinesisThrottled = errors.New("Kinesis throughput exceeded")
+
+// ErrKinesisClosed is returned by a KinesisEmitter for emits made after it
+// has been closed.
+var ErrKinesisClosed = errors.New("kinesis emitter: closed")
+
+// ErrKinesisBacklogged is returned by a KinesisEmitter when a batch fills
+// while too many full batches are already waiting to be sent. The full batch
+// is dropped.
+var ErrKinesisBacklogged = errors.New("kinesis emitter: too many batches waiting to be sent")
+
+// KinesisRecord is a single entry of a PutRecords call.
+type KinesisRecord struct {
+	PartitionKey string
+	Data         []byte
+}
+
+// KinesisClient is the subset of a Kinesis client used by KinesisEmitter.
+// PutRecords writes records to the named stream. When the call as a whole
+// succeeds it returns one error per record, in order, which is nil for records
+// that were written.
+type KinesisClient interface {
+	PutRecords(stream string, records []KinesisRecord) ([]error, error)
+}
+
+// KinesisPartitionKeyFunc picks the partition key for an envelope.
+type KinesisPartitionKeyFunc func(*events.Envelope) string
+
+// KinesisConfig configures a KinesisEmitter.
+type KinesisConfig struct {
+	Stream string
+
+	// Serializer defaults to ProtoSerializer.
+	Serializer EnvelopeSerializer
+
+	// PartitionKey defaults to PartitionByOrigin. Envelopes for which it
+	// returns an empty key are partitioned by envelope_extensions.SystemAppId.
+	PartitionKey KinesisPartitionKeyFunc
+
+	// FlushInterval is how often buffered envelopes are sent. When it is zero
+	// or less, they are only sent once a full batch has been buffered, and by
+	// Flush and Close. Full batches are always sent by the emitter's flush
+	// goroutine, so that emits never wait on PutRecords or its retries.
+	FlushInterval time.Duration
+
+	// Retries is the number of additional attempts made for throttled
+	// records.
+	Retries int
+
+	// Backoff is the wait before the first retry, doubled for each
+	// subsequent one. It defaults to 100ms.
+	Backoff time.Duration
+}
+
+// KinesisEmitter buffers envelopes and writes them to a Kinesis stream in
+// PutRecords batches, staying within the Kinesis limits of 500 records and
+// 5MB per call.
+type KinesisEmitter struct {
+	client KinesisClient
+	origin string
+	config KinesisConfig
+
+	lock         sync.Mutex
+	pending      []KinesisRecord
+	pendingBytes int
+	closed       bool
+	closedChan   chan struct{}
+	full         chan []KinesisRecord
+	done         chan struct{}
+}
+
+func NewKinesisEmitter(client KinesisClient, origin string, config KinesisConfig) *KinesisEmitter {
+	if config.Serializer == nil {
+		config.Serializer = ProtoSerializer
+	}
+	if config.PartitionKey == nil {
+		config.PartitionKey = PartitionByOrigin
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultKinesisBackoff
+	}
+
+	e := &KinesisEmitter{
+		client:     client,
+		origin:     origin,
+		config:     config,
+		closedChan: make(chan struct{}),
+		full:       make(chan []KinesisRecord, kinesisMaxQueuedBatches),
+		done:       make(chan struct{}),
+	}
+
+	go e.run()
+	return e
+}
+
+// PartitionByOrigin partitions records by the envelope's origin.
+func PartitionByOrigin(envelope *events.Envelope) string {
+	return envelope.GetOrigin()
+}
+
+// PartitionByAppID partitions records by the envelope's application ID, so
+// that all events for one app land on the same shard.
+func PartitionByAppID(envelope *events.Envelope) string {
+	return envelope_extensions.GetAppId(envelope)
+}
+
+func (e *KinesisEmitter) Origin() string {
+	return e.origin
+}
+
+func (e *KinesisEmitter) Emit(event events.Event) error {
+	envelope, err := Wrap(event, e.origin)
+	if err != nil {
+		return fmt.Errorf("Wrap: %v", err)
+	}
+
+	return e.EmitEnvelope(envelope)
+}
+
+// EmitEnvelope buffers the envelope for the next batch. If the envelope does
+// not fit in the current batch, that batch is handed to the flush goroutine
+// first; errors writing it are counted as "kinesisEmitter.failedRecords"
+// rather than returned. If too many full batches are already waiting to be
+// sent, the full batch is dropped, counted, and ErrKinesisBacklogged is
+// returned. Once the emitter is closed it returns ErrKinesisClosed.
+func (e *KinesisEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	data, err := e.config.Serializer(envelope)
+	if err != nil {
+		return fmt.Errorf("Serialize: %v", err)
+	}
+
+	key := e.config.PartitionKey(envelope)
+	if key == "" {
+		key = envelope_extensions.SystemAppId
+	}
+
+	record := KinesisRecord{PartitionKey: key, Data: data}
+	size := recordSize(record)
+	if size > kinesisMaxRecordBytes {
+		metrics.BatchIncrementCounter("kinesisEmitter.failedRecords")
+		CountDrop(DropOversized)
+		return fmt.Errorf("Record of %d bytes exceeds the Kinesis limit of %d bytes", size, kinesisMaxRecordBytes)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrKinesisClosed
+	}
+	var full []KinesisRecord
+	if len(e.pending) == kinesisMaxRecords || e.pendingBytes+size > kinesisMaxBatchBytes {
+		full = e.unsafeTakePending()
+	}
+	e.pending = append(e.pending, record)
+	e.pendingBytes += size
+
+	if full == nil {
+		return nil
+	}
+	select {
+	case e.full <- full:
+		return nil
+	default:
+		metrics.BatchAddCounter("kinesisEmitter.failedRecords", uint64(len(full)))
+		metrics.BatchAddCounter(DropOverflow.CounterName(), uint64(len(full)))
+		return ErrKinesisBacklogged
+	}
+}
+
+// Flush sends the full batches waiting for the flush goroutine and the
+// buffered envelopes, and returns the last error writing them.
+func (e *KinesisEmitter) Flush() error {
+	var lastErr error
+	for records := e.takeFull(); records != nil; records = e.takeFull() {
+		if err := e.put(records); err != nil {
+			lastErr = err
+		}
+	}
+
+	e.lock.Lock()
+	records := e.unsafeTakePending()
+	e.lock.Unlock()
+
+	if err := e.put(records); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+// Close waits for the flush goroutine to finish sending, flushes the
+// remaining envelopes and closes the client if it implements io.Closer.
+func (e *KinesisEmitter) Close() {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.closedChan)
+	e.lock.Unlock()
+
+	<-e.done
+	e.Flush()
+
+	if closer, ok := e.client.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (e *KinesisEmitter) run() {
+	defer close(e.done)
+
+	var tick <-chan time.Time
+	if e.config.FlushInterval > 0 {
+		ticker := time.NewTicker(e.config.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case records := <-e.full:
+			e.put(records)
+		case <-tick:
+			e.Flush()
+		case <-e.closedChan:
+			return
+		}
+	}
+}
+
+// takeFull returns a full batch waiting for the flush goroutine, or nil if
+// there is none.
+func (e *KinesisEmitter) takeFull() []KinesisRecord {
+	select {
+	case records := <-e.full:
+		return records
+	default:
+		return nil
+	}
+}
+
+func (e *KinesisEmitter) unsafeTakePending() []KinesisRecord {
+	records := e.pending
+	e.pending = nil
+	e.pendingBytes = 0
+	return records
+}
+
+// put writes records, retrying throttled ones with exponential backoff.
+// Records that are rejected for any other reason, or are still throttled
+// after the last retry, are counted and dropped.
+func (e *KinesisEmitter) put(records []KinesisRecord) error {
+	var lastErr error
+	backoff := e.config.Backoff
+
+	for attempt := 0; len(records) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var throttled []KinesisRecord
+		var failed int
+
+		recordErrs, err := e.client.PutRecords(e.config.Stream, records)
+		switch {
+		case err == ErrKinesisThrottled:
+			throttled = records
+		case err != nil:
+			failed = len(records)
+			lastErr = err
+		default:
+			if missing := len(records) - len(recordErrs); missing > 0 {
+				failed = missing
+				lastErr = fmt.Errorf("no result for %d of %d records", missing, len(records))
+			}
+			for i, recordErr := range recordErrs {
+				if i >= len(records) {
+					break
+				}
+				switch recordErr {
+				case nil:
+				case ErrKinesisThrottled:
+					throttled = append(throttled, records[i])
+				default:
+					failed++
+					lastErr = recordErr
+				}
+			}
+		}
+
+		if attempt >= e.config.Retries && len(throttled) > 0 {
+			failed += len(throttled)
+			lastErr = ErrKinesisThrottled
+			throttled = nil
+		}
+		if failed > 0 {
+			metrics.BatchAddCounter("kinesisEmitter.failedRecords", uint64(failed))
+		}
+		records = throttled
+	}
+
+	if lastErr != nil {
+		return fmt.Errorf("PutRecords: %v", lastErr)
+	}
+	return nil
+}
+
+func recordSize(record KinesisRecord) int {
+	return len(record.PartitionKey) + len(record.Data)
+}
+
+func (e *KinesisEmitter) Describe() []StageDescription {
+	e.lock.Lock()
+	pending := len(e.pending)
+	e.lock.Unlock()
+
+	return DescribeStage(e, map[string]interface{}{
+		"origin":         e.origin,
+		"stream":         e.config.Stream,
+		"flush_interval": e.config.FlushInterval.String(),
+		"retries":        e.config.Retries,
+		"backoff":        e.config.Backoff.String(),
+		"client":         fmt.Sprintf("%T", e.client),
+	}, map[string]interface{}{
+		"pending_records": pending,
+	}, nil)
+}
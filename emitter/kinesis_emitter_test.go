@@ -0,0 +1,332 @@
+package emitter_test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KinesisEmitter", func() {
+	var (
+		client      *fakeKinesisClient
+		mockBatcher *mockMetricBatcher
+		config      emitter.KinesisConfig
+	)
+
+	BeforeEach(func() {
+		client = &fakeKinesisClient{}
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+		config = emitter.KinesisConfig{Stream: "firehose", Backoff: time.Millisecond}
+	})
+
+	It("batches proto-encoded envelopes into a single PutRecords call on flush", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+		Expect(kinesisEmitter.Origin()).To(Equal("origin"))
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 2, "unit"))).To(Succeed())
+		Expect(client.calls()).To(BeEmpty())
+
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+
+		calls := client.calls()
+		Expect(calls).To(HaveLen(1))
+		Expect(calls[0].stream).To(Equal("firehose"))
+		Expect(calls[0].records).To(HaveLen(2))
+
+		envelope := new(events.Envelope)
+		Expect(proto.Unmarshal(calls[0].records[1].Data, envelope)).To(Succeed())
+		Expect(envelope.GetOrigin()).To(Equal("origin"))
+		Expect(envelope.GetValueMetric().GetValue()).To(Equal(float64(2)))
+	})
+
+	It("does not send empty batches", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+		Expect(client.calls()).To(BeEmpty())
+	})
+
+	It("partitions records by origin by default", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+
+		Expect(client.calls()[0].records[0].PartitionKey).To(Equal("origin"))
+	})
+
+	It("partitions records with the configured key function", func() {
+		config.PartitionKey = emitter.PartitionByAppID
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewContainerMetric("app-id", 0, 1, 2, 3))).To(Succeed())
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+
+		records := client.calls()[0].records
+		Expect(records[0].PartitionKey).To(Equal("app-id"))
+		Expect(records[1].PartitionKey).To(Equal("system"))
+	})
+
+	It("sends no more than 500 records per call", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		for i := 0; i < 501; i++ {
+			Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		}
+		Eventually(client.calls).Should(HaveLen(1))
+		Expect(client.calls()[0].records).To(HaveLen(500))
+
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+		Expect(client.calls()[1].records).To(HaveLen(1))
+	})
+
+	It("sends no more than 5MB per call", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+		message := bytes.Repeat([]byte("x"), 1000*1000)
+
+		for i := 0; i < 6; i++ {
+			Expect(kinesisEmitter.Emit(factories.NewLogMessage(events.LogMessage_OUT, string(message), "app-id", "App"))).To(Succeed())
+		}
+		Eventually(client.calls).Should(HaveLen(1))
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+
+		calls := client.calls()
+		Expect(calls).To(HaveLen(2))
+		for _, call := range calls {
+			var size int
+			for _, record := range call.records {
+				size += len(record.PartitionKey) + len(record.Data)
+			}
+			Expect(size).To(BeNumerically("<=", 5<<20))
+		}
+		Expect(calls[0].records).To(HaveLen(5))
+		Expect(calls[1].records).To(HaveLen(1))
+	})
+
+	It("sends full batches without blocking the emitting goroutine", func() {
+		blocking := &blockingKinesisClient{started: make(chan struct{}, 1), release: make(chan struct{})}
+		kinesisEmitter := emitter.NewKinesisEmitter(blocking, "origin", config)
+
+		for i := 0; i < 501; i++ {
+			Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		}
+		Eventually(blocking.started).Should(Receive())
+
+		close(blocking.release)
+		Eventually(blocking.calls).Should(HaveLen(1))
+		Expect(blocking.calls()[0].records).To(HaveLen(500))
+	})
+
+	It("drops and counts full batches while the flush goroutine is backlogged", func() {
+		blocking := &blockingKinesisClient{started: make(chan struct{}, 1), release: make(chan struct{})}
+		kinesisEmitter := emitter.NewKinesisEmitter(blocking, "origin", config)
+
+		for i := 0; i < 501; i++ {
+			Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		}
+		Eventually(blocking.started).Should(Receive())
+		for i := 0; i < 4*500; i++ {
+			Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		}
+		for i := 0; i < 499; i++ {
+			Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		}
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(MatchError(emitter.ErrKinesisBacklogged))
+		Expect(mockBatcher.BatchAddCounterInput).To(BeCalled(
+			With("kinesisEmitter.failedRecords", uint64(500)),
+			With("droppedEnvelopes.overflow", uint64(500)),
+		))
+
+		close(blocking.release)
+		kinesisEmitter.Close()
+		Expect(blocking.calls()).To(HaveLen(6))
+	})
+
+	It("rejects envelopes larger than a single record may be", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+		message := bytes.Repeat([]byte("x"), 1<<20)
+
+		err := kinesisEmitter.Emit(factories.NewLogMessage(events.LogMessage_OUT, string(message), "app-id", "App"))
+		Expect(err).To(HaveOccurred())
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("kinesisEmitter.failedRecords"),
+		))
+	})
+
+	It("sends buffered envelopes on the flush interval", func() {
+		config.FlushInterval = 10 * time.Millisecond
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+		defer kinesisEmitter.Close()
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		Eventually(client.calls).Should(HaveLen(1))
+	})
+
+	It("retries throttled records with backoff", func() {
+		config.Retries = 2
+		client.responses = []kinesisResponse{
+			{recordErrs: []error{nil, emitter.ErrKinesisThrottled}},
+			{err: emitter.ErrKinesisThrottled},
+		}
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("first", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("second", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+
+		calls := client.calls()
+		Expect(calls).To(HaveLen(3))
+		Expect(calls[1].records).To(HaveLen(1))
+		Expect(calls[2].records).To(Equal(calls[1].records))
+		Expect(calls[2].at.Sub(calls[1].at)).To(BeNumerically(">=", 2*time.Millisecond))
+		Expect(mockBatcher.BatchAddCounterCalled).ToNot(Receive())
+	})
+
+	It("counts records that are still throttled after the last retry", func() {
+		config.Retries = 1
+		client.responses = []kinesisResponse{
+			{err: emitter.ErrKinesisThrottled},
+			{err: emitter.ErrKinesisThrottled},
+		}
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Flush()).To(MatchError("PutRecords: Kinesis throughput exceeded"))
+
+		Expect(client.calls()).To(HaveLen(2))
+		Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(
+			With("kinesisEmitter.failedRecords", uint64(1)),
+		))
+	})
+
+	It("does not retry records rejected for other reasons", func() {
+		config.Retries = 3
+		client.responses = []kinesisResponse{
+			{recordErrs: []error{errors.New("internal failure"), nil}},
+		}
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("first", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("second", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Flush()).To(MatchError("PutRecords: internal failure"))
+
+		Expect(client.calls()).To(HaveLen(1))
+		Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(
+			With("kinesisEmitter.failedRecords", uint64(1)),
+		))
+	})
+
+	It("counts records missing from a short PutRecords response as failed", func() {
+		client.responses = []kinesisResponse{
+			{recordErrs: []error{nil}},
+		}
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("first", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("second", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("third", 1, "unit"))).To(Succeed())
+		Expect(kinesisEmitter.Flush()).To(MatchError("PutRecords: no result for 2 of 3 records"))
+
+		Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(
+			With("kinesisEmitter.failedRecords", uint64(2)),
+		))
+	})
+
+	It("rejects envelopes emitted after Close", func() {
+		kinesisEmitter := emitter.NewKinesisEmitter(client, "origin", config)
+		kinesisEmitter.Close()
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(MatchError(emitter.ErrKinesisClosed))
+		Expect(kinesisEmitter.Flush()).To(Succeed())
+		Expect(client.calls()).To(BeEmpty())
+	})
+
+	It("flushes and closes clients that can be closed on Close", func() {
+		closer := &closingKinesisClient{}
+		kinesisEmitter := emitter.NewKinesisEmitter(closer, "origin", config)
+
+		Expect(kinesisEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+		kinesisEmitter.Close()
+
+		Expect(closer.calls()).To(HaveLen(1))
+		Expect(closer.closed).To(BeTrue())
+	})
+})
+
+type kinesisCall struct {
+	stream  string
+	records []emitter.KinesisRecord
+	at      time.Time
+}
+
+type kinesisResponse struct {
+	recordErrs []error
+	err        error
+}
+
+type fakeKinesisClient struct {
+	lock      sync.Mutex
+	responses []kinesisResponse
+	received  []kinesisCall
+}
+
+func (c *fakeKinesisClient) PutRecords(stream string, records []emitter.KinesisRecord) ([]error, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.received = append(c.received, kinesisCall{stream: stream, records: records, at: time.Now()})
+	if len(c.responses) == 0 {
+		return make([]error, len(records)), nil
+	}
+	response := c.responses[0]
+	c.responses = c.responses[1:]
+	return response.recordErrs, response.err
+}
+
+func (c *fakeKinesisClient) calls() []kinesisCall {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]kinesisCall(nil), c.received...)
+}
+
+type closingKinesisClient struct {
+	fakeKinesisClient
+	closed bool
+}
+
+func (c *closingKinesisClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+type blockingKinesisClient struct {
+	fakeKinesisClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingKinesisClient) PutRecords(stream string, records []emitter.KinesisRecord) ([]error, error) {
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+	<-c.release
+	return c.fakeKinesisClient.PutRecords(stream, records)
+}
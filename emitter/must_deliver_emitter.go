@@ -0,0 +1,273 @@
+package emitter
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	// MustDeliverTag is the tag that flags an envelope for redelivery by a
+	// MustDeliverEmitter. Envelopes are flagged when it has the value "true".
+	// The emitter removes it before forwarding envelopes downstream.
+	MustDeliverTag = "must_deliver"
+
+	defaultMustDeliverCapacity = 1000
+	defaultMustDeliverTTL      = 10 * time.Minute
+)
+
+// ErrRetryQueueFull is returned by a MustDeliverEmitter for a flagged envelope
+// that failed to emit while its retry queue was full. The envelope is
+// dead-lettered instead.
+var ErrRetryQueueFull = errors.New("must-deliver emitter: retry queue full")
+
+// MustDeliver returns a copy of envelope flagged with MustDeliverTag.
+func MustDeliver(envelope *events.Envelope) *events.Envelope {
+	tags := make(map[string]string, len(envelope.GetTags())+1)
+	for key, value := range envelope.GetTags() {
+		tags[key] = value
+	}
+	tags[MustDeliverTag] = "true"
+
+	flagged := *envelope
+	flagged.Tags = tags
+	return &flagged
+}
+
+// withoutMustDeliverTag returns a copy of envelope without MustDeliverTag,
+// so that the internal routing tag does not reach downstream consumers.
+func withoutMustDeliverTag(envelope *events.Envelope) *events.Envelope {
+	var tags map[string]string
+	if len(envelope.GetTags()) > 1 {
+		tags = make(map[string]string, len(envelope.GetTags())-1)
+		for key, value := range envelope.GetTags() {
+			if key != MustDeliverTag {
+				tags[key] = value
+			}
+		}
+	}
+
+	stripped := *envelope
+	stripped.Tags = tags
+	return &stripped
+}
+
+// IsMustDeliver reports whether envelope is flagged with MustDeliverTag.
+func IsMustDeliver(envelope *events.Envelope) bool {
+	return envelope.GetTags()[MustDeliverTag] == "true"
+}
+
+// MustDeliverConfig configures a MustDeliverEmitter.
+type MustDeliverConfig struct {
+	// Capacity is the number of flagged envelopes the retry queue holds. It
+	// defaults to 1000.
+	Capacity int
+
+	// RetryInterval is how often queued envelopes are retried. When it is
+	// zero or less, they are only retried by calls to Retry.
+	RetryInterval time.Duration
+
+	// Retries is the number of retries an envelope gets before it is
+	// dead-lettered. When it is zero or less, envelopes are retried until
+	// their TTL expires.
+	Retries int
+
+	// TTL is how long after its first failure an envelope is retried before
+	// it is dead-lettered. It defaults to 10 minutes.
+	TTL time.Duration
+
+	// DeadLetterCapacity is the number of dead letters kept for
+	// ReplayDeadLetters. It defaults to Capacity.
+	DeadLetterCapacity int
+}
+
+// MustDeliverEmitter wraps an EnvelopeEmitter and gives envelopes flagged with
+// MustDeliverTag, such as billing metrics, a dedicated retry path. Flagged
+// envelopes that fail to emit are queued in a bounded retry queue and retried
+// until they are delivered, or dead-lettered once they exhaust their retries
+// or outlive their TTL. Other envelopes are emitted once, on a best-effort
+// basis.
+type MustDeliverEmitter struct {
+	innerEmitter EnvelopeEmitter
+	config       MustDeliverConfig
+	queue        *envelopeQueue
+	deadLetters  *DeadLetterEmitter
+
+	lock    sync.Mutex
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewMustDeliverEmitter(innerEmitter EnvelopeEmitter, config MustDeliverConfig) *MustDeliverEmitter {
+	if config.Capacity <= 0 {
+		config.Capacity = defaultMustDeliverCapacity
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaultMustDeliverTTL
+	}
+	if config.DeadLetterCapacity <= 0 {
+		config.DeadLetterCapacity = config.Capacity
+	}
+
+	e := &MustDeliverEmitter{
+		innerEmitter: innerEmitter,
+		config:       config,
+		queue:        newEnvelopeQueue(config.Capacity),
+		deadLetters:  NewDeadLetterEmitter(innerEmitter, config.DeadLetterCapacity),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if config.RetryInterval > 0 {
+		go e.run()
+	} else {
+		close(e.done)
+	}
+	return e
+}
+
+func (e *MustDeliverEmitter) Origin() string {
+	return e.innerEmitter.Origin()
+}
+
+func (e *MustDeliverEmitter) Emit(event events.Event) error {
+	envelope, err := Wrap(event, e.innerEmitter.Origin())
+	if err != nil {
+		return fmt.Errorf("Wrap: %v", err)
+	}
+
+	return e.EmitEnvelope(envelope)
+}
+
+// EmitEnvelope emits envelope. If a flagged envelope fails to emit it is
+// queued for retry and nil is returned, unless the queue is full, in which
+// case it is dead-lettered and ErrRetryQueueFull is returned. Errors emitting
+// other envelopes are returned as they are.
+func (e *MustDeliverEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	flagged := IsMustDeliver(envelope)
+	if flagged {
+		envelope = withoutMustDeliverTag(envelope)
+	}
+
+	err := e.innerEmitter.EmitEnvelope(envelope)
+	if err == nil || !flagged || isTooLarge(err) {
+		return err
+	}
+
+	queued := e.queue.offer(&queuedEnvelope{
+		envelope: envelope,
+		expires:  time.Now().Add(e.config.TTL),
+	})
+	if !queued {
+		e.deadLetter(envelope)
+		return ErrRetryQueueFull
+	}
+	return nil
+}
+
+// Retry re-emits each queued envelope once, oldest first, and returns how
+// many were delivered. A failure is counted against that envelope's retries
+// and leaves it queued, behind the others, without holding them up. The
+// queue is not locked while envelopes are emitted, so flagged envelopes that
+// fail during a retry are still queued. Envelopes that have outlived their
+// TTL or exhausted their retries, or that no longer fit in the queue once the
+// retry ends, are dead-lettered.
+func (e *MustDeliverEmitter) Retry() int {
+	var delivered int
+	now := time.Now()
+	overflow := e.queue.each(func(pending *queuedEnvelope) bool {
+		if now.After(pending.expires) {
+			e.deadLetter(pending.envelope)
+			return false
+		}
+
+		if err := e.innerEmitter.EmitEnvelope(pending.envelope); err != nil {
+			pending.attempts++
+			if isTooLarge(err) || e.config.Retries > 0 && pending.attempts >= e.config.Retries {
+				e.deadLetter(pending.envelope)
+				return false
+			}
+			return true
+		}
+		delivered++
+		return false
+	})
+	for _, pending := range overflow {
+		e.deadLetter(pending.envelope)
+	}
+
+	if delivered > 0 {
+		metrics.BatchAddCounter("mustDeliverEmitter.redeliveredEnvelopes", uint64(delivered))
+	}
+	return delivered
+}
+
+// Pending returns the number of envelopes waiting to be retried.
+func (e *MustDeliverEmitter) Pending() int {
+	return e.queue.len()
+}
+
+// DeadLetters returns the number of dead-lettered envelopes waiting to be
+// replayed.
+func (e *MustDeliverEmitter) DeadLetters() int {
+	return e.deadLetters.DeadLetters()
+}
+
+// ReplayDeadLetters re-emits the dead letters, as
+// DeadLetterEmitter.ReplayDeadLetters does.
+func (e *MustDeliverEmitter) ReplayDeadLetters() (int, error) {
+	return e.deadLetters.ReplayDeadLetters()
+}
+
+// Close stops the periodic retries, and waits for one in progress to finish.
+// Envelopes still queued are left for a final call to Retry.
+func (e *MustDeliverEmitter) Close() {
+	e.lock.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.stop)
+	}
+	e.lock.Unlock()
+
+	<-e.done
+}
+
+func (e *MustDeliverEmitter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.config.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.Retry()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *MustDeliverEmitter) deadLetter(envelope *events.Envelope) {
+	metrics.BatchIncrementCounter("mustDeliverEmitter.deadLetteredEnvelopes")
+
+	e.deadLetters.keep(envelope)
+}
+
+func (e *MustDeliverEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"capacity":             e.config.Capacity,
+		"retry_interval":       e.config.RetryInterval.String(),
+		"retries":              e.config.Retries,
+		"ttl":                  e.config.TTL.String(),
+		"dead_letter_capacity": e.config.DeadLetterCapacity,
+	}, map[string]interface{}{
+		"pending":      e.Pending(),
+		"dead_letters": e.DeadLetters(),
+	}, e.innerEmitter)
+}
@@ -0,0 +1,197 @@
+package emitter_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MustDeliverEmitter", func() {
+	var (
+		downstream  *outageEnvelopeEmitter
+		mockBatcher *mockMetricBatcher
+		config      emitter.MustDeliverConfig
+	)
+
+	BeforeEach(func() {
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+
+		downstream = &outageEnvelopeEmitter{FakeEventEmitter: fake.NewFakeEventEmitter("origin")}
+		config = emitter.MustDeliverConfig{Capacity: 2}
+	})
+
+	var newEnvelope = func(name string) *events.Envelope {
+		return &events.Envelope{
+			Origin:      proto.String("origin"),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			Timestamp:   proto.Int64(1),
+			ValueMetric: &events.ValueMetric{Name: proto.String(name), Value: proto.Float64(1), Unit: proto.String("unit")},
+		}
+	}
+
+	var metricNames = func() []string {
+		var names []string
+		for _, envelope := range downstream.GetEnvelopes() {
+			names = append(names, envelope.GetValueMetric().GetName())
+		}
+		return names
+	}
+
+	It("flags envelopes without modifying the original", func() {
+		envelope := newEnvelope("billing")
+		envelope.Tags = map[string]string{"app": "billing"}
+
+		flagged := emitter.MustDeliver(envelope)
+
+		Expect(emitter.IsMustDeliver(flagged)).To(BeTrue())
+		Expect(flagged.GetTags()).To(Equal(map[string]string{"app": "billing", emitter.MustDeliverTag: "true"}))
+		Expect(emitter.IsMustDeliver(envelope)).To(BeFalse())
+	})
+
+	It("redelivers flagged envelopes after a transient outage but not ordinary ones", func() {
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+		Expect(mustDeliverEmitter.Origin()).To(Equal("origin"))
+
+		downstream.setErr(errors.New("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(newEnvelope("ordinary"))).To(MatchError("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("billing")))).To(Succeed())
+		Expect(mustDeliverEmitter.Retry()).To(BeZero())
+		Expect(mustDeliverEmitter.Pending()).To(Equal(1))
+
+		downstream.setErr(nil)
+		Expect(mustDeliverEmitter.Retry()).To(Equal(1))
+
+		Expect(metricNames()).To(Equal([]string{"billing"}))
+		Expect(downstream.GetEnvelopes()[0].GetTags()).ToNot(HaveKey(emitter.MustDeliverTag))
+		Expect(mustDeliverEmitter.Pending()).To(BeZero())
+		Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(
+			With("mustDeliverEmitter.redeliveredEnvelopes", uint64(1)),
+		))
+	})
+
+	It("forwards flagged envelopes without the routing tag", func() {
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+		envelope := newEnvelope("billing")
+		envelope.Tags = map[string]string{"app": "billing"}
+
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(envelope))).To(Succeed())
+
+		Expect(downstream.GetEnvelopes()[0].GetTags()).To(Equal(map[string]string{"app": "billing"}))
+	})
+
+	It("retries past a queued envelope that keeps failing", func() {
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+
+		downstream.setErr(errors.New("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("poison")))).To(Succeed())
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("billing")))).To(Succeed())
+
+		downstream.setErr(nil)
+		downstream.rejectName = "poison"
+		Expect(mustDeliverEmitter.Retry()).To(Equal(1))
+
+		Expect(metricNames()).To(Equal([]string{"billing"}))
+		Expect(mustDeliverEmitter.Pending()).To(Equal(1))
+	})
+
+	It("retries queued envelopes on the retry interval", func() {
+		config.RetryInterval = 10 * time.Millisecond
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+		defer mustDeliverEmitter.Close()
+
+		downstream.setErr(errors.New("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("billing")))).To(Succeed())
+
+		downstream.setErr(nil)
+		Eventually(metricNames).Should(Equal([]string{"billing"}))
+	})
+
+	It("dead-letters envelopes that exhaust their retries", func() {
+		config.Retries = 2
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+
+		downstream.setErr(errors.New("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("billing")))).To(Succeed())
+		mustDeliverEmitter.Retry()
+		Expect(mustDeliverEmitter.DeadLetters()).To(BeZero())
+		mustDeliverEmitter.Retry()
+
+		Expect(mustDeliverEmitter.Pending()).To(BeZero())
+		Expect(mustDeliverEmitter.DeadLetters()).To(Equal(1))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("mustDeliverEmitter.deadLetteredEnvelopes"),
+		))
+
+		downstream.setErr(nil)
+		Expect(mustDeliverEmitter.ReplayDeadLetters()).To(Equal(1))
+		Expect(metricNames()).To(Equal([]string{"billing"}))
+	})
+
+	It("dead-letters envelopes that outlive their TTL", func() {
+		config.TTL = time.Millisecond
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+
+		downstream.setErr(errors.New("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("billing")))).To(Succeed())
+		time.Sleep(5 * time.Millisecond)
+
+		downstream.setErr(nil)
+		Expect(mustDeliverEmitter.Retry()).To(BeZero())
+		Expect(metricNames()).To(BeEmpty())
+		Expect(mustDeliverEmitter.DeadLetters()).To(Equal(1))
+	})
+
+	It("dead-letters flagged envelopes when the retry queue is full", func() {
+		mustDeliverEmitter := emitter.NewMustDeliverEmitter(downstream, config)
+
+		downstream.setErr(errors.New("connection refused"))
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("first")))).To(Succeed())
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("second")))).To(Succeed())
+		Expect(mustDeliverEmitter.EmitEnvelope(emitter.MustDeliver(newEnvelope("third")))).To(MatchError(emitter.ErrRetryQueueFull))
+
+		Expect(mustDeliverEmitter.Pending()).To(Equal(2))
+		Expect(mustDeliverEmitter.DeadLetters()).To(Equal(1))
+	})
+})
+
+// outageEnvelopeEmitter fails every emit with err while it is set. Unlike
+// flakyEnvelopeEmitter it is safe to reconfigure while emits are in progress.
+type outageEnvelopeEmitter struct {
+	*fake.FakeEventEmitter
+
+	lock       sync.Mutex
+	err        error
+	rejectName string
+}
+
+func (o *outageEnvelopeEmitter) setErr(err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.err = err
+}
+
+func (o *outageEnvelopeEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	o.lock.Lock()
+	err := o.err
+	o.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if o.rejectName != "" && envelope.GetValueMetric().GetName() == o.rejectName {
+		return errors.New("rejected")
+	}
+	return o.FakeEventEmitter.EmitEnvelope(envelope)
+}
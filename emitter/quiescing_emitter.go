@@ -0,0 +1,106 @@
+package emitter
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+)
+
+// ErrQuiescing is returned by a QuiescingEmitter for emits made after
+// Quiesce has been called.
+var ErrQuiescing = errors.New("quiescing emitter: not accepting new messages")
+
+// Drainer is implemented by emitters that hold messages back to write them
+// later, such as BufferedEmitter. Drain waits until every message accepted so
+// far has been written, and returns ctx.Err() if ctx is done first.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// QuiescingEmitter wraps a ByteEmitter so that emission can be wound down
+// gracefully, for example during a rolling restart, before it is closed.
+type QuiescingEmitter struct {
+	innerEmitter ByteEmitter
+
+	lock      sync.Mutex
+	quiescing bool
+	inFlight  int
+	idle      chan struct{}
+}
+
+func NewQuiescingEmitter(byteEmitter ByteEmitter) *QuiescingEmitter {
+	return &QuiescingEmitter{innerEmitter: byteEmitter}
+}
+
+func (e *QuiescingEmitter) Emit(data []byte) error {
+	e.lock.Lock()
+	if e.quiescing {
+		e.lock.Unlock()
+		metrics.BatchIncrementCounter("quiescingEmitter.rejectedEmits")
+		return ErrQuiescing
+	}
+	e.inFlight++
+	e.lock.Unlock()
+	defer e.finishEmit()
+
+	return e.innerEmitter.Emit(data)
+}
+
+func (e *QuiescingEmitter) finishEmit() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.inFlight--
+	if e.inFlight == 0 && e.idle != nil {
+		close(e.idle)
+		e.idle = nil
+	}
+}
+
+// Quiesce stops the emitter accepting new messages, which are rejected with
+// ErrQuiescing, and waits for emits already in progress to finish. If the
+// inner emitter is a Drainer, such as a BufferedEmitter, Quiesce then waits
+// for it to drain as well, so that messages it accepted are written rather
+// than lost. It returns ctx.Err() if ctx is done first. Once Quiesce returns
+// nil the emitter is safe to Close.
+func (e *QuiescingEmitter) Quiesce(ctx context.Context) error {
+	e.lock.Lock()
+	e.quiescing = true
+	var idle chan struct{}
+	if e.inFlight > 0 {
+		if e.idle == nil {
+			e.idle = make(chan struct{})
+		}
+		idle = e.idle
+	}
+	e.lock.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if drainer, ok := e.innerEmitter.(Drainer); ok {
+		return drainer.Drain(ctx)
+	}
+	return nil
+}
+
+func (e *QuiescingEmitter) Close() {
+	e.innerEmitter.Close()
+}
+
+func (e *QuiescingEmitter) Describe() []StageDescription {
+	e.lock.Lock()
+	quiescing := e.quiescing
+	e.lock.Unlock()
+
+	return DescribeStage(e, nil, map[string]interface{}{
+		"quiescing": quiescing,
+	}, e.innerEmitter)
+}
@@ -0,0 +1,125 @@
+package emitter_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("QuiescingEmitter", func() {
+	var (
+		innerEmitter     *blockingByteEmitter
+		quiescingEmitter *emitter.QuiescingEmitter
+		mockBatcher      *mockMetricBatcher
+	)
+
+	BeforeEach(func() {
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+
+		innerEmitter = &blockingByteEmitter{
+			FakeByteEmitter: fake.NewFakeByteEmitter(),
+			started:         make(chan struct{}, 10),
+			release:         make(chan struct{}),
+		}
+		quiescingEmitter = emitter.NewQuiescingEmitter(innerEmitter)
+	})
+
+	It("passes emits through before quiescing", func() {
+		close(innerEmitter.release)
+
+		Expect(quiescingEmitter.Emit([]byte("hello"))).To(Succeed())
+		Expect(innerEmitter.GetMessages()).To(Equal([][]byte{[]byte("hello")}))
+	})
+
+	It("rejects and counts new emits once quiescing", func() {
+		Expect(quiescingEmitter.Quiesce(context.Background())).To(Succeed())
+
+		Expect(quiescingEmitter.Emit([]byte("hello"))).To(Equal(emitter.ErrQuiescing))
+		Expect(innerEmitter.GetMessages()).To(BeEmpty())
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("quiescingEmitter.rejectedEmits"),
+		))
+	})
+
+	It("waits for in-flight emits to drain", func() {
+		emitted := make(chan error, 1)
+		go func() { emitted <- quiescingEmitter.Emit([]byte("in-flight")) }()
+		Eventually(innerEmitter.started).Should(Receive())
+
+		quiesced := make(chan error, 1)
+		go func() { quiesced <- quiescingEmitter.Quiesce(context.Background()) }()
+		Consistently(quiesced).ShouldNot(Receive())
+		Eventually(func() error { return quiescingEmitter.Emit([]byte("new")) }).Should(Equal(emitter.ErrQuiescing))
+
+		close(innerEmitter.release)
+
+		Eventually(quiesced).Should(Receive(BeNil()))
+		Expect(<-emitted).To(Succeed())
+		Expect(innerEmitter.GetMessages()).To(Equal([][]byte{[]byte("in-flight")}))
+	})
+
+	It("gives up when the context is done before draining", func() {
+		go quiescingEmitter.Emit([]byte("stuck"))
+		Eventually(innerEmitter.started).Should(Receive())
+		defer close(innerEmitter.release)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		Expect(quiescingEmitter.Quiesce(ctx)).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("drains a buffered inner emitter", func() {
+		quiescingEmitter = emitter.NewQuiescingEmitter(emitter.NewBufferedEmitter(innerEmitter, 10))
+		Expect(quiescingEmitter.Emit([]byte("first"))).To(Succeed())
+		Expect(quiescingEmitter.Emit([]byte("second"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+
+		quiesced := make(chan error, 1)
+		go func() { quiesced <- quiescingEmitter.Quiesce(context.Background()) }()
+		Consistently(quiesced).ShouldNot(Receive())
+
+		close(innerEmitter.release)
+
+		Eventually(quiesced).Should(Receive(BeNil()))
+		Expect(innerEmitter.GetMessages()).To(Equal([][]byte{[]byte("first"), []byte("second")}))
+	})
+
+	It("gives up when the context is done before a buffered inner emitter drains", func() {
+		quiescingEmitter = emitter.NewQuiescingEmitter(emitter.NewBufferedEmitter(innerEmitter, 10))
+		Expect(quiescingEmitter.Emit([]byte("stuck"))).To(Succeed())
+		Eventually(innerEmitter.started).Should(Receive())
+		defer close(innerEmitter.release)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		Expect(quiescingEmitter.Quiesce(ctx)).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("closes the inner emitter", func() {
+		quiescingEmitter.Close()
+
+		Expect(innerEmitter.IsClosed()).To(BeTrue())
+	})
+})
+
+type blockingByteEmitter struct {
+	*fake.FakeByteEmitter
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingByteEmitter) Emit(data []byte) error {
+	e.started <- struct{}{}
+	<-e.release
+	return e.FakeByteEmitter.Emit(data)
+}
@@ -0,0 +1,56 @@
+package emitter
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// SchemaVersionTag is the envelope tag under which SchemaVersionEmitter
+// records the sender's schema version.
+const SchemaVersionTag = "schema_version"
+
+// SchemaVersionEmitter wraps an EnvelopeEmitter and tags every envelope with
+// the schema version of the sender, so that receivers can spot mixed versions
+// during an upgrade. See DropsondeUnmarshaller.SetExpectedSchemaVersion.
+type SchemaVersionEmitter struct {
+	innerEmitter EnvelopeEmitter
+	version      string
+}
+
+func NewSchemaVersionEmitter(innerEmitter EnvelopeEmitter, version string) *SchemaVersionEmitter {
+	return &SchemaVersionEmitter{innerEmitter: innerEmitter, version: version}
+}
+
+func (e *SchemaVersionEmitter) Origin() string {
+	return e.innerEmitter.Origin()
+}
+
+func (e *SchemaVersionEmitter) Emit(event events.Event) error {
+	envelope, err := Wrap(event, e.innerEmitter.Origin())
+	if err != nil {
+		return fmt.Errorf("Wrap: %v", err)
+	}
+
+	return e.EmitEnvelope(envelope)
+}
+
+// EmitEnvelope emits a copy of envelope tagged with the schema version,
+// replacing any version it already carries.
+func (e *SchemaVersionEmitter) EmitEnvelope(envelope *events.Envelope) error {
+	tags := make(map[string]string, len(envelope.Tags)+1)
+	for key, value := range envelope.Tags {
+		tags[key] = value
+	}
+	tags[SchemaVersionTag] = e.version
+
+	tagged := *envelope
+	tagged.Tags = tags
+	return e.innerEmitter.EmitEnvelope(&tagged)
+}
+
+func (e *SchemaVersionEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"version": e.version,
+	}, nil, e.innerEmitter)
+}
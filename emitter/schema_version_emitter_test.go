@@ -0,0 +1,51 @@
+package emitter_test
+
+import (
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SchemaVersionEmitter", func() {
+	var (
+		innerEmitter  *fake.FakeEventEmitter
+		schemaEmitter *emitter.SchemaVersionEmitter
+	)
+
+	BeforeEach(func() {
+		innerEmitter = fake.NewFakeEventEmitter("origin")
+		schemaEmitter = emitter.NewSchemaVersionEmitter(innerEmitter, "2")
+	})
+
+	It("tags events with the schema version", func() {
+		Expect(schemaEmitter.Origin()).To(Equal("origin"))
+		Expect(schemaEmitter.Emit(factories.NewValueMetric("metric", 1, "unit"))).To(Succeed())
+
+		envelopes := innerEmitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(1))
+		Expect(envelopes[0].GetOrigin()).To(Equal("origin"))
+		Expect(envelopes[0].GetTags()).To(Equal(map[string]string{"schema_version": "2"}))
+	})
+
+	It("keeps existing tags without modifying the caller's envelope", func() {
+		envelope := &events.Envelope{
+			Origin:      proto.String("origin"),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			ValueMetric: factories.NewValueMetric("metric", 1, "unit"),
+			Tags:        map[string]string{"zone": "z1", "schema_version": "1"},
+		}
+
+		Expect(schemaEmitter.EmitEnvelope(envelope)).To(Succeed())
+
+		Expect(innerEmitter.GetEnvelopes()[0].GetTags()).To(Equal(map[string]string{
+			"zone":           "z1",
+			"schema_version": "2",
+		}))
+		Expect(envelope.GetTags()).To(HaveKeyWithValue("schema_version", "1"))
+	})
+})
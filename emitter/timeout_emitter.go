@@ -0,0 +1,97 @@
+package emitter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+)
+
+// ErrTimeout is returned by a TimeoutEmitter when an emit does not complete
+// within its timeout.
+var ErrTimeout = errors.New("timeout emitter: emit timed out")
+
+const defaultTimeoutMaxPending = 100
+
+// TimeoutEmitter wraps a ByteEmitter so that a slow downstream cannot block
+// the caller for longer than a fixed timeout.
+type TimeoutEmitter struct {
+	innerEmitter ByteEmitter
+	timeout      time.Duration
+	pending      chan struct{}
+}
+
+// NewTimeoutEmitter creates a TimeoutEmitter. A timeout of zero or less
+// disables it, and emits wait for the inner emitter however long it takes.
+func NewTimeoutEmitter(byteEmitter ByteEmitter, timeout time.Duration) *TimeoutEmitter {
+	return &TimeoutEmitter{
+		innerEmitter: byteEmitter,
+		timeout:      timeout,
+		pending:      make(chan struct{}, defaultTimeoutMaxPending),
+	}
+}
+
+// SetMaxPending sets how many emits may be in progress on the inner emitter
+// at once, including abandoned ones that have yet to finish. It defaults to
+// 100; values below one are treated as one. It must be called before the
+// emitter is used.
+func (e *TimeoutEmitter) SetMaxPending(maxPending int) {
+	if maxPending < 1 {
+		maxPending = 1
+	}
+	e.pending = make(chan struct{}, maxPending)
+}
+
+// Emit passes data to the inner emitter and waits for it to finish. If it
+// takes longer than the timeout, Emit counts the message as dropped and
+// returns ErrTimeout. The abandoned emit is left to finish in the background,
+// but counts against the maximum pending emits. While that maximum is
+// reached, as when the downstream hangs, messages are dropped at once and
+// ErrTimeout is returned without waiting.
+func (e *TimeoutEmitter) Emit(data []byte) error {
+	if e.timeout <= 0 {
+		return e.innerEmitter.Emit(data)
+	}
+
+	select {
+	case e.pending <- struct{}{}:
+	default:
+		e.countTimeout()
+		return ErrTimeout
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() { <-e.pending }()
+		result <- e.innerEmitter.Emit(data)
+	}()
+
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		e.countTimeout()
+		return ErrTimeout
+	}
+}
+
+func (e *TimeoutEmitter) countTimeout() {
+	metrics.BatchIncrementCounter("timeoutEmitter.droppedMessages")
+	CountDrop(DropTimeout)
+}
+
+func (e *TimeoutEmitter) Close() {
+	e.innerEmitter.Close()
+}
+
+func (e *TimeoutEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"timeout":     e.timeout.String(),
+		"max_pending": cap(e.pending),
+	}, map[string]interface{}{
+		"pending": len(e.pending),
+	}, e.innerEmitter)
+}
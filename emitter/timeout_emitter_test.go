@@ -0,0 +1,97 @@
+package emitter_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TimeoutEmitter", func() {
+	var (
+		innerEmitter *blockingByteEmitter
+		mockBatcher  *mockMetricBatcher
+	)
+
+	BeforeEach(func() {
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+
+		innerEmitter = &blockingByteEmitter{
+			FakeByteEmitter: fake.NewFakeByteEmitter(),
+			started:         make(chan struct{}, 10),
+			release:         make(chan struct{}),
+		}
+	})
+
+	It("returns the result of emits that finish in time", func() {
+		close(innerEmitter.release)
+		innerEmitter.ReturnError = errors.New("downstream failed")
+		timeoutEmitter := emitter.NewTimeoutEmitter(innerEmitter, time.Second)
+
+		Expect(timeoutEmitter.Emit([]byte("first"))).To(MatchError("downstream failed"))
+		Expect(timeoutEmitter.Emit([]byte("second"))).To(Succeed())
+		Expect(innerEmitter.GetMessages()).To(Equal([][]byte{[]byte("second")}))
+	})
+
+	It("aborts and counts emits to a slow downstream", func() {
+		defer close(innerEmitter.release)
+		timeoutEmitter := emitter.NewTimeoutEmitter(innerEmitter, 10*time.Millisecond)
+
+		start := time.Now()
+		Expect(timeoutEmitter.Emit([]byte("slow"))).To(Equal(emitter.ErrTimeout))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("timeoutEmitter.droppedMessages"),
+		))
+	})
+
+	It("drops emits at once while too many are pending", func() {
+		defer close(innerEmitter.release)
+		timeoutEmitter := emitter.NewTimeoutEmitter(innerEmitter, 10*time.Millisecond)
+		timeoutEmitter.SetMaxPending(2)
+
+		Expect(timeoutEmitter.Emit([]byte("first"))).To(Equal(emitter.ErrTimeout))
+		Expect(timeoutEmitter.Emit([]byte("second"))).To(Equal(emitter.ErrTimeout))
+		Eventually(innerEmitter.started).Should(HaveLen(2))
+
+		start := time.Now()
+		Expect(timeoutEmitter.Emit([]byte("third"))).To(Equal(emitter.ErrTimeout))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Millisecond))
+		Consistently(innerEmitter.started).Should(HaveLen(2))
+	})
+
+	It("accepts emits again once pending ones finish", func() {
+		timeoutEmitter := emitter.NewTimeoutEmitter(innerEmitter, 10*time.Millisecond)
+		timeoutEmitter.SetMaxPending(1)
+
+		Expect(timeoutEmitter.Emit([]byte("slow"))).To(Equal(emitter.ErrTimeout))
+		close(innerEmitter.release)
+		Eventually(innerEmitter.GetMessages).Should(HaveLen(1))
+
+		Eventually(func() error { return timeoutEmitter.Emit([]byte("fast")) }).Should(Succeed())
+	})
+
+	It("waits indefinitely when the timeout is disabled", func() {
+		timeoutEmitter := emitter.NewTimeoutEmitter(innerEmitter, 0)
+
+		emitted := make(chan error, 1)
+		go func() { emitted <- timeoutEmitter.Emit([]byte("slow")) }()
+		Consistently(emitted).ShouldNot(Receive())
+
+		close(innerEmitter.release)
+		Eventually(emitted).Should(Receive(BeNil()))
+	})
+
+	It("closes the inner emitter", func() {
+		emitter.NewTimeoutEmitter(innerEmitter, time.Second).Close()
+
+		Expect(innerEmitter.IsClosed()).To(BeTrue())
+	})
+})
@@ -2,6 +2,8 @@ package emitter
 
 import (
 	"net"
+	"os"
+	"syscall"
 )
 
 type UDPEmitter struct {
@@ -24,11 +26,33 @@ func NewUdpEmitter(remoteAddr string) (*UDPEmitter, error) {
 	return emitter, nil
 }
 
+// Emit sends data as a single datagram. Datagrams too large to send are
+// counted as dropped for DropOversized.
 func (e *UDPEmitter) Emit(data []byte) error {
 	_, err := e.udpConn.WriteTo(data, e.udpAddr)
+	if err != nil && isTooLarge(err) {
+		CountDrop(DropOversized)
+	}
 	return err
 }
 
+// isTooLarge reports whether err, or the error it wraps, is the EMSGSIZE a
+// UDP socket returns for a datagram that is too large to send.
+func isTooLarge(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.EMSGSIZE
+		default:
+			return false
+		}
+	}
+}
+
 func (e *UDPEmitter) Close() {
 	e.udpConn.Close()
 }
@@ -36,3 +60,11 @@ func (e *UDPEmitter) Close() {
 func (e *UDPEmitter) Address() net.Addr {
 	return e.udpConn.LocalAddr()
 }
+
+func (e *UDPEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"destination": e.udpAddr.String(),
+	}, map[string]interface{}{
+		"local_address": e.Address().String(),
+	}, nil)
+}
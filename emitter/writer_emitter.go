@@ -0,0 +1,73 @@
+package emitter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Framer delimits a single marshaled envelope so that a reader of the
+// underlying stream can split it back into envelopes.
+type Framer interface {
+	Frame(data []byte) []byte
+}
+
+// LengthPrefixFramer prefixes each envelope with its length as a 4-byte
+// big-endian unsigned integer.
+type LengthPrefixFramer struct{}
+
+func (LengthPrefixFramer) Frame(data []byte) []byte {
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	return append(frame, data...)
+}
+
+// NewlineFramer terminates each envelope with a newline. It is only suitable
+// for transports that already escape or encode the payload, since marshaled
+// envelopes may themselves contain newline bytes.
+type NewlineFramer struct{}
+
+func (NewlineFramer) Frame(data []byte) []byte {
+	frame := make([]byte, 0, len(data)+1)
+	frame = append(frame, data...)
+	return append(frame, '\n')
+}
+
+// WriterEmitter is a ByteEmitter that writes each framed message to an
+// io.Writer. It is safe for concurrent use.
+type WriterEmitter struct {
+	lock   sync.Mutex
+	writer io.Writer
+	framer Framer
+}
+
+func NewWriterEmitter(writer io.Writer, framer Framer) *WriterEmitter {
+	return &WriterEmitter{writer: writer, framer: framer}
+}
+
+// Emit frames the data and writes it to the writer in a single call.
+func (e *WriterEmitter) Emit(data []byte) error {
+	frame := e.framer.Frame(data)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.writer.Write(frame)
+	return err
+}
+
+// Close closes the writer if it implements io.Closer.
+func (e *WriterEmitter) Close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if closer, ok := e.writer.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (e *WriterEmitter) Describe() []StageDescription {
+	return DescribeStage(e, map[string]interface{}{
+		"writer": fmt.Sprintf("%T", e.writer),
+		"framer": fmt.Sprintf("%T", e.framer),
+	}, nil, nil)
+}
@@ -0,0 +1,125 @@
+package emitter_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WriterEmitter", func() {
+	var (
+		buffer *bytes.Buffer
+		writer *closeRecorder
+	)
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		writer = &closeRecorder{Writer: buffer}
+	})
+
+	Context("with a length-prefix framer", func() {
+		It("prefixes each message with its big-endian length", func() {
+			writerEmitter := emitter.NewWriterEmitter(writer, emitter.LengthPrefixFramer{})
+
+			Expect(writerEmitter.Emit([]byte("hello"))).To(Succeed())
+			Expect(writerEmitter.Emit([]byte("hi"))).To(Succeed())
+
+			Expect(buffer.Bytes()).To(Equal([]byte{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 2, 'h', 'i'}))
+		})
+
+		It("writes envelopes that can be read back", func() {
+			eventEmitter := emitter.NewEventEmitter(emitter.NewWriterEmitter(writer, emitter.LengthPrefixFramer{}), "origin")
+			event := &events.ValueMetric{Name: proto.String("metric"), Value: proto.Float64(1), Unit: proto.String("unit")}
+			Expect(eventEmitter.Emit(event)).To(Succeed())
+			Expect(eventEmitter.Emit(event)).To(Succeed())
+
+			for i := 0; i < 2; i++ {
+				var length uint32
+				Expect(binary.Read(buffer, binary.BigEndian, &length)).To(Succeed())
+				data := make([]byte, length)
+				_, err := io.ReadFull(buffer, data)
+				Expect(err).ToNot(HaveOccurred())
+
+				envelope := new(events.Envelope)
+				Expect(proto.Unmarshal(data, envelope)).To(Succeed())
+				Expect(envelope.GetOrigin()).To(Equal("origin"))
+				Expect(envelope.GetValueMetric()).To(Equal(event))
+			}
+			Expect(buffer.Len()).To(BeZero())
+		})
+	})
+
+	Context("with a newline framer", func() {
+		It("terminates each message with a newline", func() {
+			writerEmitter := emitter.NewWriterEmitter(writer, emitter.NewlineFramer{})
+
+			Expect(writerEmitter.Emit([]byte("hello"))).To(Succeed())
+			Expect(writerEmitter.Emit([]byte("hi"))).To(Succeed())
+
+			Expect(buffer.String()).To(Equal("hello\nhi\n"))
+		})
+	})
+
+	It("does not interleave concurrent writes", func() {
+		writerEmitter := emitter.NewWriterEmitter(writer, emitter.NewlineFramer{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				writerEmitter.Emit(bytes.Repeat([]byte("x"), 100))
+			}()
+		}
+		wg.Wait()
+
+		scanner := bufio.NewScanner(buffer)
+		var lines int
+		for scanner.Scan() {
+			Expect(scanner.Text()).To(HaveLen(100))
+			lines++
+		}
+		Expect(lines).To(Equal(50))
+	})
+
+	It("returns write errors", func() {
+		writerEmitter := emitter.NewWriterEmitter(failingWriter{}, emitter.NewlineFramer{})
+
+		Expect(writerEmitter.Emit([]byte("hello"))).To(MatchError(io.ErrClosedPipe))
+	})
+
+	Describe("Close()", func() {
+		It("closes the writer when it is an io.Closer", func() {
+			writerEmitter := emitter.NewWriterEmitter(writer, emitter.NewlineFramer{})
+
+			writerEmitter.Close()
+
+			Expect(writer.closed).To(BeTrue())
+		})
+	})
+})
+
+type closeRecorder struct {
+	io.Writer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -33,6 +33,17 @@ func GetAppId(envelope *events.Envelope) string {
 	return SystemAppId
 }
 
+// GetRequestId returns the request ID of an HttpStartStop event in the same
+// form as the X-Vcap-Request-Id header, or an empty string for other events
+// and events without one.
+func GetRequestId(envelope *events.Envelope) string {
+	uuid := envelope.GetHttpStartStop().GetRequestId()
+	if uuid == nil {
+		return ""
+	}
+	return formatUUID(uuid)
+}
+
 type hasAppId interface {
 	GetApplicationId() *events.UUID
 }
@@ -49,4 +49,22 @@ var _ = Describe("EnvelopeExtensions", func() {
 			})
 		})
 	})
+
+	Describe("GetRequestId", func() {
+		It("returns the request ID of an HttpStartStop event", func() {
+			envelope := &events.Envelope{
+				EventType:     events.Envelope_HttpStartStop.Enum(),
+				HttpStartStop: &events.HttpStartStop{RequestId: testAppUuid},
+			}
+			Expect(envelope_extensions.GetRequestId(envelope)).To(Equal("01000000-0000-0000-0200-000000000000"))
+		})
+
+		It("returns an empty string for other events", func() {
+			envelope := &events.Envelope{
+				EventType:  events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{AppId: proto.String("test-app-id")},
+			}
+			Expect(envelope_extensions.GetRequestId(envelope)).To(BeEmpty())
+		})
+	})
 })
@@ -9,15 +9,54 @@ type EnvelopeEmitter interface {
 // A EnvelopeSender emits envelopes.
 type EnvelopeSender struct {
 	emitter EnvelopeEmitter
+	tags    map[string]string
+}
+
+// An Option configures an EnvelopeSender.
+type Option func(*EnvelopeSender)
+
+// WithTags adds the given tags, such as an instance ID, zone or deployment,
+// to every envelope sent. Tags already on an envelope take precedence.
+func WithTags(tags map[string]string) Option {
+	return func(ms *EnvelopeSender) {
+		if ms.tags == nil {
+			ms.tags = make(map[string]string, len(tags))
+		}
+		for key, value := range tags {
+			ms.tags[key] = value
+		}
+	}
 }
 
 // NewEnvelopeSender instantiates a EnvelopeSender with the given EventEmitter.
-func NewEnvelopeSender(emitter EnvelopeEmitter) *EnvelopeSender {
-	return &EnvelopeSender{emitter: emitter}
+func NewEnvelopeSender(emitter EnvelopeEmitter, opts ...Option) *EnvelopeSender {
+	ms := &EnvelopeSender{emitter: emitter}
+	for _, opt := range opts {
+		opt(ms)
+	}
+	return ms
 }
 
 // SendEnvelope sends the given envelope.
 // Returns an error if one occurs while sending the envelope.
 func (ms *EnvelopeSender) SendEnvelope(envelope *events.Envelope) error {
-	return ms.emitter.EmitEnvelope(envelope)
+	return ms.emitter.EmitEnvelope(ms.tag(envelope))
+}
+
+func (ms *EnvelopeSender) tag(envelope *events.Envelope) *events.Envelope {
+	if len(ms.tags) == 0 {
+		return envelope
+	}
+
+	tags := make(map[string]string, len(ms.tags)+len(envelope.GetTags()))
+	for key, value := range ms.tags {
+		tags[key] = value
+	}
+	for key, value := range envelope.GetTags() {
+		tags[key] = value
+	}
+
+	tagged := *envelope
+	tagged.Tags = tags
+	return &tagged
 }
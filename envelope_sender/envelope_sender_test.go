@@ -45,4 +45,35 @@ var _ = Describe("EnvelopeSender", func() {
 		Expect(err.Error()).To(Equal("some error"))
 	})
 
+	Context("WithTags", func() {
+		BeforeEach(func() {
+			sender = envelope_sender.NewEnvelopeSender(emitter, envelope_sender.WithTags(map[string]string{
+				"zone":       "z1",
+				"deployment": "cf",
+			}))
+		})
+
+		It("adds the tags to every envelope", func() {
+			Expect(sender.SendEnvelope(createTestEnvelope(envOrigin))).To(Succeed())
+
+			Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+			Expect(emitter.GetEnvelopes()[0].GetTags()).To(Equal(map[string]string{
+				"zone":       "z1",
+				"deployment": "cf",
+			}))
+		})
+
+		It("keeps the envelope's own tags and leaves the envelope unchanged", func() {
+			envelope := createTestEnvelope(envOrigin)
+			envelope.Tags = map[string]string{"zone": "z2", "instance_id": "abc"}
+			Expect(sender.SendEnvelope(envelope)).To(Succeed())
+
+			Expect(emitter.GetEnvelopes()[0].GetTags()).To(Equal(map[string]string{
+				"zone":        "z2",
+				"deployment":  "cf",
+				"instance_id": "abc",
+			}))
+			Expect(envelope.GetTags()).To(HaveLen(2))
+		})
+	})
 })
@@ -0,0 +1,29 @@
+package envelopes
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/jsonpb"
+)
+
+// FromJSON builds an Envelope from its JSON representation, as produced by
+// jsonpb. Field names may be given in their JSON (camelCase) or original
+// proto form, and enums by name. It is intended for authoring readable test
+// fixtures:
+//
+//		envelope, err := envelopes.FromJSON([]byte(`{
+//			"origin": "fixture",
+//			"eventType": "ValueMetric",
+//			"valueMetric": {"name": "cpu", "value": 42, "unit": "percent"}
+//		}`))
+//
+// Malformed JSON and unknown fields are reported as errors.
+func FromJSON(data []byte) (*events.Envelope, error) {
+	envelope := &events.Envelope{}
+	if err := jsonpb.Unmarshal(bytes.NewReader(data), envelope); err != nil {
+		return nil, fmt.Errorf("envelopes: invalid envelope JSON: %v", err)
+	}
+	return envelope, nil
+}
@@ -0,0 +1,96 @@
+package envelopes_test
+
+import (
+	"github.com/cloudfoundry/dropsonde/envelopes"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FromJSON", func() {
+	It("builds a value metric envelope", func() {
+		envelope, err := envelopes.FromJSON([]byte(`{
+			"origin": "fixture",
+			"eventType": "ValueMetric",
+			"timestamp": "1234",
+			"tags": {"zone": "z1"},
+			"valueMetric": {"name": "cpu", "value": 42.5, "unit": "percent"}
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(envelope).To(Equal(&events.Envelope{
+			Origin:    proto.String("fixture"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Timestamp: proto.Int64(1234),
+			Tags:      map[string]string{"zone": "z1"},
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("cpu"),
+				Value: proto.Float64(42.5),
+				Unit:  proto.String("percent"),
+			},
+		}))
+	})
+
+	It("builds a counter event envelope", func() {
+		envelope, err := envelopes.FromJSON([]byte(`{
+			"origin": "fixture",
+			"eventType": "CounterEvent",
+			"counterEvent": {"name": "requests", "delta": 3, "total": 10}
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(envelope.GetCounterEvent()).To(Equal(&events.CounterEvent{
+			Name:  proto.String("requests"),
+			Delta: proto.Uint64(3),
+			Total: proto.Uint64(10),
+		}))
+	})
+
+	It("accepts enum names in nested events", func() {
+		envelope, err := envelopes.FromJSON([]byte(`{
+			"origin": "fixture",
+			"eventType": "LogMessage",
+			"logMessage": {"message": "aGVsbG8=", "message_type": "ERR", "timestamp": "5", "app_id": "app"}
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+
+		logMessage := envelope.GetLogMessage()
+		Expect(logMessage.GetMessage()).To(Equal([]byte("hello")))
+		Expect(logMessage.GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(logMessage.GetAppId()).To(Equal("app"))
+	})
+
+	It("round-trips envelopes marshaled with jsonpb", func() {
+		original := &events.Envelope{
+			Origin:    proto.String("fixture"),
+			EventType: events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{
+				ApplicationId: proto.String("app"),
+				InstanceIndex: proto.Int32(2),
+				CpuPercentage: proto.Float64(12.5),
+				MemoryBytes:   proto.Uint64(1024),
+				DiskBytes:     proto.Uint64(2048),
+			},
+		}
+		json, err := (&jsonpb.Marshaler{}).MarshalToString(original)
+		Expect(err).ToNot(HaveOccurred())
+
+		envelope, err := envelopes.FromJSON([]byte(json))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(envelope).To(Equal(original))
+	})
+
+	It("returns a descriptive error for invalid JSON", func() {
+		_, err := envelopes.FromJSON([]byte(`{"origin": `))
+		Expect(err).To(MatchError(ContainSubstring("invalid envelope JSON")))
+	})
+
+	It("returns an error for unknown fields", func() {
+		_, err := envelopes.FromJSON([]byte(`{"origin": "fixture", "colour": "blue"}`))
+		Expect(err).To(MatchError(ContainSubstring("colour")))
+	})
+})
@@ -1,9 +1,13 @@
 package factories
 
 import (
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -26,7 +30,7 @@ func NewHttpStartStop(req *http.Request, statusCode int, contentLength int64, pe
 		PeerType:       &peerType,
 		Method:         events.Method(events.Method_value[req.Method]).Enum(),
 		Uri:            proto.String(fmt.Sprintf("%s://%s%s", scheme(req), req.Host, req.URL.Path)),
-		RemoteAddress:  proto.String(req.RemoteAddr),
+		RemoteAddress:  proto.String(remoteAddress(req)),
 		UserAgent:      proto.String(req.UserAgent()),
 		StatusCode:     proto.Int(statusCode),
 		ContentLength:  proto.Int64(contentLength),
@@ -52,6 +56,200 @@ func NewHttpStartStop(req *http.Request, statusCode int, contentLength int64, pe
 	return httpStartStop
 }
 
+// NewProxiedHttpStartStop creates the pair of correlated events recorded by a
+// reverse proxy for one request: a server event for the inbound request and a
+// client event for the request forwarded upstream. Both share requestId and
+// carry the status code and content length of the proxied response. The
+// client event's URI is taken from outReq.URL when it names a host. Both
+// events are stamped with the current time; use SetHttpStartStopTimes to
+// record the timing of each leg.
+func NewProxiedHttpStartStop(inReq, outReq *http.Request, statusCode int, contentLength int64, requestId *uuid.UUID) (server, client *events.HttpStartStop) {
+	server = NewHttpStartStop(inReq, statusCode, contentLength, events.PeerType_Server, requestId)
+	client = NewHttpStartStop(outReq, statusCode, contentLength, events.PeerType_Client, requestId)
+	if outReq.URL != nil && outReq.URL.Host != "" {
+		client.Uri = proto.String(fmt.Sprintf("%s://%s%s", outboundScheme(outReq), outReq.URL.Host, outReq.URL.Path))
+	}
+	return server, client
+}
+
+// SetHttpStartStopTimes sets the start and stop timestamps of event. Zero
+// times leave the corresponding timestamp unchanged.
+func SetHttpStartStopTimes(event *events.HttpStartStop, start, stop time.Time) {
+	if !start.IsZero() {
+		event.StartTimestamp = proto.Int64(start.UnixNano())
+	}
+	if !stop.IsZero() {
+		event.StopTimestamp = proto.Int64(stop.UnixNano())
+	}
+}
+
+// An HttpStartStopOption customizes an HttpStartStop event built from req and
+// may record additional request or response attributes as envelope tags. The
+// response header is nil when no response was received.
+type HttpStartStopOption func(req *http.Request, responseHeader http.Header, event *events.HttpStartStop, tags map[string]string)
+
+// NewTaggedHttpStartStop creates an HttpStartStop event as NewHttpStartStop
+// does, applies the given options to it and returns the envelope tags they
+// recorded. The returned tags are nil if no option recorded any.
+func NewTaggedHttpStartStop(req *http.Request, responseHeader http.Header, statusCode int, contentLength int64, peerType events.PeerType, requestId *uuid.UUID, opts ...HttpStartStopOption) (*events.HttpStartStop, map[string]string) {
+	httpStartStop := NewHttpStartStop(req, statusCode, contentLength, peerType, requestId)
+
+	tags := make(map[string]string)
+	for _, opt := range opts {
+		opt(req, responseHeader, httpStartStop, tags)
+	}
+	if len(tags) == 0 {
+		return httpStartStop, nil
+	}
+	return httpStartStop, tags
+}
+
+// WithServerName records the TLS SNI server name requested by the client as
+// the "server_name" tag. Plaintext requests, and TLS clients that did not send
+// SNI, are left untagged.
+func WithServerName() HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		if req.TLS != nil && req.TLS.ServerName != "" {
+			tags["server_name"] = req.TLS.ServerName
+		}
+	}
+}
+
+// WithNegotiatedProtocol records the application protocol negotiated over
+// TLS ALPN, such as "h2" or "http/1.1", as the "negotiated_protocol" tag.
+// Plaintext requests, and TLS connections that did not negotiate a protocol,
+// are left untagged.
+func WithNegotiatedProtocol() HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		if req.TLS != nil && req.TLS.NegotiatedProtocol != "" {
+			tags["negotiated_protocol"] = req.TLS.NegotiatedProtocol
+		}
+	}
+}
+
+// WithApplicationIDFromContext falls back to the application ID stored in the
+// request context under key when the X-CF-ApplicationID header does not carry
+// a valid one. The context value may be a *uuid.UUID or a string; values that
+// are not valid UUIDs are ignored.
+func WithApplicationIDFromContext(key interface{}) HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, event *events.HttpStartStop, _ map[string]string) {
+		if event.ApplicationId != nil {
+			return
+		}
+
+		switch value := req.Context().Value(key).(type) {
+		case *uuid.UUID:
+			if value != nil {
+				event.ApplicationId = NewUUID(value)
+			}
+		case string:
+			if applicationId, err := uuid.ParseHex(value); err == nil {
+				event.ApplicationId = NewUUID(applicationId)
+			}
+		}
+	}
+}
+
+// WithApplicationIDFromJWT falls back to the application ID carried in the
+// named claim of a JWT when the X-CF-ApplicationID header does not carry a
+// valid one. The token is read from header, with or without a "Bearer "
+// prefix. Its signature is not verified, which is left to the caller; tokens
+// that are malformed, unsigned or whose claim is not a valid UUID are
+// ignored.
+func WithApplicationIDFromJWT(header, claim string) HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, event *events.HttpStartStop, _ map[string]string) {
+		if event.ApplicationId != nil {
+			return
+		}
+
+		value, ok := jwtClaim(req.Header.Get(header), claim)
+		if !ok {
+			return
+		}
+		if applicationId, err := uuid.ParseHex(value); err == nil {
+			event.ApplicationId = NewUUID(applicationId)
+		}
+	}
+}
+
+// WithHandlerName records the name returned by nameFor as the "handler" tag,
+// identifying the logical handler or controller that served the request. The
+// tag is omitted when nameFor returns an empty string.
+func WithHandlerName(nameFor func(*http.Request) string) HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		if name := nameFor(req); name != "" {
+			tags["handler"] = name
+		}
+	}
+}
+
+// WithTags records each of the given tags, such as a deployment or zone, on
+// every event built with the option. Tags recorded by options listed after it
+// take precedence.
+func WithTags(tags map[string]string) HttpStartStopOption {
+	return func(_ *http.Request, _ http.Header, _ *events.HttpStartStop, recorded map[string]string) {
+		for key, value := range tags {
+			recorded[key] = value
+		}
+	}
+}
+
+// WithContentEncoding records the request's Accept-Encoding header as the
+// "accept_encoding" tag and the response's Content-Encoding header as the
+// "content_encoding" tag, to help diagnose compression. Absent headers are
+// omitted.
+func WithContentEncoding() HttpStartStopOption {
+	return func(req *http.Request, responseHeader http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		if acceptEncoding := req.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+			tags["accept_encoding"] = acceptEncoding
+		}
+		if contentEncoding := responseHeader.Get("Content-Encoding"); contentEncoding != "" {
+			tags["content_encoding"] = contentEncoding
+		}
+	}
+}
+
+// WithRefererHost records the host of the request's Referer header as the
+// "referer_host" tag. Use WithReferer to record the full referer. Requests
+// without a referer, or whose referer is not an absolute URL, are left
+// untagged.
+func WithRefererHost() HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		if referer, ok := parseReferer(req); ok {
+			tags["referer_host"] = referer.Host
+		}
+	}
+}
+
+// WithReferer records the request's full Referer header as the "referer" tag.
+// Referers can carry personal data in their paths and query strings, so
+// prefer WithRefererHost unless the full URL is needed. Absent and malformed
+// referers are omitted.
+func WithReferer() HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		if _, ok := parseReferer(req); ok {
+			tags["referer"] = req.Referer()
+		}
+	}
+}
+
+// WithTraceContext records the distributed trace context propagated with the
+// request as the "trace_id", "span_id" and "sampled" tags. It understands the
+// W3C traceparent header and both forms of B3: the single b3 header and the
+// X-B3-TraceId, X-B3-SpanId and X-B3-Sampled headers. A valid traceparent
+// takes precedence over B3, and the single B3 header over the multi-header
+// form. Malformed values are ignored.
+func WithTraceContext() HttpStartStopOption {
+	return func(req *http.Request, _ http.Header, _ *events.HttpStartStop, tags map[string]string) {
+		for _, parse := range []func(http.Header) (traceContext, bool){parseTraceparent, parseB3Single, parseB3Multi} {
+			if trace, ok := parse(req.Header); ok {
+				trace.record(tags)
+				return
+			}
+		}
+	}
+}
+
 func NewError(source string, code int32, message string) *events.Error {
 	err := &events.Error{
 		Source:  proto.String(source),
@@ -90,6 +288,37 @@ func NewLogMessage(messageType events.LogMessage_MessageType, messageString, app
 	return logMessage
 }
 
+// A LogMessageOption customizes a LogMessage event and may record envelope
+// tags for it.
+type LogMessageOption func(event *events.LogMessage, tags map[string]string)
+
+// NewTaggedLogMessage creates a LogMessage event as NewLogMessage does,
+// applies the given options to it and returns the envelope tags they
+// recorded. The returned tags are nil if no option recorded any.
+func NewTaggedLogMessage(messageType events.LogMessage_MessageType, messageString, appId, sourceType string, opts ...LogMessageOption) (*events.LogMessage, map[string]string) {
+	logMessage := NewLogMessage(messageType, messageString, appId, sourceType)
+
+	tags := make(map[string]string)
+	for _, opt := range opts {
+		opt(logMessage, tags)
+	}
+	if len(tags) == 0 {
+		return logMessage, nil
+	}
+	return logMessage, tags
+}
+
+// WithLogMessageTags records each of the given tags, such as a deployment or
+// zone, on every log message built with the option. It is the LogMessage
+// counterpart of WithTags.
+func WithLogMessageTags(tags map[string]string) LogMessageOption {
+	return func(_ *events.LogMessage, recorded map[string]string) {
+		for key, value := range tags {
+			recorded[key] = value
+		}
+	}
+}
+
 func NewContainerMetric(applicationId string, instanceIndex int32, cpuPercentage float64, memoryBytes uint64, diskBytes uint64) *events.ContainerMetric {
 	return &events.ContainerMetric{
 		ApplicationId: &applicationId,
@@ -100,6 +329,28 @@ func NewContainerMetric(applicationId string, instanceIndex int32, cpuPercentage
 	}
 }
 
+// remoteAddress returns the address of the client that originated req: the
+// left-most entry of X-Forwarded-For when it is an IP address, and otherwise
+// the host part of req.RemoteAddr.
+func remoteAddress(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		client := stripPort(strings.TrimSpace(strings.Split(forwarded, ",")[0]))
+		if net.ParseIP(client) != nil {
+			return client
+		}
+	}
+	return stripPort(req.RemoteAddr)
+}
+
+// stripPort returns the host part of a host:port address, without the
+// brackets around IPv6 literals. Addresses without a port are returned as is.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
 func parseXForwarded(forwarded string) []string {
 	addrs := strings.Split(forwarded, ",")
 	for i, addr := range addrs {
@@ -108,9 +359,150 @@ func parseXForwarded(forwarded string) []string {
 	return addrs
 }
 
+func outboundScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+	return scheme(req)
+}
+
 func scheme(req *http.Request) string {
 	if req.TLS == nil {
 		return "http"
 	}
 	return "https"
 }
+
+// jwtClaim returns the string value of claim in the payload of a signed
+// JWT, without verifying the signature.
+func jwtClaim(token, claim string) (string, bool) {
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[2] == "" {
+		return "", false
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if !decodeJWTSegment(parts[0], &header) || header.Alg == "" || strings.EqualFold(header.Alg, "none") {
+		return "", false
+	}
+
+	var claims map[string]interface{}
+	if !decodeJWTSegment(parts[1], &claims) {
+		return "", false
+	}
+	value, ok := claims[claim].(string)
+	return value, ok
+}
+
+func decodeJWTSegment(segment string, v interface{}) bool {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func parseReferer(req *http.Request) (*url.URL, bool) {
+	referer, err := url.Parse(req.Referer())
+	if err != nil || !referer.IsAbs() || referer.Host == "" {
+		return nil, false
+	}
+	return referer, true
+}
+
+type traceContext struct {
+	traceId, spanId, sampled string
+}
+
+func (t traceContext) record(tags map[string]string) {
+	if t.traceId != "" {
+		tags["trace_id"] = t.traceId
+		tags["span_id"] = t.spanId
+	}
+	if t.sampled != "" {
+		tags["sampled"] = t.sampled
+	}
+}
+
+func parseTraceparent(header http.Header) (traceContext, bool) {
+	parts := strings.Split(header.Get("traceparent"), "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	if !isHexId(parts[1], 32) || !isHexId(parts[2], 16) || !isHex(parts[3], 2) {
+		return traceContext{}, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return traceContext{traceId: parts[1], spanId: parts[2], sampled: strconv.FormatBool(flags&1 == 1)}, true
+}
+
+func parseB3Single(header http.Header) (traceContext, bool) {
+	value := header.Get("b3")
+	if value == "0" {
+		return traceContext{sampled: "false"}, true
+	}
+
+	parts := strings.Split(value, "-")
+	if len(parts) < 2 || len(parts) > 4 || !isB3TraceId(parts[0]) || !isHexId(parts[1], 16) {
+		return traceContext{}, false
+	}
+	trace := traceContext{traceId: parts[0], spanId: parts[1]}
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "1", "d":
+			trace.sampled = "true"
+		case "0":
+			trace.sampled = "false"
+		default:
+			return traceContext{}, false
+		}
+	}
+	if len(parts) > 3 && !isHexId(parts[3], 16) {
+		return traceContext{}, false
+	}
+	return trace, true
+}
+
+func parseB3Multi(header http.Header) (traceContext, bool) {
+	traceId, spanId := header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId")
+	if !isB3TraceId(traceId) || !isHexId(spanId, 16) {
+		return traceContext{}, false
+	}
+	trace := traceContext{traceId: traceId, spanId: spanId}
+	switch {
+	case header.Get("X-B3-Flags") == "1":
+		trace.sampled = "true"
+	case header.Get("X-B3-Sampled") == "1" || header.Get("X-B3-Sampled") == "true":
+		trace.sampled = "true"
+	case header.Get("X-B3-Sampled") == "0" || header.Get("X-B3-Sampled") == "false":
+		trace.sampled = "false"
+	}
+	return trace, true
+}
+
+func isB3TraceId(id string) bool {
+	return isHexId(id, 16) || isHexId(id, 32)
+}
+
+// isHexId reports whether id is a non-zero identifier of length lowercase hex
+// digits. Both W3C and B3 treat an all-zero identifier as invalid.
+func isHexId(id string, length int) bool {
+	return isHex(id, length) && strings.Trim(id, "0") != ""
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -5,8 +5,12 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/sonde-go/events"
@@ -96,6 +100,485 @@ var _ = Describe("HTTP event creation", func() {
 			startStopEvent := factories.NewHttpStartStop(req, http.StatusOK, 3, events.PeerType_Server, requestId)
 			Expect(startStopEvent.GetForwarded()).To(Equal(allForwards))
 		})
+
+		Describe("RemoteAddress", func() {
+			remoteAddress := func() string {
+				return factories.NewHttpStartStop(req, http.StatusOK, 3, events.PeerType_Server, requestId).GetRemoteAddress()
+			}
+
+			It("uses the left-most X-Forwarded-For address", func() {
+				req.Header.Set("X-Forwarded-For", " 123.123.123.123 , 10.10.10.10")
+				req.Header.Add("X-Forwarded-For", "192.168.0.2")
+
+				Expect(remoteAddress()).To(Equal("123.123.123.123"))
+			})
+
+			It("accepts IPv6 addresses in X-Forwarded-For", func() {
+				req.Header.Set("X-Forwarded-For", "2001:db8::1, 10.10.10.10")
+
+				Expect(remoteAddress()).To(Equal("2001:db8::1"))
+			})
+
+			It("strips the port from RemoteAddr", func() {
+				req.RemoteAddr = "10.0.0.1:1234"
+
+				Expect(remoteAddress()).To(Equal("10.0.0.1"))
+			})
+
+			It("strips the port and brackets from an IPv6 RemoteAddr", func() {
+				req.RemoteAddr = "[::1]:443"
+
+				Expect(remoteAddress()).To(Equal("::1"))
+			})
+
+			It("falls back to RemoteAddr when X-Forwarded-For is empty", func() {
+				req.RemoteAddr = "10.0.0.1:1234"
+				req.Header.Set("X-Forwarded-For", "")
+
+				Expect(remoteAddress()).To(Equal("10.0.0.1"))
+			})
+
+			It("falls back to RemoteAddr when X-Forwarded-For is malformed", func() {
+				req.RemoteAddr = "10.0.0.1:1234"
+				req.Header.Set("X-Forwarded-For", "not-an-ip, 10.10.10.10")
+
+				Expect(remoteAddress()).To(Equal("10.0.0.1"))
+			})
+		})
+	})
+
+	Describe("NewTaggedHttpStartStop", func() {
+		It("records the left-most X-Forwarded-For address as the remote address", func() {
+			req.Header.Set("X-Forwarded-For", "123.123.123.123, 10.10.10.10")
+
+			event, _ := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 1234, events.PeerType_Server, requestId)
+			Expect(event.GetRemoteAddress()).To(Equal("123.123.123.123"))
+		})
+
+		It("returns the same event as NewHttpStartStop and no tags without options", func() {
+			event, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 1234, events.PeerType_Server, requestId)
+			expectedEvent := factories.NewHttpStartStop(req, http.StatusOK, 1234, events.PeerType_Server, requestId)
+			expectedEvent.StartTimestamp = event.StartTimestamp
+			expectedEvent.StopTimestamp = event.StopTimestamp
+
+			Expect(event).To(Equal(expectedEvent))
+			Expect(tags).To(BeNil())
+		})
+
+		Describe("WithServerName", func() {
+			It("records the TLS SNI server name as a tag", func() {
+				req.TLS = &tls.ConnectionState{ServerName: "tenant.example.com"}
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithServerName())
+				Expect(tags).To(HaveKeyWithValue("server_name", "tenant.example.com"))
+			})
+
+			It("omits the tag for plaintext requests", func() {
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithServerName())
+				Expect(tags).ToNot(HaveKey("server_name"))
+			})
+
+			It("omits the tag when the client sent no server name", func() {
+				req.TLS = &tls.ConnectionState{}
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithServerName())
+				Expect(tags).ToNot(HaveKey("server_name"))
+			})
+		})
+
+		Describe("WithNegotiatedProtocol", func() {
+			It("records the ALPN protocol as a tag", func() {
+				req.TLS = &tls.ConnectionState{NegotiatedProtocol: "h2"}
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithNegotiatedProtocol())
+				Expect(tags).To(HaveKeyWithValue("negotiated_protocol", "h2"))
+			})
+
+			It("omits the tag for plaintext requests", func() {
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithNegotiatedProtocol())
+				Expect(tags).ToNot(HaveKey("negotiated_protocol"))
+			})
+
+			It("omits the tag when no protocol was negotiated", func() {
+				req.TLS = &tls.ConnectionState{}
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithNegotiatedProtocol())
+				Expect(tags).ToNot(HaveKey("negotiated_protocol"))
+			})
+		})
+
+		Describe("WithApplicationIDFromContext", func() {
+			var (
+				headerAppId  *uuid.UUID
+				contextAppId *uuid.UUID
+			)
+
+			BeforeEach(func() {
+				headerAppId, _ = uuid.NewV4()
+				contextAppId, _ = uuid.NewV4()
+			})
+
+			withContextValue := func(value interface{}) {
+				req = req.WithContext(context.WithValue(req.Context(), appIdKey{}, value))
+			}
+
+			newEvent := func() *events.HttpStartStop {
+				event, _ := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithApplicationIDFromContext(appIdKey{}))
+				return event
+			}
+
+			It("uses the header when only the header is set", func() {
+				req.Header.Set("X-CF-ApplicationID", headerAppId.String())
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(headerAppId)))
+			})
+
+			It("falls back to a string in the context", func() {
+				withContextValue(contextAppId.String())
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(contextAppId)))
+			})
+
+			It("falls back to a UUID in the context", func() {
+				withContextValue(contextAppId)
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(contextAppId)))
+			})
+
+			It("prefers the header when both are set", func() {
+				req.Header.Set("X-CF-ApplicationID", headerAppId.String())
+				withContextValue(contextAppId.String())
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(headerAppId)))
+			})
+
+			It("ignores an invalid context value", func() {
+				withContextValue("not-a-uuid")
+
+				Expect(newEvent().ApplicationId).To(BeNil())
+			})
+
+			It("ignores a context value of another type", func() {
+				withContextValue(42)
+
+				Expect(newEvent().ApplicationId).To(BeNil())
+			})
+		})
+
+		Describe("WithApplicationIDFromJWT", func() {
+			var tokenAppId *uuid.UUID
+
+			BeforeEach(func() {
+				tokenAppId, _ = uuid.NewV4()
+			})
+
+			newEvent := func() *events.HttpStartStop {
+				event, _ := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithApplicationIDFromJWT("Authorization", "app_id"))
+				return event
+			}
+
+			It("uses the claim when the header is absent", func() {
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"RS256","typ":"JWT"}`, `{"sub":"user","app_id":"`+tokenAppId.String()+`"}`, "c2lnbmF0dXJl"))
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(tokenAppId)))
+			})
+
+			It("accepts a token without the bearer prefix", func() {
+				req.Header.Set("Authorization", jwt(`{"alg":"HS256"}`, `{"app_id":"`+tokenAppId.String()+`"}`, "c2lnbmF0dXJl"))
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(tokenAppId)))
+			})
+
+			It("prefers the X-CF-ApplicationID header", func() {
+				headerAppId, _ := uuid.NewV4()
+				req.Header.Set("X-CF-ApplicationID", headerAppId.String())
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"RS256"}`, `{"app_id":"`+tokenAppId.String()+`"}`, "c2lnbmF0dXJl"))
+
+				Expect(newEvent().GetApplicationId()).To(Equal(factories.NewUUID(headerAppId)))
+			})
+
+			It("ignores malformed tokens", func() {
+				req.Header.Set("Authorization", "Bearer not.a-token")
+				Expect(newEvent().ApplicationId).To(BeNil())
+
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"RS256"}`, `not json`, "c2lnbmF0dXJl"))
+				Expect(newEvent().ApplicationId).To(BeNil())
+			})
+
+			It("ignores unsigned tokens", func() {
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"none"}`, `{"app_id":"`+tokenAppId.String()+`"}`, ""))
+				Expect(newEvent().ApplicationId).To(BeNil())
+
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"none"}`, `{"app_id":"`+tokenAppId.String()+`"}`, "c2lnbmF0dXJl"))
+				Expect(newEvent().ApplicationId).To(BeNil())
+			})
+
+			It("ignores claims that are missing or not UUIDs", func() {
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"RS256"}`, `{"sub":"user"}`, "c2lnbmF0dXJl"))
+				Expect(newEvent().ApplicationId).To(BeNil())
+
+				req.Header.Set("Authorization", "Bearer "+jwt(`{"alg":"RS256"}`, `{"app_id":"tenant-a"}`, "c2lnbmF0dXJl"))
+				Expect(newEvent().ApplicationId).To(BeNil())
+			})
+		})
+
+		Describe("WithContentEncoding", func() {
+			It("records the accepted and actual encodings", func() {
+				req.Header.Set("Accept-Encoding", "gzip, deflate")
+				responseHeader := http.Header{"Content-Encoding": {"gzip"}}
+
+				_, tags := factories.NewTaggedHttpStartStop(req, responseHeader, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithContentEncoding())
+				Expect(tags).To(Equal(map[string]string{
+					"accept_encoding":  "gzip, deflate",
+					"content_encoding": "gzip",
+				}))
+			})
+
+			It("omits absent headers", func() {
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithContentEncoding())
+				Expect(tags).To(BeNil())
+			})
+		})
+
+		Describe("WithHandlerName", func() {
+			It("records the provided name as a tag", func() {
+				nameFor := func(r *http.Request) string { return "users#" + r.Method }
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithHandlerName(nameFor))
+				Expect(tags).To(HaveKeyWithValue("handler", "users#"+req.Method))
+			})
+
+			It("omits the tag when the name is empty", func() {
+				nameFor := func(*http.Request) string { return "" }
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithHandlerName(nameFor))
+				Expect(tags).To(BeNil())
+			})
+		})
+		Describe("WithTags", func() {
+			It("records the given tags", func() {
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithTags(map[string]string{"zone": "z1", "deployment": "cf"}))
+				Expect(tags).To(Equal(map[string]string{"zone": "z1", "deployment": "cf"}))
+			})
+
+			It("is overridden by later options", func() {
+				nameFor := func(*http.Request) string { return "users" }
+
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithTags(map[string]string{"handler": "static"}), factories.WithHandlerName(nameFor))
+				Expect(tags).To(HaveKeyWithValue("handler", "users"))
+			})
+		})
+
+		Describe("WithRefererHost and WithReferer", func() {
+			var refererTags = func(opts ...factories.HttpStartStopOption) map[string]string {
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, opts...)
+				return tags
+			}
+
+			It("records only the referer host by default", func() {
+				req.Header.Set("Referer", "https://search.example.com:8443/results?q=private")
+
+				Expect(refererTags(factories.WithRefererHost())).To(Equal(map[string]string{
+					"referer_host": "search.example.com:8443",
+				}))
+			})
+
+			It("records the full referer when asked to", func() {
+				req.Header.Set("Referer", "https://search.example.com/results?q=private")
+
+				Expect(refererTags(factories.WithRefererHost(), factories.WithReferer())).To(Equal(map[string]string{
+					"referer_host": "search.example.com",
+					"referer":      "https://search.example.com/results?q=private",
+				}))
+			})
+
+			It("omits malformed referers", func() {
+				req.Header.Set("Referer", "http://%zz/")
+				Expect(refererTags(factories.WithRefererHost(), factories.WithReferer())).To(BeNil())
+
+				req.Header.Set("Referer", "/relative/path")
+				Expect(refererTags(factories.WithRefererHost(), factories.WithReferer())).To(BeNil())
+			})
+
+			It("omits absent referers", func() {
+				Expect(refererTags(factories.WithRefererHost(), factories.WithReferer())).To(BeNil())
+			})
+		})
+
+		Describe("WithTraceContext", func() {
+			const (
+				w3cTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+				w3cSpanId  = "00f067aa0ba902b7"
+				b3TraceId  = "80f198ee56343ba864fe8b2a57d3eff7"
+				b3SpanId   = "e457b5a2e4d86bd1"
+			)
+
+			var traceTags = func() map[string]string {
+				_, tags := factories.NewTaggedHttpStartStop(req, nil, http.StatusOK, 3, events.PeerType_Server, requestId, factories.WithTraceContext())
+				return tags
+			}
+
+			It("records the W3C traceparent", func() {
+				req.Header.Set("traceparent", "00-"+w3cTraceId+"-"+w3cSpanId+"-01")
+
+				Expect(traceTags()).To(Equal(map[string]string{
+					"trace_id": w3cTraceId,
+					"span_id":  w3cSpanId,
+					"sampled":  "true",
+				}))
+			})
+
+			It("records the single B3 header", func() {
+				req.Header.Set("b3", b3TraceId+"-"+b3SpanId+"-0-05e3ac9a4f6e3b90")
+
+				Expect(traceTags()).To(Equal(map[string]string{
+					"trace_id": b3TraceId,
+					"span_id":  b3SpanId,
+					"sampled":  "false",
+				}))
+			})
+
+			It("records a single B3 header that only carries a sampling decision", func() {
+				req.Header.Set("b3", "0")
+
+				Expect(traceTags()).To(Equal(map[string]string{"sampled": "false"}))
+			})
+
+			It("records the multiple B3 headers", func() {
+				req.Header.Set("X-B3-TraceId", "a3ce929d0e0e4736")
+				req.Header.Set("X-B3-SpanId", b3SpanId)
+				req.Header.Set("X-B3-Sampled", "1")
+
+				Expect(traceTags()).To(Equal(map[string]string{
+					"trace_id": "a3ce929d0e0e4736",
+					"span_id":  b3SpanId,
+					"sampled":  "true",
+				}))
+			})
+
+			It("treats the B3 debug flag as sampled", func() {
+				req.Header.Set("X-B3-TraceId", b3TraceId)
+				req.Header.Set("X-B3-SpanId", b3SpanId)
+				req.Header.Set("X-B3-Flags", "1")
+
+				Expect(traceTags()).To(HaveKeyWithValue("sampled", "true"))
+			})
+
+			It("omits the sampling decision when B3 defers it", func() {
+				req.Header.Set("X-B3-TraceId", b3TraceId)
+				req.Header.Set("X-B3-SpanId", b3SpanId)
+
+				Expect(traceTags()).ToNot(HaveKey("sampled"))
+			})
+
+			It("prefers W3C over B3", func() {
+				req.Header.Set("traceparent", "00-"+w3cTraceId+"-"+w3cSpanId+"-00")
+				req.Header.Set("b3", b3TraceId+"-"+b3SpanId+"-1")
+				req.Header.Set("X-B3-TraceId", b3TraceId)
+				req.Header.Set("X-B3-SpanId", b3SpanId)
+
+				Expect(traceTags()).To(Equal(map[string]string{
+					"trace_id": w3cTraceId,
+					"span_id":  w3cSpanId,
+					"sampled":  "false",
+				}))
+			})
+
+			It("prefers the single B3 header over the multiple headers", func() {
+				req.Header.Set("b3", b3TraceId+"-"+b3SpanId)
+				req.Header.Set("X-B3-TraceId", "a3ce929d0e0e4736")
+				req.Header.Set("X-B3-SpanId", "a3ce929d0e0e4736")
+
+				Expect(traceTags()).To(HaveKeyWithValue("trace_id", b3TraceId))
+			})
+
+			It("falls back to B3 when the traceparent is malformed", func() {
+				req.Header.Set("traceparent", "00-"+w3cTraceId+"-"+w3cSpanId)
+				req.Header.Set("b3", b3TraceId+"-"+b3SpanId+"-1")
+
+				Expect(traceTags()).To(HaveKeyWithValue("trace_id", b3TraceId))
+			})
+
+			It("ignores malformed values", func() {
+				req.Header.Set("traceparent", "00-00000000000000000000000000000000-"+w3cSpanId+"-01")
+				req.Header.Set("b3", b3TraceId+"-"+b3SpanId+"-x")
+				req.Header.Set("X-B3-TraceId", "not-hex")
+				req.Header.Set("X-B3-SpanId", b3SpanId)
+
+				Expect(traceTags()).To(BeNil())
+			})
+		})
+	})
+
+	Describe("NewProxiedHttpStartStop", func() {
+		var (
+			requestId *uuid.UUID
+			inReq     *http.Request
+			outReq    *http.Request
+		)
+
+		BeforeEach(func() {
+			requestId, _ = uuid.NewV4()
+
+			inReq, _ = http.NewRequest("GET", "http://foo.example.com/", nil)
+			inReq.URL = &url.URL{Path: "/users"}
+			inReq.RemoteAddr = "10.0.0.1:1234"
+
+			outReq, _ = http.NewRequest("GET", "https://backend.internal:8443/api/users", nil)
+		})
+
+		It("returns a server and a client event sharing the request ID", func() {
+			server, client := factories.NewProxiedHttpStartStop(inReq, outReq, http.StatusOK, 42, requestId)
+
+			Expect(server.GetRequestId()).To(Equal(factories.NewUUID(requestId)))
+			Expect(client.GetRequestId()).To(Equal(server.GetRequestId()))
+
+			Expect(server.GetPeerType()).To(Equal(events.PeerType_Server))
+			Expect(client.GetPeerType()).To(Equal(events.PeerType_Client))
+
+			Expect(server.GetStatusCode()).To(BeNumerically("==", http.StatusOK))
+			Expect(client.GetStatusCode()).To(BeNumerically("==", http.StatusOK))
+			Expect(client.GetContentLength()).To(BeNumerically("==", 42))
+		})
+
+		It("records the URI of each leg", func() {
+			server, client := factories.NewProxiedHttpStartStop(inReq, outReq, http.StatusOK, 42, requestId)
+
+			Expect(server.GetUri()).To(Equal("http://foo.example.com/users"))
+			Expect(client.GetUri()).To(Equal("https://backend.internal:8443/api/users"))
+		})
+
+		It("records the originating client as the remote address of the server leg", func() {
+			server, _ := factories.NewProxiedHttpStartStop(inReq, outReq, http.StatusOK, 42, requestId)
+			Expect(server.GetRemoteAddress()).To(Equal("10.0.0.1"))
+
+			inReq.Header.Set("X-Forwarded-For", "123.123.123.123, 10.10.10.10")
+			server, _ = factories.NewProxiedHttpStartStop(inReq, outReq, http.StatusOK, 42, requestId)
+			Expect(server.GetRemoteAddress()).To(Equal("123.123.123.123"))
+		})
+
+		It("records the timing of each leg when provided", func() {
+			server, client := factories.NewProxiedHttpStartStop(inReq, outReq, http.StatusOK, 42, requestId)
+
+			start := time.Unix(100, 0)
+			factories.SetHttpStartStopTimes(server, start, start.Add(5*time.Second))
+			factories.SetHttpStartStopTimes(client, start.Add(time.Second), start.Add(4*time.Second))
+
+			Expect(server.GetStartTimestamp()).To(Equal(start.UnixNano()))
+			Expect(server.GetStopTimestamp()).To(Equal(start.Add(5 * time.Second).UnixNano()))
+			Expect(client.GetStartTimestamp()).To(Equal(start.Add(time.Second).UnixNano()))
+			Expect(client.GetStopTimestamp()).To(Equal(start.Add(4 * time.Second).UnixNano()))
+		})
+
+		It("leaves timestamps unchanged for zero times", func() {
+			_, client := factories.NewProxiedHttpStartStop(inReq, outReq, http.StatusOK, 42, requestId)
+			stop := client.GetStopTimestamp()
+
+			factories.SetHttpStartStopTimes(client, time.Unix(100, 0), time.Time{})
+
+			Expect(client.GetStartTimestamp()).To(Equal(time.Unix(100, 0).UnixNano()))
+			Expect(client.GetStopTimestamp()).To(Equal(stop))
+		})
 	})
 
 	Describe("NewLogMessage", func() {
@@ -116,6 +599,26 @@ var _ = Describe("HTTP event creation", func() {
 		})
 	})
 
+	Describe("NewTaggedLogMessage", func() {
+		It("builds the same event as NewLogMessage with no tags by default", func() {
+			logEvent, tags := factories.NewTaggedLogMessage(events.LogMessage_ERR, "hello", "app-id", "App")
+
+			Expect(logEvent.GetMessage()).To(Equal([]byte("hello")))
+			Expect(logEvent.GetMessageType()).To(Equal(events.LogMessage_ERR))
+			Expect(logEvent.GetAppId()).To(Equal("app-id"))
+			Expect(tags).To(BeNil())
+		})
+
+		It("records the tags given with WithLogMessageTags", func() {
+			_, tags := factories.NewTaggedLogMessage(events.LogMessage_OUT, "hello", "app-id", "App",
+				factories.WithLogMessageTags(map[string]string{"zone": "z1"}),
+				factories.WithLogMessageTags(map[string]string{"deployment": "cf"}),
+			)
+
+			Expect(tags).To(Equal(map[string]string{"zone": "z1", "deployment": "cf"}))
+		})
+	})
+
 	Describe("NewContainerMetric", func() {
 		It("should set the appropriate fields", func() {
 			expectedContainerMetric := &events.ContainerMetric{
@@ -132,3 +635,10 @@ var _ = Describe("HTTP event creation", func() {
 		})
 	})
 })
+
+type appIdKey struct{}
+
+func jwt(header, claims, signature string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims)) + "." + signature
+}
@@ -2,11 +2,17 @@ package instrumented_handler
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cloudfoundry/dropsonde/emitter"
 	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
@@ -17,19 +23,75 @@ type EventEmitter interface {
 	Emit(events.Event) error
 }
 
+type envelopeEmitter interface {
+	EmitEnvelope(*events.Envelope) error
+	Origin() string
+}
+
+type connContextKey struct{}
+
+// ConnContext returns a copy of ctx that carries conn. The instrumented
+// handler records the remote host of that connection for requests that have
+// neither a RemoteAddr nor an X-Forwarded-For client, as happens with some
+// custom listeners and hijacked connections.
+//
+// On Go 1.13 and later, ConnContext can be installed as http.Server's
+// ConnContext hook. On earlier versions, which lack that hook, the code that
+// reads requests from the connection, such as a custom listener's serve loop
+// or a handler serving requests over a hijacked connection, attaches it to
+// each request before passing the request on:
+//
+//	req = req.WithContext(instrumented_handler.ConnContext(req.Context(), conn))
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
 type instrumentedHandler struct {
-	handler http.Handler
-	emitter EventEmitter
+	handler     http.Handler
+	emitter     EventEmitter
+	opts        []factories.HttpStartStopOption
+	emitTimings bool
 }
 
 // InstrumentedHandler is a helper for creating an instrumented http.Handler
-// which will delegate to the given http.Handler.
-func InstrumentedHandler(handler http.Handler, emitter EventEmitter) http.Handler {
-	return &instrumentedHandler{handler, emitter}
+// which will delegate to the given http.Handler. The options are applied to
+// each HttpStartStop event after the request has been served; any tags they
+// record are attached to the event's envelope if the emitter can emit
+// envelopes.
+func InstrumentedHandler(handler http.Handler, emitter EventEmitter, opts ...factories.HttpStartStopOption) http.Handler {
+	return &instrumentedHandler{handler: handler, emitter: emitter, opts: opts}
+}
+
+// TimedInstrumentedHandler is like InstrumentedHandler, but also splits each
+// request's duration into two value metrics, in milliseconds, so that a slow
+// app can be told apart from a slow client: "requestHandlerTime" is the time
+// the handler took to return, less the time it spent blocked writing and
+// flushing the response, and "requestTotalTime" is the time until the
+// response has been flushed to the client. To measure the latter, the
+// response is flushed once the handler returns, rather than by net/http
+// afterwards, so responses without a Content-Length are sent chunked.
+//
+// Requests carrying an X-Request-Start header, as stamped by a front-end
+// proxy, also produce a "requestQueueTime" value metric: the milliseconds
+// between that time and the handler starting. See parseRequestStart for the
+// accepted formats. Since gorouter stamps the header on every request, this
+// costs an extra envelope per request, so it is not emitted by a plain
+// InstrumentedHandler.
+func TimedInstrumentedHandler(handler http.Handler, emitter EventEmitter, opts ...factories.HttpStartStopOption) http.Handler {
+	return &instrumentedHandler{handler: handler, emitter: emitter, opts: opts, emitTimings: true}
 }
 
 // ServeHTTP wraps the given http.Handler ServerHTTP function.  It provides
-// accounting metrics for the http.Request / http.Response life-cycle
+// accounting metrics for the http.Request / http.Response life-cycle.
+//
+// The event records the first final status the handler wrote, and the bytes
+// it wrote. If the handler hijacks the connection, as for a WebSocket
+// upgrade, the event is emitted once the hijacked connection is closed, even
+// if that happens after the handler returns, so that it covers the whole
+// upgraded session. It then counts the body bytes written to the connection
+// until then too, and records the status from a response status line written
+// to it; the status line and headers themselves are not counted. A hijacked
+// connection that is never closed is never reported.
 func (ih *instrumentedHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	requestId, err := uuid.ParseHex(req.Header.Get("X-Vcap-Request-Id"))
 	if err != nil {
@@ -43,23 +105,144 @@ func (ih *instrumentedHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 	rw.Header().Set("X-Vcap-Request-Id", requestId.String())
 
 	startTime := time.Now()
+	if ih.emitTimings {
+		ih.emitQueueTime(req, startTime)
+	}
 
-	instrumentedWriter := &instrumentedResponseWriter{writer: rw, statusCode: 200}
+	instrumentedWriter := &instrumentedResponseWriter{
+		writer:     rw,
+		statusCode: 200,
+		reportHijacked: func(statusCode int, contentLength int64) {
+			ih.emitStartStop(req, rw.Header(), statusCode, contentLength, requestId, startTime)
+		},
+	}
 	ih.handler.ServeHTTP(instrumentedWriter, req)
+	if ih.emitTimings {
+		if _, ok := rw.(http.Flusher); ok && instrumentedWriter.hijackedConn == nil {
+			instrumentedWriter.Flush()
+		}
+		ih.emitTimes(time.Since(startTime), instrumentedWriter.writeTime)
+	}
 
-	startStopEvent := factories.NewHttpStartStop(req, instrumentedWriter.statusCode, instrumentedWriter.contentLength, events.PeerType_Server, requestId)
+	if instrumentedWriter.hijackedConn != nil {
+		return
+	}
+	ih.emitStartStop(req, rw.Header(), instrumentedWriter.statusCode, instrumentedWriter.contentLength, requestId, startTime)
+}
+
+func (ih *instrumentedHandler) emitStartStop(req *http.Request, responseHeader http.Header, statusCode int, contentLength int64, requestId *uuid.UUID, startTime time.Time) {
+	startStopEvent, tags := factories.NewTaggedHttpStartStop(req, responseHeader, statusCode, contentLength, events.PeerType_Server, requestId, ih.opts...)
 	startStopEvent.StartTimestamp = proto.Int64(startTime.UnixNano())
+	if startStopEvent.GetRemoteAddress() == "" {
+		if conn, ok := req.Context().Value(connContextKey{}).(net.Conn); ok && conn.RemoteAddr() != nil {
+			startStopEvent.RemoteAddress = proto.String(connHost(conn.RemoteAddr()))
+		}
+	}
 
-	err = ih.emitter.Emit(startStopEvent)
+	err := ih.emit(startStopEvent, tags)
 	if err != nil {
 		log.Printf("failed to emit startstop event: %v\n", err)
 	}
 }
 
+func connHost(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// emitQueueTime emits the time the request spent queued in front of the
+// handler. Queue times below zero, caused by clock skew between hosts, are
+// reported as zero.
+func (ih *instrumentedHandler) emitQueueTime(req *http.Request, startTime time.Time) {
+	requestStart, ok := parseRequestStart(req.Header.Get("X-Request-Start"))
+	if !ok {
+		return
+	}
+
+	queueTime := startTime.Sub(requestStart)
+	if queueTime < 0 {
+		queueTime = 0
+	}
+
+	ih.emitTime("requestQueueTime", queueTime)
+}
+
+func (ih *instrumentedHandler) emitTimes(total, writing time.Duration) {
+	ih.emitTime("requestHandlerTime", total-writing)
+	ih.emitTime("requestTotalTime", total)
+}
+
+func (ih *instrumentedHandler) emitTime(name string, duration time.Duration) {
+	err := ih.emitter.Emit(&events.ValueMetric{
+		Name:  proto.String(name),
+		Value: proto.Float64(float64(duration) / float64(time.Millisecond)),
+		Unit:  proto.String("ms"),
+	})
+	if err != nil {
+		log.Printf("failed to emit %s: %v\n", name, err)
+	}
+}
+
+// parseRequestStart parses an X-Request-Start header holding the Unix time,
+// optionally prefixed with "t=". A value with a fractional part, as written
+// by nginx's $msec, is read as seconds. An integer value is read in the unit
+// its magnitude implies: seconds, milliseconds as written by gorouter,
+// microseconds as written by Apache's %t, or nanoseconds.
+func parseRequestStart(header string) (time.Time, bool) {
+	value := strings.TrimPrefix(strings.TrimSpace(header), "t=")
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if strings.Contains(value, ".") {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds <= 0 {
+			return time.Time{}, false
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || timestamp <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case timestamp >= 1e17:
+		return time.Unix(0, timestamp), true
+	case timestamp >= 1e14:
+		return time.Unix(0, timestamp*int64(time.Microsecond)), true
+	case timestamp >= 1e11:
+		return time.Unix(0, timestamp*int64(time.Millisecond)), true
+	default:
+		return time.Unix(timestamp, 0), true
+	}
+}
+
+func (ih *instrumentedHandler) emit(event *events.HttpStartStop, tags map[string]string) error {
+	envEmitter, ok := ih.emitter.(envelopeEmitter)
+	if len(tags) == 0 || !ok {
+		return ih.emitter.Emit(event)
+	}
+
+	envelope, err := emitter.Wrap(event, envEmitter.Origin())
+	if err != nil {
+		return err
+	}
+	envelope.Tags = tags
+	return envEmitter.EmitEnvelope(envelope)
+}
+
 type instrumentedResponseWriter struct {
 	writer        http.ResponseWriter
 	contentLength int64
 	statusCode    int
+	wroteHeader   bool
+	writeTime     time.Duration
+
+	hijackedConn   *instrumentedConn
+	reportHijacked func(statusCode int, contentLength int64)
 }
 
 func (irw *instrumentedResponseWriter) Header() http.Header {
@@ -67,16 +250,29 @@ func (irw *instrumentedResponseWriter) Header() http.Header {
 }
 
 func (irw *instrumentedResponseWriter) Write(data []byte) (int, error) {
+	irw.wroteHeader = true
+	start := time.Now()
 	writeCount, err := irw.writer.Write(data)
+	irw.writeTime += time.Since(start)
 	irw.contentLength += int64(writeCount)
 	return writeCount, err
 }
 
+// WriteHeader records the first final status written. As in net/http, later
+// calls do not change the status sent, and informational 1xx statuses other
+// than 101 Switching Protocols are followed by the final one.
 func (irw *instrumentedResponseWriter) WriteHeader(statusCode int) {
-	irw.statusCode = statusCode
+	if !irw.wroteHeader && !isInformational(statusCode) {
+		irw.statusCode = statusCode
+		irw.wroteHeader = true
+	}
 	irw.writer.WriteHeader(statusCode)
 }
 
+func isInformational(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+}
+
 func (irw *instrumentedResponseWriter) Flush() {
 	flusher, ok := irw.writer.(http.Flusher)
 
@@ -84,7 +280,9 @@ func (irw *instrumentedResponseWriter) Flush() {
 		panic("Called Flush on an InstrumentedResponseWriter that wraps a non-Flushable writer.")
 	}
 
+	start := time.Now()
 	flusher.Flush()
+	irw.writeTime += time.Since(start)
 }
 
 func (irw *instrumentedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
@@ -94,7 +292,30 @@ func (irw *instrumentedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, er
 		panic("Called Hijack on an InstrumentedResponseWriter that wraps a non-Hijackable writer")
 	}
 
-	return hijacker.Hijack()
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+
+	// Anything still buffered was written before the hijack, so it is sent
+	// as it is before the writer is redirected through the counting conn.
+	if brw != nil {
+		if err := brw.Writer.Flush(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	irw.hijackedConn = &instrumentedConn{
+		Conn:          conn,
+		statusCode:    irw.statusCode,
+		contentLength: irw.contentLength,
+		report:        irw.reportHijacked,
+	}
+	if brw != nil {
+		brw.Writer.Reset(irw.hijackedConn)
+	}
+	return irw.hijackedConn, brw, nil
 }
 
 func (irw *instrumentedResponseWriter) CloseNotify() <-chan bool {
@@ -107,4 +328,102 @@ func (irw *instrumentedResponseWriter) CloseNotify() <-chan bool {
 	return notifier.CloseNotify()
 }
 
+// instrumentedConn counts the body bytes written to a hijacked connection and
+// reports them once, when the connection is first closed.
+type instrumentedConn struct {
+	net.Conn
+
+	lock          sync.Mutex
+	statusCode    int
+	contentLength int64
+	wroteStatus   bool
+	inHead        bool
+	headTail      []byte
+	reported      bool
+	report        func(statusCode int, contentLength int64)
+}
+
+var headTerminator = []byte("\r\n\r\n")
+
+func (c *instrumentedConn) Write(data []byte) (int, error) {
+	writeCount, err := c.Conn.Write(data)
+	written := data[:writeCount]
+
+	c.lock.Lock()
+	if !c.wroteStatus {
+		c.wroteStatus = true
+		if statusCode, ok := parseStatusLine(data); ok {
+			c.statusCode = statusCode
+			c.inHead = true
+		}
+	}
+	c.contentLength += int64(c.bodyLength(written))
+	c.lock.Unlock()
+
+	return writeCount, err
+}
+
+// bodyLength returns how many of the written bytes follow the response head
+// written to the connection, if any. It must be called with the lock held.
+func (c *instrumentedConn) bodyLength(written []byte) int {
+	if !c.inHead {
+		return len(written)
+	}
+
+	// The terminator may straddle writes, so the end of the previous write
+	// is searched along with this one.
+	buffer := append(c.headTail, written...)
+	end := bytes.Index(buffer, headTerminator)
+	if end < 0 {
+		if len(buffer) > len(headTerminator)-1 {
+			buffer = buffer[len(buffer)-(len(headTerminator)-1):]
+		}
+		c.headTail = append([]byte(nil), buffer...)
+		return 0
+	}
+
+	c.inHead = false
+	c.headTail = nil
+	return len(buffer) - (end + len(headTerminator))
+}
+
+func (c *instrumentedConn) Close() error {
+	err := c.Conn.Close()
+	c.finish()
+	return err
+}
+
+// finish reports the status and bytes recorded so far, unless they have
+// already been reported.
+func (c *instrumentedConn) finish() {
+	c.lock.Lock()
+	if c.reported || c.report == nil {
+		c.lock.Unlock()
+		return
+	}
+	c.reported = true
+	statusCode, contentLength := c.statusCode, c.contentLength
+	c.lock.Unlock()
+
+	c.report(statusCode, contentLength)
+}
+
+// parseStatusLine reads the status code from data that starts with an HTTP/1
+// status line, such as "HTTP/1.1 101 Switching Protocols".
+func parseStatusLine(data []byte) (int, bool) {
+	line := string(data)
+	if !strings.HasPrefix(line, "HTTP/1.") {
+		return 0, false
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	statusCode, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil || statusCode < 100 || statusCode > 999 {
+		return 0, false
+	}
+	return statusCode, true
+}
+
 var GenerateUuid = uuid.NewV4
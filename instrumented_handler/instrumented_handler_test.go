@@ -2,13 +2,18 @@ package instrumented_handler_test
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"time"
 
 	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/dropsonde/instrumented_handler"
 	"github.com/cloudfoundry/sonde-go/events"
 	uuid "github.com/nu7hatch/gouuid"
@@ -95,11 +100,444 @@ var _ = Describe("InstrumentedHandler", func() {
 				Expect(messages).To(HaveLen(1))
 				Expect(messages[0].Event).To(BeAssignableToTypeOf(new(events.HttpStartStop)))
 				startStopEvent := messages[0].Event.(*events.HttpStartStop)
-				Expect(startStopEvent.GetStatusCode()).To(BeNumerically("==", 123))
+				Expect(startStopEvent.GetStatusCode()).To(BeNumerically("==", http.StatusAccepted))
 				Expect(startStopEvent.GetContentLength()).To(BeNumerically("==", 12))
 				Expect(startStopEvent.StartTimestamp).NotTo(Equal(startStopEvent.StopTimestamp))
 			})
 		})
+
+		Context("with an empty RemoteAddr", func() {
+			BeforeEach(func() {
+				req.RemoteAddr = ""
+			})
+
+			var emittedRemoteAddress = func() string {
+				messages := fakeEmitter.GetMessages()
+				Expect(messages).To(HaveLen(1))
+				return messages[0].Event.(*events.HttpStartStop).GetRemoteAddress()
+			}
+
+			It("records the remote host of the connection in the context", func() {
+				server, client := net.Pipe()
+				defer server.Close()
+				defer client.Close()
+				conn := &addrConn{Conn: server, remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 52311}}
+				req = req.WithContext(instrumented_handler.ConnContext(context.Background(), conn))
+
+				h.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(emittedRemoteAddress()).To(Equal("10.0.0.7"))
+			})
+
+			It("leaves the address empty when there is no connection in the context", func() {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(emittedRemoteAddress()).To(BeEmpty())
+			})
+		})
+
+		It("prefers RemoteAddr over the connection in the context", func() {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			conn := &addrConn{Conn: server, remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 52311}}
+			req = req.WithContext(instrumented_handler.ConnContext(context.Background(), conn))
+
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(fakeEmitter.GetMessages()[0].Event.(*events.HttpStartStop).GetRemoteAddress()).To(Equal("127.0.0.1"))
+		})
+
+		Context("with content encoding tags", func() {
+			serveWithEncoding := func(contentEncoding string) *events.Envelope {
+				encodingHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					rw.Header().Set("Content-Encoding", contentEncoding)
+					rw.Write([]byte("body"))
+				})
+				h = instrumented_handler.InstrumentedHandler(encodingHandler, fakeEmitter, factories.WithContentEncoding())
+				req.Header.Set("Accept-Encoding", "gzip")
+				h.ServeHTTP(httptest.NewRecorder(), req)
+
+				envelopes := fakeEmitter.GetEnvelopes()
+				Expect(envelopes).To(HaveLen(1))
+				return envelopes[0]
+			}
+
+			It("tags gzip responses", func() {
+				envelope := serveWithEncoding("gzip")
+				Expect(envelope.GetTags()).To(Equal(map[string]string{
+					"accept_encoding":  "gzip",
+					"content_encoding": "gzip",
+				}))
+			})
+
+			It("tags identity responses", func() {
+				envelope := serveWithEncoding("identity")
+				Expect(envelope.GetTags()).To(HaveKeyWithValue("content_encoding", "identity"))
+			})
+
+			It("omits the content encoding when the response has none", func() {
+				h = instrumented_handler.InstrumentedHandler(fakeHandler{}, fakeEmitter, factories.WithContentEncoding())
+				req.Header.Set("Accept-Encoding", "gzip")
+				h.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(fakeEmitter.GetEnvelopes()[0].GetTags()).To(Equal(map[string]string{"accept_encoding": "gzip"}))
+			})
+		})
+
+		Context("with a handler name provider", func() {
+			var handlerName string
+
+			BeforeEach(func() {
+				handlerName = "HomeController#index"
+				nameFor := func(*http.Request) string { return handlerName }
+				h = instrumented_handler.InstrumentedHandler(fakeHandler{}, fakeEmitter, factories.WithHandlerName(nameFor))
+			})
+
+			It("tags the envelope with the handler name", func() {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(fakeEmitter.GetMessages()).To(BeEmpty())
+				envelopes := fakeEmitter.GetEnvelopes()
+				Expect(envelopes).To(HaveLen(1))
+				Expect(envelopes[0].GetOrigin()).To(Equal(origin))
+				Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_HttpStartStop))
+				Expect(envelopes[0].GetTags()).To(Equal(map[string]string{"handler": "HomeController#index"}))
+
+				startStopEvent := envelopes[0].GetHttpStartStop()
+				Expect(startStopEvent.GetStatusCode()).To(BeNumerically("==", http.StatusAccepted))
+				Expect(startStopEvent.GetRequestId()).To(Equal(factories.NewUUID(requestId)))
+			})
+
+			It("emits an untagged event when the name is empty", func() {
+				handlerName = ""
+				h.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+				Expect(fakeEmitter.GetMessages()).To(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("queue time", func() {
+		BeforeEach(func() {
+			h = instrumented_handler.TimedInstrumentedHandler(fakeHandler{}, fakeEmitter)
+		})
+
+		var queueTimes = func() []*events.ValueMetric {
+			var metrics []*events.ValueMetric
+			for _, event := range fakeEmitter.GetEvents() {
+				if metric, ok := event.(*events.ValueMetric); ok && metric.GetName() == "requestQueueTime" {
+					metrics = append(metrics, metric)
+				}
+			}
+			return metrics
+		}
+
+		var serveQueuedFor = func(header string, queued time.Duration) float64 {
+			req.Header.Set("X-Request-Start", header)
+			start := time.Now()
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			elapsed := time.Since(start)
+
+			Expect(queueTimes()).To(HaveLen(1))
+			metric := queueTimes()[0]
+			Expect(metric.GetUnit()).To(Equal("ms"))
+			Expect(metric.GetValue()).To(BeNumerically(">=", float64(queued/time.Millisecond)-1))
+			Expect(metric.GetValue()).To(BeNumerically("<=", float64((queued+elapsed)/time.Millisecond)+2))
+			return metric.GetValue()
+		}
+
+		It("emits the time since an X-Request-Start in epoch milliseconds", func() {
+			requestStart := time.Now().Add(-250 * time.Millisecond)
+			serveQueuedFor(strconv.FormatInt(requestStart.UnixNano()/int64(time.Millisecond), 10), 250*time.Millisecond)
+		})
+
+		It("accepts the t= format", func() {
+			requestStart := time.Now().Add(-250 * time.Millisecond)
+			serveQueuedFor("t="+strconv.FormatInt(requestStart.UnixNano()/int64(time.Millisecond), 10), 250*time.Millisecond)
+		})
+
+		It("accepts microseconds in Apache's t= format", func() {
+			requestStart := time.Now().Add(-250 * time.Millisecond)
+			serveQueuedFor("t="+strconv.FormatInt(requestStart.UnixNano()/int64(time.Microsecond), 10), 250*time.Millisecond)
+		})
+
+		It("accepts whole seconds", func() {
+			requestStart := time.Unix(time.Now().Add(-2*time.Second).Unix(), 0)
+			serveQueuedFor(strconv.FormatInt(requestStart.Unix(), 10), time.Since(requestStart))
+		})
+
+		It("accepts fractional seconds in the t= format", func() {
+			requestStart := time.Now().Add(-250 * time.Millisecond)
+			serveQueuedFor(fmt.Sprintf("t=%.3f", float64(requestStart.UnixNano())/float64(time.Second)), 250*time.Millisecond)
+		})
+
+		It("clamps queue times from a skewed clock to zero", func() {
+			requestStart := time.Now().Add(time.Minute)
+			req.Header.Set("X-Request-Start", strconv.FormatInt(requestStart.UnixNano()/int64(time.Millisecond), 10))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(queueTimes()).To(HaveLen(1))
+			Expect(queueTimes()[0].GetValue()).To(BeZero())
+		})
+
+		It("skips the metric for malformed headers", func() {
+			for _, header := range []string{"soon", "t=", "t=abc", "-5", "1.2.3"} {
+				req.Header.Set("X-Request-Start", header)
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			Expect(queueTimes()).To(BeEmpty())
+		})
+
+		It("skips the metric without the header", func() {
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(queueTimes()).To(BeEmpty())
+		})
+
+		It("is not emitted by a plain instrumented handler", func() {
+			h = instrumented_handler.InstrumentedHandler(fakeHandler{}, fakeEmitter)
+			req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(queueTimes()).To(BeEmpty())
+			Expect(fakeEmitter.GetMessages()).To(HaveLen(1))
+		})
+	})
+
+	Describe("handler and total time", func() {
+		var timings = func() map[string]float64 {
+			values := make(map[string]float64)
+			for _, event := range fakeEmitter.GetEvents() {
+				if metric, ok := event.(*events.ValueMetric); ok {
+					Expect(metric.GetUnit()).To(Equal("ms"))
+					values[metric.GetName()] = metric.GetValue()
+				}
+			}
+			return values
+		}
+
+		It("separates a fast handler from a slow-writing response", func() {
+			h = instrumented_handler.TimedInstrumentedHandler(fakeHandler{}, fakeEmitter)
+			h.ServeHTTP(&slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), delay: 50 * time.Millisecond}, req)
+
+			values := timings()
+			Expect(values).To(HaveLen(2))
+			Expect(values["requestTotalTime"]).To(BeNumerically(">=", 50))
+			Expect(values["requestHandlerTime"]).To(BeNumerically("<", 25))
+			Expect(fakeEmitter.GetMessages()).To(HaveLen(3))
+		})
+
+		It("includes the final flush to a slow client in the total time", func() {
+			rw := &slowReaderResponseWriter{ResponseRecorder: httptest.NewRecorder(), delay: 50 * time.Millisecond}
+			h = instrumented_handler.TimedInstrumentedHandler(fakeHandler{}, fakeEmitter)
+			h.ServeHTTP(rw, req)
+
+			values := timings()
+			Expect(rw.Flushed).To(BeTrue())
+			Expect(values["requestTotalTime"]).To(BeNumerically(">=", 50))
+			Expect(values["requestHandlerTime"]).To(BeNumerically("<", 25))
+		})
+
+		It("counts time spent flushing as writing", func() {
+			flushingHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.(http.Flusher).Flush()
+			})
+			h = instrumented_handler.TimedInstrumentedHandler(flushingHandler, fakeEmitter)
+			h.ServeHTTP(&slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), delay: 50 * time.Millisecond}, req)
+
+			values := timings()
+			Expect(values["requestTotalTime"]).To(BeNumerically(">=", 50))
+			Expect(values["requestHandlerTime"]).To(BeNumerically("<", 25))
+		})
+
+		It("reports matching times for a slow handler", func() {
+			slowHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+				rw.Write([]byte("done"))
+			})
+			h = instrumented_handler.TimedInstrumentedHandler(slowHandler, fakeEmitter)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			values := timings()
+			Expect(values["requestHandlerTime"]).To(BeNumerically(">=", 50))
+			Expect(values["requestHandlerTime"]).To(BeNumerically("~", values["requestTotalTime"], 5))
+		})
+
+		It("emits no timings from a plain instrumented handler", func() {
+			h.ServeHTTP(&slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), delay: time.Millisecond}, req)
+
+			Expect(timings()).To(BeEmpty())
+		})
+	})
+
+	Describe("streaming and hijacked responses", func() {
+		var startStopEvents = func() []*events.HttpStartStop {
+			var startStops []*events.HttpStartStop
+			for _, event := range fakeEmitter.GetEvents() {
+				if startStop, ok := event.(*events.HttpStartStop); ok {
+					startStops = append(startStops, startStop)
+				}
+			}
+			return startStops
+		}
+
+		var serve = func(handler http.HandlerFunc) {
+			h = instrumented_handler.InstrumentedHandler(handler, fakeEmitter)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			Expect(startStopEvents()).To(HaveLen(1))
+		}
+
+		It("records the first final status", func() {
+			serve(func(rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(103)
+				rw.WriteHeader(http.StatusCreated)
+				rw.WriteHeader(http.StatusInternalServerError)
+			})
+
+			Expect(startStopEvents()[0].GetStatusCode()).To(BeNumerically("==", http.StatusCreated))
+		})
+
+		It("records the implicit 200 of a response written before its header", func() {
+			serve(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Write([]byte("body"))
+				rw.WriteHeader(http.StatusInternalServerError)
+			})
+
+			Expect(startStopEvents()[0].GetStatusCode()).To(BeNumerically("==", http.StatusOK))
+		})
+
+		It("counts every byte of a flushed stream", func() {
+			serve(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/event-stream")
+				for i := 0; i < 3; i++ {
+					rw.Write([]byte("data: tick\n\n"))
+					rw.(http.Flusher).Flush()
+				}
+			})
+
+			Expect(startStopEvents()[0].GetContentLength()).To(BeNumerically("==", 3*len("data: tick\n\n")))
+		})
+
+		Context("with a hijacked connection", func() {
+			const upgradeResponse = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"
+
+			var (
+				server         *httptest.Server
+				closeConn      chan struct{}
+				closedConn     chan struct{}
+				returnHandler  chan struct{}
+				handlerReturns chan struct{}
+			)
+
+			BeforeEach(func() {
+				closeConn = make(chan struct{})
+				closedConn = make(chan struct{})
+				returnHandler = make(chan struct{})
+				handlerReturns = make(chan struct{})
+				closeConn, closedConn, returnHandler, handlerReturns := closeConn, closedConn, returnHandler, handlerReturns
+				upgrader := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					defer close(handlerReturns)
+
+					conn, brw, err := rw.(http.Hijacker).Hijack()
+					Expect(err).ToNot(HaveOccurred())
+					brw.WriteString(upgradeResponse[:20])
+					brw.Flush()
+					brw.WriteString(upgradeResponse[20:])
+					brw.WriteString("hello")
+					brw.Flush()
+
+					go func() {
+						defer GinkgoRecover()
+						<-closeConn
+						conn.Write([]byte("bye"))
+						conn.Close()
+						close(closedConn)
+					}()
+					<-returnHandler
+				})
+				server = httptest.NewServer(instrumented_handler.InstrumentedHandler(upgrader, fakeEmitter))
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			var upgrade = func() net.Conn {
+				conn, err := net.Dial("tcp", server.Listener.Addr().String())
+				Expect(err).ToNot(HaveOccurred())
+				_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"))
+				Expect(err).ToNot(HaveOccurred())
+				return conn
+			}
+
+			It("emits when the connection is closed before the handler returns", func() {
+				conn := upgrade()
+				defer conn.Close()
+
+				time.Sleep(50 * time.Millisecond)
+				Expect(startStopEvents()).To(BeEmpty())
+				close(closeConn)
+				Eventually(startStopEvents).Should(HaveLen(1))
+
+				startStop := startStopEvents()[0]
+				Expect(startStop.GetStatusCode()).To(BeNumerically("==", http.StatusSwitchingProtocols))
+				Expect(startStop.GetContentLength()).To(BeNumerically("==", len("hello")+len("bye")))
+				Expect(startStop.GetStopTimestamp() - startStop.GetStartTimestamp()).To(BeNumerically(">=", int64(50*time.Millisecond)))
+
+				close(returnHandler)
+				Eventually(handlerReturns).Should(BeClosed())
+				Consistently(startStopEvents, 50*time.Millisecond).Should(HaveLen(1))
+			})
+
+			It("emits when the connection is closed after the handler returns", func() {
+				conn := upgrade()
+				defer conn.Close()
+
+				close(returnHandler)
+				Eventually(handlerReturns).Should(BeClosed())
+				Consistently(startStopEvents, 50*time.Millisecond).Should(BeEmpty())
+
+				close(closeConn)
+				Eventually(closedConn).Should(BeClosed())
+				Eventually(startStopEvents).Should(HaveLen(1))
+				startStop := startStopEvents()[0]
+				Expect(startStop.GetStatusCode()).To(BeNumerically("==", http.StatusSwitchingProtocols))
+				Expect(startStop.GetContentLength()).To(BeNumerically("==", len("hello")+len("bye")))
+				Expect(startStop.GetStopTimestamp() - startStop.GetStartTimestamp()).To(BeNumerically(">=", int64(50*time.Millisecond)))
+			})
+		})
+
+		It("sends data buffered before the hijack", func() {
+			conn, client := net.Pipe()
+			defer client.Close()
+			buffered := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+			buffered.WriteString("pending")
+			rw := &bufferedHijackWriter{ResponseRecorder: httptest.NewRecorder(), conn: conn, brw: buffered}
+
+			received := make(chan string, 1)
+			go func() {
+				data := make([]byte, len("pendinglater"))
+				_, err := io.ReadFull(client, data)
+				if err == nil {
+					received <- string(data)
+				}
+			}()
+
+			h = instrumented_handler.InstrumentedHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				hijacked, brw, err := rw.(http.Hijacker).Hijack()
+				Expect(err).ToNot(HaveOccurred())
+				brw.WriteString("later")
+				brw.Flush()
+				hijacked.Close()
+			}), fakeEmitter)
+			h.ServeHTTP(rw, req)
+
+			Eventually(received).Should(Receive(Equal("pendinglater")))
+			Expect(startStopEvents()[0].GetContentLength()).To(BeNumerically("==", len("later")))
+		})
 	})
 
 	Describe("satisfaction of interfaces", func() {
@@ -176,8 +614,38 @@ var _ = Describe("InstrumentedHandler", func() {
 type fakeHandler struct{}
 
 func (fh fakeHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.WriteHeader(http.StatusAccepted)
 	rw.Write([]byte("Hello World!"))
-	rw.WriteHeader(123)
+}
+
+// slowResponseWriter is an http.ResponseWriter and http.Flusher for a client
+// that takes delay to accept each write or flush
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (rw *slowResponseWriter) Write(data []byte) (int, error) {
+	time.Sleep(rw.delay)
+	return rw.ResponseRecorder.Write(data)
+}
+
+func (rw *slowResponseWriter) Flush() {
+	time.Sleep(rw.delay)
+	rw.ResponseRecorder.Flush()
+}
+
+// slowReaderResponseWriter is an http.ResponseWriter and http.Flusher that
+// buffers writes at once, like net/http, but takes delay to flush them to a
+// slowly reading client
+type slowReaderResponseWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (rw *slowReaderResponseWriter) Flush() {
+	time.Sleep(rw.delay)
+	rw.ResponseRecorder.Flush()
 }
 
 // storageHelperHandler stores the ResponseWriter it is given during ServeHTTP
@@ -281,3 +749,24 @@ func (fakeAddr) Network() string {
 func (fakeAddr) String() string {
 	return ""
 }
+
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// bufferedHijackWriter is an http.Hijacker whose hijacked writer still holds
+// buffered data
+type bufferedHijackWriter struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+	brw  *bufio.ReadWriter
+}
+
+func (rw *bufferedHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rw.conn, rw.brw, nil
+}
@@ -0,0 +1,33 @@
+package log_sender
+
+// ContainerMetadata describes the Diego container a log message came from.
+// Empty fields are treated as unknown.
+type ContainerMetadata struct {
+	// CellID identifies the Diego cell running the container.
+	CellID string
+	// InstanceGUID identifies the container itself.
+	InstanceGUID string
+	// InstanceIndex is the app instance index of the container, as found
+	// in CF_INSTANCE_INDEX.
+	InstanceIndex string
+}
+
+// Apply stamps the metadata onto a log message: the instance index becomes
+// its source instance and is also recorded, together with the cell ID and
+// instance GUID, as the "instance_index", "cell_id" and "instance_guid" tags.
+// Unknown fields are skipped. Use the same metadata for every message from a
+// container so that they are all described alike:
+//
+//	metadata.Apply(sender.LogMessage(line, events.LogMessage_OUT).SetAppId(appID)).Send()
+func (m ContainerMetadata) Apply(chainer LogChainer) LogChainer {
+	if m.InstanceIndex != "" {
+		chainer = chainer.SetSourceInstance(m.InstanceIndex).SetTag("instance_index", m.InstanceIndex)
+	}
+	if m.CellID != "" {
+		chainer = chainer.SetTag("cell_id", m.CellID)
+	}
+	if m.InstanceGUID != "" {
+		chainer = chainer.SetTag("instance_guid", m.InstanceGUID)
+	}
+	return chainer
+}
@@ -0,0 +1,65 @@
+package log_sender_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/log_sender"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("ContainerMetadata", func() {
+	var (
+		emitter *fake.FakeEventEmitter
+		sender  *log_sender.LogSender
+	)
+
+	BeforeEach(func() {
+		metrics.Initialize(nil, newMockMetricBatcher())
+		emitter = fake.NewFakeEventEmitter("test-origin")
+		sender = log_sender.NewLogSender(emitter)
+	})
+
+	var sendWith = func(metadata log_sender.ContainerMetadata) *events.Envelope {
+		chainer := sender.LogMessage([]byte("hello"), events.LogMessage_OUT).
+			SetAppId("app-id").
+			SetSourceType("APP/PROC/WEB")
+		Expect(metadata.Apply(chainer).Send()).To(Succeed())
+
+		envelopes := emitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(1))
+		return envelopes[0]
+	}
+
+	It("stamps the source instance and tags from populated metadata", func() {
+		envelope := sendWith(log_sender.ContainerMetadata{
+			CellID:        "cell-z1-0",
+			InstanceGUID:  "2c7d4ba6-1d3f-4c2a-6a1b-0c55",
+			InstanceIndex: "3",
+		})
+
+		Expect(envelope.GetLogMessage().GetSourceInstance()).To(Equal("3"))
+		Expect(envelope.GetLogMessage().GetSourceType()).To(Equal("APP/PROC/WEB"))
+		Expect(envelope.GetTags()).To(Equal(map[string]string{
+			"cell_id":        "cell-z1-0",
+			"instance_guid":  "2c7d4ba6-1d3f-4c2a-6a1b-0c55",
+			"instance_index": "3",
+		}))
+	})
+
+	It("skips missing fields", func() {
+		envelope := sendWith(log_sender.ContainerMetadata{CellID: "cell-z1-0"})
+
+		Expect(envelope.GetLogMessage().GetSourceInstance()).To(BeEmpty())
+		Expect(envelope.GetTags()).To(Equal(map[string]string{"cell_id": "cell-z1-0"}))
+	})
+
+	It("leaves the message untouched for empty metadata", func() {
+		envelope := sendWith(log_sender.ContainerMetadata{})
+
+		Expect(envelope.GetLogMessage().GetAppId()).To(Equal("app-id"))
+		Expect(envelope.GetTags()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,94 @@
+package log_sender
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const defaultJournalSourceType = "JOURNAL"
+
+// A JournalEntry is a single record read from the systemd journal.
+type JournalEntry struct {
+	// Cursor identifies the position of the entry in the journal.
+	Cursor string
+	// RealtimeTimestamp is the time the entry was received by journald, in
+	// microseconds since the epoch.
+	RealtimeTimestamp uint64
+	// Fields holds journal fields such as MESSAGE, PRIORITY and
+	// SYSLOG_IDENTIFIER.
+	Fields map[string]string
+}
+
+// A JournalReader reads entries from the systemd journal. It is typically
+// backed by sd-journal (e.g. github.com/coreos/go-systemd/sdjournal).
+type JournalReader interface {
+	// SeekCursor positions the reader on the entry identified by cursor.
+	SeekCursor(cursor string) error
+	// Next returns the next entry, or io.EOF once there are none left.
+	Next() (*JournalEntry, error)
+}
+
+// SendJournal sends a log message for each entry read from reader until the
+// reader returns io.EOF. Entries with a PRIORITY of 3 (err) or more severe
+// are sent as std err, all others as std out. The source type is taken from
+// SYSLOG_IDENTIFIER, falling back to _SYSTEMD_UNIT, and the source instance
+// from _PID.
+//
+// If cursor is not empty, SendJournal resumes after the entry it identifies.
+// It returns the cursor of the last entry sent, which can be saved and passed
+// to a later call to continue without duplicating or losing entries. This is
+// true even when an error is returned.
+func (l *LogSender) SendJournal(appID string, reader JournalReader, cursor string) (string, error) {
+	if cursor != "" {
+		if err := reader.SeekCursor(cursor); err != nil {
+			return cursor, err
+		}
+	}
+
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return cursor, nil
+		}
+		if err != nil {
+			return cursor, err
+		}
+
+		if entry.Cursor == cursor {
+			// sd-journal yields the entry under the cursor first after a seek.
+			continue
+		}
+
+		if err := l.sendJournalEntry(appID, entry); err != nil {
+			return cursor, err
+		}
+		cursor = entry.Cursor
+	}
+}
+
+func (l *LogSender) sendJournalEntry(appID string, entry *JournalEntry) error {
+	messageType := events.LogMessage_OUT
+	if priority, err := strconv.Atoi(entry.Fields["PRIORITY"]); err == nil && priority <= 3 {
+		messageType = events.LogMessage_ERR
+	}
+
+	sourceType := entry.Fields["SYSLOG_IDENTIFIER"]
+	if sourceType == "" {
+		sourceType = entry.Fields["_SYSTEMD_UNIT"]
+	}
+	if sourceType == "" {
+		sourceType = defaultJournalSourceType
+	}
+
+	chainer := l.LogMessage([]byte(entry.Fields["MESSAGE"]), messageType).
+		SetAppId(appID).
+		SetSourceType(sourceType).
+		SetSourceInstance(entry.Fields["_PID"])
+	if entry.RealtimeTimestamp != 0 {
+		chainer = chainer.SetTimestamp(int64(entry.RealtimeTimestamp) * 1000)
+	}
+
+	return chainer.Send()
+}
@@ -0,0 +1,146 @@
+package log_sender_test
+
+import (
+	"errors"
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/log_sender"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("SendJournal", func() {
+	var (
+		emitter *fake.FakeEventEmitter
+		sender  *log_sender.LogSender
+		reader  *fakeJournalReader
+	)
+
+	BeforeEach(func() {
+		metrics.Initialize(nil, newMockMetricBatcher())
+		emitter = fake.NewFakeEventEmitter("test-origin")
+		sender = log_sender.NewLogSender(emitter)
+		reader = &fakeJournalReader{
+			entries: []*log_sender.JournalEntry{
+				{
+					Cursor:            "c1",
+					RealtimeTimestamp: 1500000000000000,
+					Fields: map[string]string{
+						"MESSAGE":           "started",
+						"PRIORITY":          "6",
+						"SYSLOG_IDENTIFIER": "rep",
+						"_PID":              "42",
+					},
+				},
+				{
+					Cursor: "c2",
+					Fields: map[string]string{
+						"MESSAGE":       "disk full",
+						"PRIORITY":      "3",
+						"_SYSTEMD_UNIT": "garden.service",
+					},
+				},
+				{
+					Cursor: "c3",
+					Fields: map[string]string{
+						"MESSAGE": "no metadata",
+					},
+				},
+			},
+		}
+	})
+
+	It("sends a log message for each journal entry", func() {
+		cursor, err := sender.SendJournal("app-id", reader, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cursor).To(Equal("c3"))
+
+		envelopes := emitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(3))
+
+		first := envelopes[0].GetLogMessage()
+		Expect(first.GetMessage()).To(Equal([]byte("started")))
+		Expect(first.GetAppId()).To(Equal("app-id"))
+		Expect(first.GetMessageType()).To(Equal(events.LogMessage_OUT))
+		Expect(first.GetSourceType()).To(Equal("rep"))
+		Expect(first.GetSourceInstance()).To(Equal("42"))
+		Expect(first.GetTimestamp()).To(Equal(int64(1500000000000000000)))
+
+		second := envelopes[1].GetLogMessage()
+		Expect(second.GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(second.GetSourceType()).To(Equal("garden.service"))
+		Expect(second.GetTimestamp()).ToNot(BeZero())
+
+		third := envelopes[2].GetLogMessage()
+		Expect(third.GetMessageType()).To(Equal(events.LogMessage_OUT))
+		Expect(third.GetSourceType()).To(Equal("JOURNAL"))
+	})
+
+	It("resumes after the saved cursor", func() {
+		cursor, err := sender.SendJournal("app-id", reader, "c1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cursor).To(Equal("c3"))
+
+		Expect(reader.seekedTo).To(Equal("c1"))
+		envelopes := emitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(2))
+		Expect(envelopes[0].GetLogMessage().GetMessage()).To(Equal([]byte("disk full")))
+		Expect(envelopes[1].GetLogMessage().GetMessage()).To(Equal([]byte("no metadata")))
+	})
+
+	It("returns the cursor of the last entry sent when emitting fails", func() {
+		emitter.ReturnError = errors.New("fake error")
+
+		cursor, err := sender.SendJournal("app-id", reader, "")
+		Expect(err).To(MatchError("fake error"))
+		Expect(cursor).To(BeEmpty())
+
+		reopened := &fakeJournalReader{entries: reader.entries}
+		cursor, err = sender.SendJournal("app-id", reopened, cursor)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cursor).To(Equal("c3"))
+		Expect(emitter.GetEnvelopes()).To(HaveLen(3))
+	})
+
+	It("returns read errors", func() {
+		reader.readErr = errors.New("journal rotated")
+
+		cursor, err := sender.SendJournal("app-id", reader, "c2")
+		Expect(err).To(MatchError("journal rotated"))
+		Expect(cursor).To(Equal("c2"))
+	})
+})
+
+type fakeJournalReader struct {
+	entries  []*log_sender.JournalEntry
+	seekedTo string
+	readErr  error
+	position int
+}
+
+func (r *fakeJournalReader) SeekCursor(cursor string) error {
+	r.seekedTo = cursor
+	for i, entry := range r.entries {
+		if entry.Cursor == cursor {
+			r.position = i
+			return nil
+		}
+	}
+	return errors.New("unknown cursor")
+}
+
+func (r *fakeJournalReader) Next() (*log_sender.JournalEntry, error) {
+	if r.readErr != nil {
+		return nil, r.readErr
+	}
+	if r.position >= len(r.entries) {
+		return nil, io.EOF
+	}
+	entry := r.entries[r.position]
+	r.position++
+	return entry, nil
+}
@@ -37,7 +37,9 @@ type LogChainer interface {
 
 // A LogSender emits log events.
 type LogSender struct {
-	eventEmitter EventEmitter
+	eventEmitter  EventEmitter
+	minSeverity   Severity
+	levelPrefixes map[string]Severity
 }
 
 // NewLogSender instantiates a LogSender with the given EventEmitter.
@@ -52,6 +54,9 @@ func NewLogSender(eventEmitter EventEmitter) *LogSender {
 // Returns an error if one occurs while sending the event.
 func (l *LogSender) SendAppLog(appID, message, sourceType, sourceInstance string) error {
 	metrics.BatchIncrementCounter("logSenderTotalMessagesRead")
+	if l.belowMinimumSeverity([]byte(message), events.LogMessage_OUT) {
+		return nil
+	}
 	return l.eventEmitter.Emit(makeLogMessage(appID, message, sourceType, sourceInstance, events.LogMessage_OUT))
 }
 
@@ -60,6 +65,9 @@ func (l *LogSender) SendAppLog(appID, message, sourceType, sourceInstance string
 // Returns an error if one occurs while sending the event.
 func (l *LogSender) SendAppErrorLog(appID, message, sourceType, sourceInstance string) error {
 	metrics.BatchIncrementCounter("logSenderTotalMessagesRead")
+	if l.belowMinimumSeverity([]byte(message), events.LogMessage_ERR) {
+		return nil
+	}
 	return l.eventEmitter.Emit(makeLogMessage(appID, message, sourceType, sourceInstance, events.LogMessage_ERR))
 }
 
@@ -79,6 +87,7 @@ func (l *LogSender) ScanErrorLogStream(appID, sourceType, sourceInstance string,
 // and then sent.
 func (l *LogSender) LogMessage(message []byte, msgType events.LogMessage_MessageType) LogChainer {
 	return logChainer{
+		sender:  l,
 		emitter: l.eventEmitter,
 		envelope: &events.Envelope{
 			Origin:    proto.String(l.eventEmitter.Origin()),
@@ -152,6 +161,7 @@ type envelopeEmitter interface {
 }
 
 type logChainer struct {
+	sender   *LogSender
 	emitter  envelopeEmitter
 	envelope *events.Envelope
 	err      error
@@ -204,6 +214,9 @@ func (c logChainer) Send() error {
 	}
 
 	metrics.BatchIncrementCounter("logSenderTotalMessagesRead")
+	if c.sender.belowMinimumSeverity(c.envelope.LogMessage.GetMessage(), c.envelope.LogMessage.GetMessageType()) {
+		return nil
+	}
 
 	c.envelope.Timestamp = proto.Int64(time.Now().UnixNano())
 
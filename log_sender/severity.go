@@ -0,0 +1,73 @@
+package log_sender
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Severity orders log messages for filtering by SetMinimumSeverity.
+type Severity int
+
+const (
+	SeverityDebug Severity = iota
+	SeverityInfo
+	SeverityWarn
+	SeverityError
+)
+
+// SetMinimumSeverity makes the LogSender drop, and count, every message that
+// is less severe than min. Std out messages have SeverityInfo and std err
+// messages SeverityError, unless SetLevelPrefixes is used. It must be called
+// before the LogSender is used.
+func (l *LogSender) SetMinimumSeverity(min Severity) {
+	l.minSeverity = min
+}
+
+// SetLevelPrefixes derives the severity of a message from a level at its
+// start, such as "DEBUG: connecting" or "[WARN] retrying". prefixes maps each
+// level, matched case-sensitively, to its severity. Messages without a known
+// level keep the severity of their message type. A nil map disables parsing,
+// which is the default. It must be called before the LogSender is used.
+func (l *LogSender) SetLevelPrefixes(prefixes map[string]Severity) {
+	l.levelPrefixes = prefixes
+}
+
+func (l *LogSender) belowMinimumSeverity(message []byte, messageType events.LogMessage_MessageType) bool {
+	if l.minSeverity == SeverityDebug {
+		return false
+	}
+
+	if l.severity(message, messageType) >= l.minSeverity {
+		return false
+	}
+
+	metrics.BatchIncrementCounter("logSenderTotalMessagesFiltered")
+	return true
+}
+
+func (l *LogSender) severity(message []byte, messageType events.LogMessage_MessageType) Severity {
+	if l.levelPrefixes != nil {
+		if severity, ok := l.levelPrefixes[leadingLevel(message)]; ok {
+			return severity
+		}
+	}
+
+	if messageType == events.LogMessage_ERR {
+		return SeverityError
+	}
+	return SeverityInfo
+}
+
+func leadingLevel(message []byte) string {
+	trimmed := strings.TrimLeft(string(message), " [")
+	end := strings.IndexFunc(trimmed, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if end < 0 {
+		return trimmed
+	}
+	return trimmed[:end]
+}
@@ -0,0 +1,85 @@
+package log_sender_test
+
+import (
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/log_sender"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("Severity filtering", func() {
+	var (
+		mockBatcher *mockMetricBatcher
+		emitter     *fake.FakeEventEmitter
+		sender      *log_sender.LogSender
+	)
+
+	BeforeEach(func() {
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+		emitter = fake.NewFakeEventEmitter("test-origin")
+		sender = log_sender.NewLogSender(emitter)
+	})
+
+	var sendMixedSeverities = func() {
+		Expect(sender.SendAppLog("app-id", "DEBUG: connecting", "APP", "0")).To(Succeed())
+		Expect(sender.SendAppLog("app-id", "[INFO] connected", "APP", "0")).To(Succeed())
+		Expect(sender.SendAppLog("app-id", "WARN slow response", "APP", "0")).To(Succeed())
+		Expect(sender.SendAppLog("app-id", "plain output", "APP", "0")).To(Succeed())
+		Expect(sender.SendAppErrorLog("app-id", "plain error", "APP", "0")).To(Succeed())
+		Expect(sender.LogMessage([]byte("DEBUG: chained"), events.LogMessage_OUT).Send()).To(Succeed())
+	}
+
+	It("sends every message by default", func() {
+		sendMixedSeverities()
+
+		Expect(getLogMessages(emitter.GetMessages())).To(HaveLen(5))
+		Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+	})
+
+	It("drops std out messages below an error threshold", func() {
+		sender.SetMinimumSeverity(log_sender.SeverityError)
+		sendMixedSeverities()
+
+		Expect(getLogMessages(emitter.GetMessages())).To(ConsistOf("plain error"))
+		Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("logSenderTotalMessagesFiltered"),
+		))
+	})
+
+	Context("with level prefixes", func() {
+		BeforeEach(func() {
+			sender.SetLevelPrefixes(map[string]log_sender.Severity{
+				"DEBUG": log_sender.SeverityDebug,
+				"INFO":  log_sender.SeverityInfo,
+				"WARN":  log_sender.SeverityWarn,
+			})
+		})
+
+		It("uses the level at the start of the message", func() {
+			sender.SetMinimumSeverity(log_sender.SeverityWarn)
+			sendMixedSeverities()
+
+			Expect(getLogMessages(emitter.GetMessages())).To(ConsistOf("WARN slow response", "plain error"))
+			Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		})
+
+		It("falls back to the message type without a known level", func() {
+			sender.SetMinimumSeverity(log_sender.SeverityInfo)
+			sendMixedSeverities()
+
+			Expect(getLogMessages(emitter.GetMessages())).To(ConsistOf(
+				"[INFO] connected",
+				"WARN slow response",
+				"plain output",
+				"plain error",
+			))
+			Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		})
+	})
+})
@@ -9,8 +9,10 @@ import (
 
 type FakeMetricSender struct {
 	counters         map[string]uint64
+	counterTags      map[string]map[string]string
 	values           map[string]Metric
 	containerMetrics map[string]ContainerMetric
+	summaries        map[string]Summary
 	events           []events.Event
 	sync.RWMutex
 }
@@ -18,6 +20,14 @@ type FakeMetricSender struct {
 type Metric struct {
 	Value float64
 	Unit  string
+	Tags  map[string]string
+}
+
+type Summary struct {
+	Count    uint64
+	Min, Max float64
+	Sum      float64
+	Unit     string
 }
 
 type ContainerMetric struct {
@@ -31,8 +41,10 @@ type ContainerMetric struct {
 func NewFakeMetricSender() *FakeMetricSender {
 	return &FakeMetricSender{
 		counters:         make(map[string]uint64),
+		counterTags:      make(map[string]map[string]string),
 		values:           make(map[string]Metric),
 		containerMetrics: make(map[string]ContainerMetric),
+		summaries:        make(map[string]Summary),
 	}
 }
 
@@ -83,6 +95,42 @@ func (fms *FakeMetricSender) SendContainerMetric(applicationId string, instanceI
 	return nil
 }
 
+func (fms *FakeMetricSender) SendSummary(name string, count uint64, min, max, sum float64, unit string) error {
+	fms.Lock()
+	defer fms.Unlock()
+	fms.summaries[name] = Summary{Count: count, Min: min, Max: max, Sum: sum, Unit: unit}
+
+	return nil
+}
+
+func (fms *FakeMetricSender) SendTaggedValue(name string, value float64, unit string, tags map[string]string) error {
+	fms.Lock()
+	defer fms.Unlock()
+	fms.values[name] = Metric{Value: value, Unit: unit, Tags: copyTags(tags)}
+
+	return nil
+}
+
+func (fms *FakeMetricSender) SendTaggedCounter(name string, delta uint64, tags map[string]string) error {
+	fms.Lock()
+	defer fms.Unlock()
+	fms.counters[name] = fms.counters[name] + delta
+	fms.counterTags[name] = copyTags(tags)
+
+	return nil
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
+}
+
 func (fms *FakeMetricSender) HasValue(name string) bool {
 	fms.RLock()
 	defer fms.RUnlock()
@@ -105,6 +153,13 @@ func (fms *FakeMetricSender) GetCounter(name string) uint64 {
 	return fms.counters[name]
 }
 
+func (fms *FakeMetricSender) GetCounterTags(name string) map[string]string {
+	fms.RLock()
+	defer fms.RUnlock()
+
+	return fms.counterTags[name]
+}
+
 func (fms *FakeMetricSender) GetContainerMetric(applicationId string) ContainerMetric {
 	fms.RLock()
 	defer fms.RUnlock()
@@ -112,13 +167,22 @@ func (fms *FakeMetricSender) GetContainerMetric(applicationId string) ContainerM
 	return fms.containerMetrics[applicationId]
 }
 
+func (fms *FakeMetricSender) GetSummary(name string) Summary {
+	fms.RLock()
+	defer fms.RUnlock()
+
+	return fms.summaries[name]
+}
+
 func (fms *FakeMetricSender) Reset() {
 	fms.Lock()
 	defer fms.Unlock()
 
 	fms.counters = make(map[string]uint64)
+	fms.counterTags = make(map[string]map[string]string)
 	fms.values = make(map[string]Metric)
 	fms.containerMetrics = make(map[string]ContainerMetric)
+	fms.summaries = make(map[string]Summary)
 }
 
 func (fms *FakeMetricSender) Value(string, float64, string) metric_sender.ValueChainer {
@@ -2,6 +2,8 @@ package metric_sender
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"time"
 	"unicode/utf8"
 
@@ -27,6 +29,7 @@ type ValueChainer interface {
 
 type ContainerMetricChainer interface {
 	SetTag(key, value string) ContainerMetricChainer
+	NormalizeCPU(cores float64) ContainerMetricChainer
 	Send() error
 }
 
@@ -72,6 +75,46 @@ func (ms *MetricSender) AddToCounter(name string, delta uint64) error {
 	return ms.eventEmitter.Emit(&events.CounterEvent{Name: &name, Delta: &delta})
 }
 
+// SendTaggedValue sends a value metric as SendValue does, with tags written
+// to the envelope. Tags are applied in key order, under the same limits as
+// ValueChainer.SetTag. With no tags it is identical to SendValue.
+func (ms *MetricSender) SendTaggedValue(name string, value float64, unit string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return ms.SendValue(name, value, unit)
+	}
+
+	chainer := ms.Value(name, value, unit)
+	for _, key := range sortedKeys(tags) {
+		chainer = chainer.SetTag(key, tags[key])
+	}
+	return chainer.Send()
+}
+
+// SendTaggedCounter sends an event to increment the named counter by delta,
+// as AddToCounter does, with tags written to the envelope. Tags are applied
+// in key order, under the same limits as CounterChainer.SetTag. With no tags
+// it is identical to AddToCounter.
+func (ms *MetricSender) SendTaggedCounter(name string, delta uint64, tags map[string]string) error {
+	if len(tags) == 0 {
+		return ms.AddToCounter(name, delta)
+	}
+
+	chainer := ms.Counter(name)
+	for _, key := range sortedKeys(tags) {
+		chainer = chainer.SetTag(key, tags[key])
+	}
+	return chainer.Add(delta)
+}
+
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // SendContainerMetric sends a metric that records resource usage of an app in a container.
 // The container is identified by the applicationId and the instanceIndex. The resource
 // metrics are CPU percentage, memory and disk usage in bytes. Returns an error if one occurs
@@ -80,6 +123,30 @@ func (ms *MetricSender) SendContainerMetric(applicationId string, instanceIndex
 	return ms.eventEmitter.Emit(&events.ContainerMetric{ApplicationId: &applicationId, InstanceIndex: &instanceIndex, CpuPercentage: &cpuPercentage, MemoryBytes: &memoryBytes, DiskBytes: &diskBytes})
 }
 
+// SendSummary sends a value metric summarising count samples observed over
+// a window. The value is the mean of the samples, and the count, min, max and
+// sum are attached as tags so that receivers can approximate the
+// distribution. Returns an error if count is zero or max is less than min.
+func (ms *MetricSender) SendSummary(name string, count uint64, min, max, sum float64, unit string) error {
+	if count == 0 {
+		return fmt.Errorf("Summary %s has a count of zero", name)
+	}
+	if max < min {
+		return fmt.Errorf("Summary %s has a max (%v) less than its min (%v)", name, max, min)
+	}
+
+	return ms.Value(name, sum/float64(count), unit).
+		SetTag("count", strconv.FormatUint(count, 10)).
+		SetTag("min", formatFloat(min)).
+		SetTag("max", formatFloat(max)).
+		SetTag("sum", formatFloat(sum)).
+		Send()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
 // Value creates a value metric that can be manipulated via cascading calls
 // and then sent.
 func (ms *MetricSender) Value(name string, value float64, unit string) ValueChainer {
@@ -187,6 +254,24 @@ func (c containerMetricChainer) SetTag(key, value string) ContainerMetricChainer
 	return c
 }
 
+// NormalizeCPU divides the CPU percentage by the number of cores allocated
+// to the container, so that 100 means the whole allocation is in use rather
+// than one core. The raw percentage is kept in the "raw_cpu_percentage" tag.
+// If cores is not positive the core count is unknown and the metric is left
+// unchanged.
+func (c containerMetricChainer) NormalizeCPU(cores float64) ContainerMetricChainer {
+	if c.err != nil || cores <= 0 {
+		return c
+	}
+
+	raw := c.envelope.ContainerMetric.GetCpuPercentage()
+	c.chainer = c.chainer.SetTag("raw_cpu_percentage", formatFloat(raw))
+	if c.err == nil {
+		c.envelope.ContainerMetric.CpuPercentage = proto.Float64(raw / cores)
+	}
+	return c
+}
+
 type counterChainer struct {
 	chainer
 }
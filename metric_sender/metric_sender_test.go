@@ -189,6 +189,41 @@ var _ = Describe("MetricSender", func() {
 			})
 		})
 
+		Context("NormalizeCPU", func() {
+			It("divides the CPU percentage by the core count and keeps the raw value", func() {
+				err := sender.ContainerMetric("test-app-id", 1234, 350, 2345, 3456).
+					NormalizeCPU(4).
+					Send()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+				envelope := emitter.GetEnvelopes()[0]
+				Expect(envelope.GetContainerMetric().GetCpuPercentage()).To(Equal(87.5))
+				Expect(envelope.GetTags()).To(HaveKeyWithValue("raw_cpu_percentage", "350"))
+			})
+
+			It("passes the raw value through when the core count is unknown", func() {
+				err := sender.ContainerMetric("test-app-id", 1234, 350, 2345, 3456).
+					NormalizeCPU(0).
+					Send()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+				envelope := emitter.GetEnvelopes()[0]
+				Expect(envelope.GetContainerMetric().GetCpuPercentage()).To(Equal(350.0))
+				Expect(envelope.GetTags()).ToNot(HaveKey("raw_cpu_percentage"))
+			})
+
+			It("preserves earlier tag errors", func() {
+				tooLong := strings.Repeat("x", 257)
+				err := sender.ContainerMetric("test-app-id", 1234, 350, 2345, 3456).
+					SetTag(tooLong, "bar").
+					NormalizeCPU(4).
+					Send()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		It("sets origin", func() {
 			err := sender.ContainerMetric("test-app-id", 1234, 1.2, 2345, 3456).
 				Send()
@@ -377,6 +412,150 @@ var _ = Describe("MetricSender", func() {
 		})
 	})
 
+	Describe("SendTaggedValue", func() {
+		It("writes the tags to the envelope", func() {
+			err := sender.SendTaggedValue("metric-name", 42, "answers", map[string]string{
+				"component": "router",
+				"zone":      "z1",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+			envelope := emitter.GetEnvelopes()[0]
+			Expect(envelope.GetOrigin()).To(Equal("test-origin"))
+			Expect(envelope.GetValueMetric().GetName()).To(Equal("metric-name"))
+			Expect(envelope.GetValueMetric().GetValue()).To(BeNumerically("==", 42))
+			Expect(envelope.GetValueMetric().GetUnit()).To(Equal("answers"))
+			Expect(envelope.GetTags()).To(Equal(map[string]string{
+				"component": "router",
+				"zone":      "z1",
+			}))
+		})
+
+		It("sends exactly what SendValue sends when there are no tags", func() {
+			for _, tags := range []map[string]string{nil, {}} {
+				emitter.Reset()
+				Expect(sender.SendTaggedValue("metric-name", 42, "answers", tags)).To(Succeed())
+				Expect(sender.SendValue("metric-name", 42, "answers")).To(Succeed())
+
+				messages := emitter.GetMessages()
+				Expect(messages).To(HaveLen(2))
+				Expect(messages[0]).To(Equal(messages[1]))
+				Expect(emitter.GetEnvelopes()).To(BeEmpty())
+			}
+		})
+
+		It("does not let tags named after event fields change them", func() {
+			err := sender.SendTaggedValue("metric-name", 42, "answers", map[string]string{
+				"name":   "other",
+				"origin": "other",
+				"unit":   "other",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			envelope := emitter.GetEnvelopes()[0]
+			Expect(envelope.GetOrigin()).To(Equal("test-origin"))
+			Expect(envelope.GetValueMetric().GetName()).To(Equal("metric-name"))
+			Expect(envelope.GetValueMetric().GetUnit()).To(Equal("answers"))
+			Expect(envelope.GetTags()).To(HaveKeyWithValue("name", "other"))
+		})
+
+		It("rejects tags over the limits", func() {
+			tooMany := make(map[string]string)
+			for i := 0; i < 11; i++ {
+				tooMany[fmt.Sprintf("key%d", i)] = "value"
+			}
+			Expect(sender.SendTaggedValue("metric-name", 42, "answers", tooMany)).ToNot(Succeed())
+			Expect(sender.SendTaggedValue("metric-name", 42, "answers", map[string]string{"key": strings.Repeat("x", 257)})).ToNot(Succeed())
+			Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		})
+
+		It("returns an error if it can't send the value metric", func() {
+			emitter.ReturnError = errors.New("some error")
+
+			err := sender.SendTaggedValue("metric-name", 42, "answers", map[string]string{"zone": "z1"})
+			Expect(err).To(MatchError("some error"))
+		})
+	})
+
+	Describe("SendTaggedCounter", func() {
+		It("writes the tags to the envelope", func() {
+			err := sender.SendTaggedCounter("counter-strike", 3, map[string]string{"component": "router"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+			envelope := emitter.GetEnvelopes()[0]
+			Expect(envelope.GetCounterEvent().GetName()).To(Equal("counter-strike"))
+			Expect(envelope.GetCounterEvent().GetDelta()).To(Equal(uint64(3)))
+			Expect(envelope.GetTags()).To(Equal(map[string]string{"component": "router"}))
+		})
+
+		It("sends exactly what AddToCounter sends when there are no tags", func() {
+			Expect(sender.SendTaggedCounter("counter-strike", 3, nil)).To(Succeed())
+			Expect(sender.AddToCounter("counter-strike", 3)).To(Succeed())
+
+			messages := emitter.GetMessages()
+			Expect(messages).To(HaveLen(2))
+			Expect(messages[0]).To(Equal(messages[1]))
+			Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		})
+
+		It("does not let tags named after event fields change them", func() {
+			err := sender.SendTaggedCounter("counter-strike", 3, map[string]string{"name": "other", "delta": "7"})
+			Expect(err).NotTo(HaveOccurred())
+
+			counter := emitter.GetEnvelopes()[0].GetCounterEvent()
+			Expect(counter.GetName()).To(Equal("counter-strike"))
+			Expect(counter.GetDelta()).To(Equal(uint64(3)))
+		})
+	})
+
+	Describe("SendSummary", func() {
+		It("sends the mean as a value metric with the aggregates as tags", func() {
+			err := sender.SendSummary("latency", 4, 1.5, 9, 18, "ms")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(emitter.GetEnvelopes()).To(HaveLen(1))
+			envelope := emitter.GetEnvelopes()[0]
+			metric := envelope.GetValueMetric()
+			Expect(metric.GetName()).To(Equal("latency"))
+			Expect(metric.GetValue()).To(Equal(4.5))
+			Expect(metric.GetUnit()).To(Equal("ms"))
+			Expect(envelope.GetTags()).To(Equal(map[string]string{
+				"count": "4",
+				"min":   "1.5",
+				"max":   "9",
+				"sum":   "18",
+			}))
+		})
+
+		It("accepts a single sample", func() {
+			err := sender.SendSummary("latency", 1, 3, 3, 3, "ms")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(emitter.GetEnvelopes()[0].GetValueMetric().GetValue()).To(Equal(3.0))
+		})
+
+		It("returns an error when the count is zero", func() {
+			err := sender.SendSummary("latency", 0, 1, 9, 18, "ms")
+			Expect(err).To(HaveOccurred())
+			Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		})
+
+		It("returns an error when max is less than min", func() {
+			err := sender.SendSummary("latency", 4, 9, 1, 18, "ms")
+			Expect(err).To(HaveOccurred())
+			Expect(emitter.GetEnvelopes()).To(BeEmpty())
+		})
+
+		It("returns an error if it can't send the summary", func() {
+			emitter.ReturnError = errors.New("some error")
+
+			err := sender.SendSummary("latency", 4, 1, 9, 18, "ms")
+			Expect(err).To(MatchError("some error"))
+		})
+	})
+
 	Describe("IncrementCounter", func() {
 		It("sends an update counter event to its emitter", func() {
 			err := sender.IncrementCounter("counter-strike")
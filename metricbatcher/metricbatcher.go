@@ -2,6 +2,7 @@
 package metricbatcher
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -12,12 +13,45 @@ import (
 
 type MetricSender interface {
 	Counter(name string) metric_sender.CounterChainer
+	Value(name string, value float64, unit string) metric_sender.ValueChainer
 }
 
+// RateMode controls whether a MetricBatcher reports per-second rates for the
+// counters it batches.
+type RateMode int
+
+const (
+	// NoRates emits only the batched CounterEvents. This is the default.
+	NoRates RateMode = iota
+	// RatesWithCounters emits a rate ValueMetric alongside each CounterEvent.
+	RatesWithCounters
+	// RatesOnly emits a rate ValueMetric instead of each CounterEvent.
+	RatesOnly
+)
+
+const (
+	rateSuffix     = ".rate"
+	rateUnit       = "/s"
+	cumulativeUnit = "count"
+	intervalUnit   = "count"
+	timerUnit      = "ms"
+	timerCountUnit = "count"
+)
+
 type batch struct {
 	name  string
 	tags  map[string]string
 	value uint64
+	total uint64
+}
+
+// flushMode is the emission configuration captured for a single flush.
+type flushMode struct {
+	rateMode         RateMode
+	cumulative       bool
+	deltaSuffix      string
+	cumulativeSuffix string
+	interval         map[string]struct{}
 }
 
 // MetricBatcher batches counter increment/add calls into periodic, aggregate events.
@@ -29,23 +63,26 @@ type MetricBatcher struct {
 	closed                         bool
 	closedChan                     chan struct{}
 	consistentlyEmittedMetricNames []string
+	mode                           flushMode
+	totals                         map[string]uint64
+	lastFlush                      time.Time
+	idleWindow                     time.Duration
+	idleTimer                      *time.Timer
+	timers                         map[string]*timerHistogram
 }
 
 // New instantiates a running MetricBatcher. Eventswill be emitted once per batchDuration. All
 // updates to a given counter name will be combined into a single event and sent to metricSender.
 func New(metricSender MetricSender, batchDuration time.Duration) *MetricBatcher {
-	mb := &MetricBatcher{
-		batchTicker:  time.NewTicker(batchDuration),
-		metricSender: metricSender,
-		closed:       false,
-		closedChan:   make(chan struct{}),
-	}
+	mb := newMetricBatcher(metricSender)
+	mb.batchTicker = time.NewTicker(batchDuration)
 
 	go func() {
 		for {
 			select {
 			case <-mb.batchTicker.C:
 				mb.flush(mb.resetAndReturnMetrics())
+				mb.flushTimers(mb.resetAndReturnTimers())
 			case <-mb.closedChan:
 				mb.batchTicker.Stop()
 				return
@@ -56,6 +93,24 @@ func New(metricSender MetricSender, batchDuration time.Duration) *MetricBatcher
 	return mb
 }
 
+// NewWithoutFlushing instantiates a MetricBatcher that never flushes on its
+// own, for callers that collect its counters with SnapshotAndReset on their
+// own schedule. Pending counters and timers are only sent to metricSender
+// when the batcher is closed, or after an idle window if SetIdleFlush is
+// used.
+func NewWithoutFlushing(metricSender MetricSender) *MetricBatcher {
+	return newMetricBatcher(metricSender)
+}
+
+func newMetricBatcher(metricSender MetricSender) *MetricBatcher {
+	return &MetricBatcher{
+		metricSender: metricSender,
+		closed:       false,
+		closedChan:   make(chan struct{}),
+		lastFlush:    time.Now(),
+	}
+}
+
 // BatchIncrementCounter increments the named counter by 1, but does not immediately send a
 // CounterEvent.
 func (mb *MetricBatcher) BatchIncrementCounter(name string) {
@@ -76,6 +131,8 @@ func (mb *MetricBatcher) BatchAddCounter(name string, delta uint64) {
 }
 
 func (mb *MetricBatcher) add(newBatch batch) {
+	mb.resetIdleTimer()
+
 	for i, batch := range mb.metrics {
 		if batch.name != newBatch.name {
 			continue
@@ -109,9 +166,83 @@ func (mb *MetricBatcher) BatchCounter(name string) BatchCounterChainer {
 	}
 }
 
-// Reset clears the MetricBatcher's internal state, so that no counters are tracked.
+// BatchTimer records a duration sample for the named timer, but does not
+// immediately send it. On each flush, every timer with samples is reported as
+// ValueMetrics summarizing the samples recorded since the previous flush: its
+// name with a ".count" suffix holds the number of samples, and the ".min",
+// ".max", ".mean", ".p95" and ".p99" suffixes hold those statistics in
+// milliseconds. Samples are counted in fixed exponential buckets rather than
+// kept, so memory does not grow with the number of samples; the count, min,
+// max and mean are exact, while the percentiles are accurate to within about
+// 9%.
+func (mb *MetricBatcher) BatchTimer(name string, duration time.Duration) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if mb.closed {
+		panic("Attempting to send metrics after closed")
+	}
+
+	mb.resetIdleTimer()
+
+	if mb.timers == nil {
+		mb.timers = make(map[string]*timerHistogram)
+	}
+	histogram, ok := mb.timers[name]
+	if !ok {
+		histogram = &timerHistogram{}
+		mb.timers[name] = histogram
+	}
+	histogram.record(duration)
+}
+
+// Reset clears the MetricBatcher's internal state, so that no counters or
+// timers are tracked.
 func (mb *MetricBatcher) Reset() {
 	mb.resetAndReturnMetrics()
+	mb.resetAndReturnTimers()
+}
+
+// CounterDelta is the pending delta of a single batched counter series, as
+// returned by SnapshotAndReset.
+type CounterDelta struct {
+	Name  string
+	Tags  map[string]string
+	Delta uint64
+}
+
+// SnapshotAndReset returns the pending delta of every batched counter and
+// clears them in a single step, so that callers can flush on their own
+// schedule without losing concurrent increments. Counters with the same name
+// but different tags are separate series and are returned separately, sorted
+// by name and then by tags. Counters registered with
+// AddConsistentlyEmittedMetrics are included even when their delta is zero.
+// Timers are not included, since their summaries have no single delta; they
+// are still reported by the batcher's own flushes. Batchers created with New
+// also keep flushing on their ticker, which sends and clears whatever has
+// accumulated since the last snapshot; use NewWithoutFlushing to leave
+// flushing entirely to the caller.
+func (mb *MetricBatcher) SnapshotAndReset() []CounterDelta {
+	metrics, _, _ := mb.resetAndReturnMetrics()
+
+	keys := make([]string, 0, len(metrics))
+	deltas := make(map[string]*CounterDelta, len(metrics))
+	for _, metric := range metrics {
+		key := seriesKey(metric)
+		if delta, ok := deltas[key]; ok {
+			delta.Delta += metric.value
+			continue
+		}
+		keys = append(keys, key)
+		deltas[key] = &CounterDelta{Name: metric.name, Tags: copyTags(metric.tags), Delta: metric.value}
+	}
+	sort.Strings(keys)
+
+	snapshot := make([]CounterDelta, 0, len(keys))
+	for _, key := range keys {
+		snapshot = append(snapshot, *deltas[key])
+	}
+	return snapshot
 }
 
 // Closes the metrics batcher. Using the batcher after closing, will cause a panic.
@@ -121,31 +252,208 @@ func (mb *MetricBatcher) Close() {
 
 	mb.closed = true
 	close(mb.closedChan)
+	if mb.idleTimer != nil {
+		mb.idleTimer.Stop()
+	}
 
 	mb.flush(mb.unsafeResetAndReturnMetrics())
+	mb.flushTimers(mb.unsafeResetAndReturnTimers())
+}
+
+// SetRateMode configures whether each flush also reports, for every batched
+// counter, a ValueMetric named after the counter with a ".rate" suffix. Its
+// value is the counter's delta divided by the time actually elapsed since
+// the previous flush, in units per second.
+func (mb *MetricBatcher) SetRateMode(mode RateMode) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	mb.mode.rateMode = mode
+}
+
+// AddIntervalCounters registers the named counters as reset-on-emit. Instead
+// of a CounterEvent, each flush reports such a counter as a ValueMetric, in
+// units of "count", holding only the updates made since the previous flush;
+// its value then resets to zero. Zero is reported for intervals without
+// updates. Interval counters are not affected by SetRateMode or
+// SetCumulativeMode, so they can be used alongside ordinary counters.
+func (mb *MetricBatcher) AddIntervalCounters(names ...string) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	interval := make(map[string]struct{}, len(mb.mode.interval)+len(names))
+	for name := range mb.mode.interval {
+		interval[name] = struct{}{}
+	}
+	for _, name := range names {
+		if _, ok := interval[name]; !ok {
+			mb.consistentlyEmittedMetricNames = append(mb.consistentlyEmittedMetricNames, name)
+		}
+		interval[name] = struct{}{}
+	}
+	mb.mode.interval = interval
+}
+
+// SetCumulativeMode configures each flush to report every batched counter
+// twice: its delta as a CounterEvent named with deltaSuffix, and its running
+// total since the batcher was created as a ValueMetric named with
+// cumulativeSuffix. The suffixes should differ so that consumers can tell the
+// two apart.
+func (mb *MetricBatcher) SetCumulativeMode(deltaSuffix, cumulativeSuffix string) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	mb.mode.cumulative = true
+	mb.mode.deltaSuffix = deltaSuffix
+	mb.mode.cumulativeSuffix = cumulativeSuffix
+	if mb.totals == nil {
+		mb.totals = make(map[string]uint64)
+	}
+}
+
+// SetIdleFlush configures the batcher to flush as soon as no counter or timer
+// has been updated for the given window, instead of waiting for the next batch
+// interval. This bounds the latency of rare updates during quiet periods,
+// while bursts of updates are still combined. The window should be shorter
+// than the batch interval; a window of zero or less disables idle flushes,
+// which is the default.
+func (mb *MetricBatcher) SetIdleFlush(window time.Duration) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	mb.idleWindow = window
+	if window <= 0 && mb.idleTimer != nil {
+		mb.idleTimer.Stop()
+		mb.idleTimer = nil
+	}
+}
+
+// resetIdleTimer restarts the idle window. It must be called with the lock
+// held.
+func (mb *MetricBatcher) resetIdleTimer() {
+	if mb.idleWindow <= 0 {
+		return
+	}
+	if mb.idleTimer == nil {
+		mb.idleTimer = time.AfterFunc(mb.idleWindow, mb.idleFlush)
+		return
+	}
+	mb.idleTimer.Reset(mb.idleWindow)
+}
+
+func (mb *MetricBatcher) idleFlush() {
+	mb.lock.Lock()
+	if mb.closed {
+		mb.lock.Unlock()
+		return
+	}
+	metrics, elapsed, mode := mb.unsafeResetAndReturnMetrics()
+	timers := mb.unsafeResetAndReturnTimers()
+	mb.lock.Unlock()
+
+	mb.flush(metrics, elapsed, mode)
+	mb.flushTimers(timers)
 }
 
-func (mb *MetricBatcher) flush(metrics []batch) {
+func (mb *MetricBatcher) flush(metrics []batch, elapsed time.Duration, mode flushMode) {
 	for _, metric := range metrics {
-		counter := mb.metricSender.Counter(metric.name)
-		for k, v := range metric.tags {
-			counter.SetTag(k, v)
+		if _, ok := mode.interval[metric.name]; ok {
+			value := mb.metricSender.Value(metric.name, float64(metric.value), intervalUnit)
+			for k, v := range metric.tags {
+				value.SetTag(k, v)
+			}
+			value.Send()
+			continue
+		}
+
+		if mode.rateMode != RatesOnly {
+			counter := mb.metricSender.Counter(metric.name + mode.deltaSuffix)
+			for k, v := range metric.tags {
+				counter.SetTag(k, v)
+			}
+			counter.Add(metric.value)
+		}
+
+		if mode.cumulative {
+			total := mb.metricSender.Value(metric.name+mode.cumulativeSuffix, float64(metric.total), cumulativeUnit)
+			for k, v := range metric.tags {
+				total.SetTag(k, v)
+			}
+			total.Send()
+		}
+
+		if mode.rateMode != NoRates && elapsed > 0 {
+			rate := mb.metricSender.Value(metric.name+rateSuffix, float64(metric.value)/elapsed.Seconds(), rateUnit)
+			for k, v := range metric.tags {
+				rate.SetTag(k, v)
+			}
+			rate.Send()
 		}
-		counter.Add(metric.value)
 	}
 }
 
-func (mb *MetricBatcher) resetAndReturnMetrics() []batch {
+func (mb *MetricBatcher) flushTimers(timers map[string]*timerHistogram) {
+	names := make([]string, 0, len(timers))
+	for name := range timers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		histogram := timers[name]
+
+		mb.metricSender.Value(name+".count", float64(histogram.count), timerCountUnit).Send()
+		mb.sendTimerStat(name+".min", histogram.min)
+		mb.sendTimerStat(name+".max", histogram.max)
+		mb.sendTimerStat(name+".mean", histogram.sum/time.Duration(histogram.count))
+		mb.sendTimerStat(name+".p95", histogram.percentile(0.95))
+		mb.sendTimerStat(name+".p99", histogram.percentile(0.99))
+	}
+}
+
+func (mb *MetricBatcher) sendTimerStat(name string, duration time.Duration) {
+	mb.metricSender.Value(name, float64(duration)/float64(time.Millisecond), timerUnit).Send()
+}
+
+func (mb *MetricBatcher) resetAndReturnTimers() map[string]*timerHistogram {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	return mb.unsafeResetAndReturnTimers()
+}
+
+func (mb *MetricBatcher) unsafeResetAndReturnTimers() map[string]*timerHistogram {
+	timers := mb.timers
+	mb.timers = nil
+	return timers
+}
+
+func (mb *MetricBatcher) resetAndReturnMetrics() ([]batch, time.Duration, flushMode) {
 	mb.lock.Lock()
 	defer mb.lock.Unlock()
 
 	return mb.unsafeResetAndReturnMetrics()
 }
 
-func (mb *MetricBatcher) unsafeResetAndReturnMetrics() []batch {
+func (mb *MetricBatcher) unsafeResetAndReturnMetrics() ([]batch, time.Duration, flushMode) {
+	now := time.Now()
+	elapsed := now.Sub(mb.lastFlush)
+	mb.lastFlush = now
+
 	localMetrics := mb.metrics
 	mb.metrics = make([]batch, 0, len(mb.metrics))
 
+	if mb.mode.cumulative {
+		for i, metric := range localMetrics {
+			if _, ok := mb.mode.interval[metric.name]; ok {
+				continue
+			}
+			key := seriesKey(metric)
+			mb.totals[key] += metric.value
+			localMetrics[i].total = mb.totals[key]
+		}
+	}
+
 	matched := make(map[string]struct{})
 
 	for _, previousMetric := range localMetrics {
@@ -170,7 +478,34 @@ func (mb *MetricBatcher) unsafeResetAndReturnMetrics() []batch {
 		}
 	}
 
-	return localMetrics
+	return localMetrics, elapsed, mb.mode
+}
+
+// seriesKey identifies a counter by its name and tags.
+func seriesKey(metric batch) string {
+	keys := make([]string, 0, len(metric.tags))
+	for k := range metric.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := metric.name
+	for _, k := range keys {
+		key += "\x00" + k + "=" + metric.tags[k]
+	}
+	return key
+}
+
+// copyTags returns a copy of tags, or nil if there are none.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
 }
 
 func (mb *MetricBatcher) AddConsistentlyEmittedMetrics(names ...string) {
@@ -1,6 +1,7 @@
 package metricbatcher_test
 
 import (
+	"sync"
 	"time"
 
 	. "github.com/apoydence/eachers"
@@ -16,6 +17,7 @@ var _ = Describe("MetricBatcher", func() {
 		mockMetricSender *mockMetricSender
 		metricBatcher    *metricbatcher.MetricBatcher
 		mockChainer      *mockCounterChainer
+		mockValue        *mockValueChainer
 	)
 
 	BeforeEach(func() {
@@ -23,6 +25,9 @@ var _ = Describe("MetricBatcher", func() {
 		mockChainer = newMockCounterChainer()
 		testhelpers.AlwaysReturn(mockMetricSender.CounterOutput, mockChainer)
 		testhelpers.AlwaysReturn(mockChainer.SetTagOutput, mockChainer)
+		mockValue = newMockValueChainer()
+		testhelpers.AlwaysReturn(mockMetricSender.ValueOutput, mockValue)
+		testhelpers.AlwaysReturn(mockValue.SetTagOutput, mockValue)
 
 		metricBatcher = metricbatcher.New(mockMetricSender, 50*time.Millisecond)
 	})
@@ -219,6 +224,250 @@ var _ = Describe("MetricBatcher", func() {
 		})
 	})
 
+	Describe("SetRateMode", func() {
+		var start time.Time
+
+		BeforeEach(func() {
+			close(mockChainer.AddOutput.Ret0)
+			close(mockValue.SendOutput.Ret0)
+
+			start = time.Now()
+			metricBatcher = metricbatcher.New(mockMetricSender, 50*time.Millisecond)
+		})
+
+		It("emits no rates by default", func() {
+			metricBatcher.BatchAddCounter("count", 3)
+
+			Eventually(mockChainer.AddInput).Should(BeCalled(With(uint64(3))))
+			Consistently(mockMetricSender.ValueCalled).ShouldNot(Receive())
+		})
+
+		It("emits the delta divided by the elapsed interval alongside the counter", func() {
+			metricBatcher.SetRateMode(metricbatcher.RatesWithCounters)
+			metricBatcher.BatchCounter("count").SetTag("foo", "bar").Add(3)
+
+			Eventually(mockChainer.AddInput).Should(BeCalled(With(uint64(3))))
+			Eventually(mockMetricSender.ValueInput.Name).Should(Receive(Equal("count.rate")))
+			Expect(mockMetricSender.ValueInput.Unit).To(Receive(Equal("/s")))
+
+			var rate float64
+			Expect(mockMetricSender.ValueInput.Value).To(Receive(&rate))
+			elapsed := time.Since(start)
+			Expect(rate).To(BeNumerically("<=", 3/(50*time.Millisecond).Seconds()))
+			Expect(rate).To(BeNumerically(">=", 3/elapsed.Seconds()))
+
+			Eventually(mockValue.SetTagInput).Should(BeCalled(With("foo", "bar")))
+		})
+
+		It("emits only the rate when configured to replace counters", func() {
+			metricBatcher.SetRateMode(metricbatcher.RatesOnly)
+			metricBatcher.BatchAddCounter("count", 3)
+
+			Eventually(mockMetricSender.ValueInput.Name).Should(Receive(Equal("count.rate")))
+			Expect(mockMetricSender.CounterCalled).ToNot(Receive())
+		})
+	})
+
+	Describe("SetCumulativeMode", func() {
+		BeforeEach(func() {
+			close(mockChainer.AddOutput.Ret0)
+			close(mockValue.SendOutput.Ret0)
+
+			metricBatcher = metricbatcher.New(mockMetricSender, 50*time.Millisecond)
+			metricBatcher.SetCumulativeMode(".delta", ".total")
+		})
+
+		It("emits the delta and the running total on each flush", func() {
+			metricBatcher.BatchAddCounter("count", 3)
+
+			Eventually(mockMetricSender.CounterInput).Should(BeCalled(With("count.delta")))
+			Expect(mockChainer.AddInput).To(BeCalled(With(uint64(3))))
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("count.total", float64(3), "count")))
+
+			metricBatcher.BatchAddCounter("count", 2)
+
+			Eventually(mockMetricSender.CounterInput).Should(BeCalled(With("count.delta")))
+			Expect(mockChainer.AddInput).To(BeCalled(With(uint64(2))))
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("count.total", float64(5), "count")))
+		})
+
+		It("keeps separate totals for counters with different tags", func() {
+			metricBatcher.BatchCounter("count").SetTag("foo", "bar").Add(3)
+			metricBatcher.BatchCounter("count").SetTag("foo", "baz").Add(4)
+			Eventually(mockMetricSender.ValueInput.Value).Should(Receive())
+			Eventually(mockMetricSender.ValueInput.Value).Should(Receive())
+
+			metricBatcher.BatchCounter("count").SetTag("foo", "baz").Add(1)
+
+			Eventually(mockMetricSender.ValueInput.Value).Should(Receive(Equal(float64(5))))
+			Eventually(mockValue.SetTagInput).Should(BeCalled(With("foo", "baz")))
+		})
+	})
+
+	Describe("AddIntervalCounters", func() {
+		BeforeEach(func() {
+			close(mockChainer.AddOutput.Ret0)
+			close(mockValue.SendOutput.Ret0)
+
+			metricBatcher = metricbatcher.New(mockMetricSender, 50*time.Millisecond)
+			metricBatcher.AddIntervalCounters("interval")
+		})
+
+		It("emits the count since the previous flush and then resets it", func() {
+			metricBatcher.BatchAddCounter("interval", 3)
+			metricBatcher.BatchAddCounter("count", 3)
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("interval", float64(3), "count")))
+			Eventually(mockChainer.AddInput).Should(BeCalled(With(uint64(3))))
+
+			metricBatcher.BatchAddCounter("interval", 1)
+			metricBatcher.BatchAddCounter("count", 2)
+			metricBatcher.BatchIncrementCounter("interval")
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("interval", float64(2), "count")))
+			Eventually(mockChainer.AddInput).Should(BeCalled(With(uint64(2))))
+			Expect(mockMetricSender.CounterInput).ToNot(BeCalled(With("interval")))
+		})
+
+		It("emits zero for intervals without updates", func() {
+			metricBatcher.BatchAddCounter("interval", 3)
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("interval", float64(3), "count")))
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("interval", float64(0), "count")))
+		})
+
+		It("coexists with cumulative counters", func() {
+			metricBatcher.SetCumulativeMode("", ".total")
+			metricBatcher.BatchAddCounter("interval", 3)
+			metricBatcher.BatchAddCounter("count", 3)
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("interval", float64(3), "count")))
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("count.total", float64(3), "count")))
+
+			metricBatcher.BatchAddCounter("interval", 2)
+			metricBatcher.BatchAddCounter("count", 2)
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("interval", float64(2), "count")))
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("count.total", float64(5), "count")))
+		})
+	})
+
+	Describe("SetIdleFlush", func() {
+		BeforeEach(func() {
+			close(mockChainer.AddOutput.Ret0)
+
+			// Sets ticker to a longer time so that only idle flushes are observed
+			metricBatcher = metricbatcher.New(mockMetricSender, 5*time.Second)
+			metricBatcher.SetIdleFlush(50 * time.Millisecond)
+		})
+
+		AfterEach(func() {
+			metricBatcher.Close()
+		})
+
+		It("flushes a lone counter after the idle window rather than the batch interval", func() {
+			start := time.Now()
+			metricBatcher.BatchIncrementCounter("count")
+
+			Eventually(mockMetricSender.CounterInput).Should(BeCalled(With("count")))
+			Expect(mockChainer.AddInput).To(BeCalled(With(uint64(1))))
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+
+		It("waits for updates to stop before flushing", func() {
+			for i := 0; i < 10; i++ {
+				metricBatcher.BatchCounter("count").Increment()
+				time.Sleep(10 * time.Millisecond)
+			}
+			Expect(mockMetricSender.CounterCalled).ToNot(Receive())
+
+			Eventually(mockChainer.AddInput).Should(BeCalled(With(uint64(10))))
+		})
+
+		It("flushes timers after the idle window", func() {
+			close(mockValue.SendOutput.Ret0)
+			metricBatcher.BatchTimer("latency", time.Millisecond)
+
+			Eventually(mockMetricSender.ValueInput, time.Second).Should(BeCalled(With("latency.count", float64(1), "count")))
+		})
+	})
+
+	Describe("BatchTimer", func() {
+		BeforeEach(func() {
+			close(mockValue.SendOutput.Ret0)
+		})
+
+		It("emits summary statistics of the durations recorded over the interval", func() {
+			for i := 100; i >= 1; i-- {
+				metricBatcher.BatchTimer("latency", time.Duration(i)*time.Millisecond)
+			}
+			Expect(mockMetricSender.ValueInput).ToNot(BeCalled())
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(
+				With("latency.count", float64(100), "count"),
+				With("latency.min", float64(1), "ms"),
+				With("latency.max", float64(100), "ms"),
+				With("latency.mean", 50.5, "ms"),
+				With("latency.p95", BeNumerically("~", 95, 95*0.09), "ms"),
+				With("latency.p99", BeNumerically("~", 99, 99*0.09), "ms"),
+			))
+		})
+
+		It("clamps percentiles to the recorded range", func() {
+			for i := 0; i < 10; i++ {
+				metricBatcher.BatchTimer("latency", 3*time.Millisecond)
+			}
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(
+				With("latency.count", float64(10), "count"),
+				With("latency.min", float64(3), "ms"),
+				With("latency.max", float64(3), "ms"),
+				With("latency.mean", float64(3), "ms"),
+				With("latency.p95", float64(3), "ms"),
+				With("latency.p99", float64(3), "ms"),
+			))
+		})
+
+		It("summarizes each timer separately", func() {
+			metricBatcher.BatchTimer("fast", time.Millisecond)
+			metricBatcher.BatchTimer("slow", time.Second)
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("fast.max", float64(1), "ms")))
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("slow.max", float64(1000), "ms")))
+		})
+
+		It("is safe for concurrent use", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						metricBatcher.BatchTimer("latency", time.Millisecond)
+					}
+				}()
+			}
+			wg.Wait()
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("latency.count", float64(100), "count")))
+		})
+
+		It("emits recorded durations on Close", func() {
+			metricBatcher = metricbatcher.New(mockMetricSender, 5*time.Second)
+			metricBatcher.BatchTimer("latency", 2*time.Millisecond)
+			metricBatcher.Close()
+
+			Eventually(mockMetricSender.ValueInput).Should(BeCalled(With("latency.mean", float64(2), "ms")))
+		})
+
+		It("is cleared by Reset", func() {
+			metricBatcher.BatchTimer("latency", time.Millisecond)
+			metricBatcher.Reset()
+
+			Consistently(mockMetricSender.ValueInput).ShouldNot(BeCalled())
+		})
+	})
+
 	Describe("Reset", func() {
 		It("cancels any scheduled counter emission", func() {
 			metricBatcher.BatchAddCounter("count1", 2)
@@ -230,6 +479,88 @@ var _ = Describe("MetricBatcher", func() {
 		})
 	})
 
+	Describe("SnapshotAndReset", func() {
+		BeforeEach(func() {
+			metricBatcher = metricbatcher.NewWithoutFlushing(mockMetricSender)
+		})
+
+		It("returns the pending counters and clears them", func() {
+			metricBatcher.BatchAddCounter("count1", 2)
+			metricBatcher.BatchIncrementCounter("count1")
+			metricBatcher.BatchCounter("count2").SetTag("foo", "bar").Add(4)
+			metricBatcher.BatchCounter("count2").SetTag("foo", "baz").Add(5)
+
+			Expect(metricBatcher.SnapshotAndReset()).To(Equal([]metricbatcher.CounterDelta{
+				{Name: "count1", Delta: 3},
+				{Name: "count2", Tags: map[string]string{"foo": "bar"}, Delta: 4},
+				{Name: "count2", Tags: map[string]string{"foo": "baz"}, Delta: 5},
+			}))
+			Expect(metricBatcher.SnapshotAndReset()).To(BeEmpty())
+			Consistently(mockChainer.AddInput).ShouldNot(BeCalled())
+		})
+
+		It("includes consistently emitted metrics", func() {
+			metricBatcher.AddConsistentlyEmittedMetrics("always")
+			metricBatcher.BatchIncrementCounter("count1")
+
+			Expect(metricBatcher.SnapshotAndReset()).To(Equal([]metricbatcher.CounterDelta{
+				{Name: "count1", Delta: 1},
+			}))
+			Expect(metricBatcher.SnapshotAndReset()).To(Equal([]metricbatcher.CounterDelta{
+				{Name: "always", Delta: 0},
+			}))
+		})
+
+		It("never flushes on its own when created without flushing", func() {
+			metricBatcher.BatchIncrementCounter("count1")
+			metricBatcher.BatchTimer("timer", time.Millisecond)
+
+			Consistently(mockMetricSender.CounterInput, 100*time.Millisecond).ShouldNot(BeCalled())
+			Expect(mockMetricSender.ValueInput).ToNot(BeCalled())
+			Expect(metricBatcher.SnapshotAndReset()).To(Equal([]metricbatcher.CounterDelta{
+				{Name: "count1", Delta: 1},
+			}))
+		})
+
+		It("does not lose increments made while snapshotting", func() {
+			const (
+				writers    = 8
+				increments = 5000
+			)
+
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < increments; j++ {
+						metricBatcher.BatchIncrementCounter("count")
+					}
+				}()
+			}
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			var total uint64
+			for finished := false; !finished; {
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+				for _, delta := range metricBatcher.SnapshotAndReset() {
+					total += delta.Delta
+				}
+			}
+
+			Expect(total).To(BeEquivalentTo(writers * increments))
+		})
+	})
+
 	Describe("Close", func() {
 		BeforeEach(func() {
 			// Sets ticker to a longer time so that the Flush isn't called automatically from the go routine
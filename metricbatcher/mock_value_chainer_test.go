@@ -0,0 +1,38 @@
+package metricbatcher_test
+
+import "github.com/cloudfoundry/dropsonde/metric_sender"
+
+type mockValueChainer struct {
+	SetTagCalled chan bool
+	SetTagInput  struct {
+		Key, Value chan string
+	}
+	SetTagOutput struct {
+		Ret0 chan metric_sender.ValueChainer
+	}
+	SendCalled chan bool
+	SendOutput struct {
+		Ret0 chan error
+	}
+}
+
+func newMockValueChainer() *mockValueChainer {
+	m := &mockValueChainer{}
+	m.SetTagCalled = make(chan bool, 100)
+	m.SetTagInput.Key = make(chan string, 100)
+	m.SetTagInput.Value = make(chan string, 100)
+	m.SetTagOutput.Ret0 = make(chan metric_sender.ValueChainer, 100)
+	m.SendCalled = make(chan bool, 100)
+	m.SendOutput.Ret0 = make(chan error, 100)
+	return m
+}
+func (m *mockValueChainer) SetTag(key, value string) metric_sender.ValueChainer {
+	m.SetTagCalled <- true
+	m.SetTagInput.Key <- key
+	m.SetTagInput.Value <- value
+	return <-m.SetTagOutput.Ret0
+}
+func (m *mockValueChainer) Send() error {
+	m.SendCalled <- true
+	return <-m.SendOutput.Ret0
+}
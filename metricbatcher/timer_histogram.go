@@ -0,0 +1,79 @@
+package metricbatcher
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Bucket upper bounds grow by a factor of 2^(1/8), about 9%, from one
+	// microsecond, so that 256 buckets reach roughly an hour.
+	timerBucketBase       = time.Microsecond
+	timerBucketsPerDouble = 8
+	timerBucketCount      = 256
+)
+
+// timerHistogram summarizes the samples of a timer in a fixed amount of
+// memory.
+type timerHistogram struct {
+	count   uint64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+	buckets [timerBucketCount]uint64
+}
+
+func (h *timerHistogram) record(duration time.Duration) {
+	if h.count == 0 || duration < h.min {
+		h.min = duration
+	}
+	if h.count == 0 || duration > h.max {
+		h.max = duration
+	}
+	h.count++
+	h.sum += duration
+	h.buckets[timerBucket(duration)]++
+}
+
+// percentile returns the upper bound of the bucket holding the nearest-rank
+// percentile p, clamped to the recorded min and max.
+func (h *timerHistogram) percentile(p float64) time.Duration {
+	rank := uint64(math.Ceil(p * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range h.buckets {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		bound := timerBucketBound(i)
+		if bound > h.max {
+			bound = h.max
+		}
+		if bound < h.min {
+			bound = h.min
+		}
+		return bound
+	}
+	return h.max
+}
+
+// timerBucket returns the index of the first bucket whose upper bound is at
+// least duration. Durations beyond the last bound fall in the last bucket.
+func timerBucket(duration time.Duration) int {
+	if duration <= timerBucketBase {
+		return 0
+	}
+	index := int(math.Ceil(math.Log2(float64(duration)/float64(timerBucketBase)) * timerBucketsPerDouble))
+	if index >= timerBucketCount {
+		return timerBucketCount - 1
+	}
+	return index
+}
+
+func timerBucketBound(index int) time.Duration {
+	return time.Duration(float64(timerBucketBase) * math.Pow(2, float64(index)/timerBucketsPerDouble))
+}
@@ -20,6 +20,9 @@
 package metrics
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/cloudfoundry/dropsonde/metric_sender"
 	"github.com/cloudfoundry/sonde-go/events"
 )
@@ -46,6 +49,19 @@ type MetricSender interface {
 	SendContainerMetric(applicationId string, instanceIndex int32, cpuPercentage float64, memoryBytes uint64, diskBytes uint64) error
 }
 
+// SummarySender is implemented by MetricSenders that can send pre-aggregated
+// summaries, such as metric_sender.MetricSender.
+type SummarySender interface {
+	SendSummary(name string, count uint64, min, max, sum float64, unit string) error
+}
+
+// TaggedSender is implemented by MetricSenders that can attach envelope tags
+// to value and counter metrics, such as metric_sender.MetricSender.
+type TaggedSender interface {
+	SendTaggedValue(name string, value float64, unit string, tags map[string]string) error
+	SendTaggedCounter(name string, delta uint64, tags map[string]string) error
+}
+
 //go:generate hel --type MetricBatcher --output mock_metric_batcher_test.go
 
 type MetricBatcher interface {
@@ -54,6 +70,12 @@ type MetricBatcher interface {
 	Close()
 }
 
+// TimerBatcher is implemented by MetricBatchers that can aggregate timer
+// samples, such as metricbatcher.MetricBatcher.
+type TimerBatcher interface {
+	BatchTimer(name string, duration time.Duration)
+}
+
 // Initialize prepares the metrics package for use with the automatic Emitter.
 func Initialize(ms MetricSender, mb MetricBatcher) {
 	if metricBatcher != nil {
@@ -79,6 +101,26 @@ func SendValue(name string, value float64, unit string) error {
 	if metricSender == nil {
 		return nil
 	}
+	if suppressed, _ := throttled(name, nil, 0); suppressed {
+		return nil
+	}
+	return metricSender.SendValue(name, value, unit)
+}
+
+// SendTaggedValue sends a value event for the named metric with the given
+// envelope tags, so that the same metric sent from several components can be
+// told apart. With no tags, or when the MetricSender is not a TaggedSender,
+// it behaves as SendValue.
+func SendTaggedValue(name string, value float64, unit string, tags map[string]string) error {
+	if metricSender == nil {
+		return nil
+	}
+	if suppressed, _ := throttled(name, tags, 0); suppressed {
+		return nil
+	}
+	if taggedSender, ok := metricSender.(TaggedSender); ok {
+		return taggedSender.SendTaggedValue(name, value, unit, tags)
+	}
 	return metricSender.SendValue(name, value, unit)
 }
 
@@ -89,6 +131,13 @@ func IncrementCounter(name string) error {
 	if metricSender == nil {
 		return nil
 	}
+	suppressed, delta := throttled(name, nil, 1)
+	if suppressed {
+		return nil
+	}
+	if delta != 1 {
+		return metricSender.AddToCounter(name, delta)
+	}
 	return metricSender.IncrementCounter(name)
 }
 
@@ -109,6 +158,31 @@ func AddToCounter(name string, delta uint64) error {
 	if metricSender == nil {
 		return nil
 	}
+	suppressed, delta := throttled(name, nil, delta)
+	if suppressed {
+		return nil
+	}
+	return metricSender.AddToCounter(name, delta)
+}
+
+// SendTaggedCounter sends an event to increment the named counter by delta
+// with the given envelope tags. With no tags, or when the MetricSender is not a
+// TaggedSender, it behaves as AddToCounter.
+func SendTaggedCounter(name string, delta uint64, tags map[string]string) error {
+	if metricSender == nil {
+		return nil
+	}
+	suppressed, delta := throttled(name, tags, delta)
+	if suppressed {
+		return nil
+	}
+	return sendTaggedCounter(name, delta, tags)
+}
+
+func sendTaggedCounter(name string, delta uint64, tags map[string]string) error {
+	if taggedSender, ok := metricSender.(TaggedSender); ok {
+		return taggedSender.SendTaggedCounter(name, delta, tags)
+	}
 	return metricSender.AddToCounter(name, delta)
 }
 
@@ -122,6 +196,35 @@ func BatchAddCounter(name string, delta uint64) {
 	metricBatcher.BatchAddCounter(name, delta)
 }
 
+// SendTimer records duration as a sample of the named timer. When the batcher
+// is a TimerBatcher, the samples are aggregated and summary statistics are
+// sent once per batch interval instead of one value metric per sample;
+// otherwise the duration is sent at once as a value metric in milliseconds.
+func SendTimer(name string, duration time.Duration) {
+	if timerBatcher, ok := metricBatcher.(TimerBatcher); ok {
+		timerBatcher.BatchTimer(name, duration)
+		return
+	}
+	if metricSender == nil {
+		return
+	}
+	if suppressed, _ := throttled(name, nil, 0); suppressed {
+		return
+	}
+	metricSender.Value(name, float64(duration)/float64(time.Millisecond), "ms").Send()
+}
+
+// BatchTimer records duration as a sample of the named timer when the batcher
+// is a TimerBatcher, which sends summary statistics once per batch interval.
+// Unlike SendTimer it never sends a value metric per sample, so it is safe to
+// call for every envelope an emitter handles; the sample is discarded when
+// the batcher cannot aggregate timers.
+func BatchTimer(name string, duration time.Duration) {
+	if timerBatcher, ok := metricBatcher.(TimerBatcher); ok {
+		timerBatcher.BatchTimer(name, duration)
+	}
+}
+
 // SendContainerMetric sends a metric that records resource usage of an app in a container.
 // The container is identified by the applicationId and the instanceIndex. The resource
 // metrics are CPU percentage, memory and disk usage in bytes. Returns an error if one occurs
@@ -134,6 +237,29 @@ func SendContainerMetric(applicationId string, instanceIndex int32, cpuPercentag
 	return metricSender.SendContainerMetric(applicationId, instanceIndex, cpuPercentage, memoryBytes, diskBytes)
 }
 
+// SendSummary sends a pre-aggregated summary of count samples as a value
+// metric carrying their mean, with the count, min, max and sum as tags. When
+// the MetricSender is not a SummarySender, only the mean is sent, with
+// SendValue. Returns an error if count is zero or max is less than min.
+func SendSummary(name string, count uint64, min, max, sum float64, unit string) error {
+	if metricSender == nil {
+		return nil
+	}
+	if suppressed, _ := throttled(name, nil, 0); suppressed {
+		return nil
+	}
+	if summarySender, ok := metricSender.(SummarySender); ok {
+		return summarySender.SendSummary(name, count, min, max, sum, unit)
+	}
+	if count == 0 {
+		return fmt.Errorf("Summary %s has a count of zero", name)
+	}
+	if max < min {
+		return fmt.Errorf("Summary %s has a max (%v) less than its min (%v)", name, max, min)
+	}
+	return metricSender.SendValue(name, sum/float64(count), unit)
+}
+
 // Value creates a value metric that can be manipulated via cascading calls
 // and then sent.
 func Value(name string, value float64, unit string) metric_sender.ValueChainer {
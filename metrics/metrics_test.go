@@ -86,6 +86,57 @@ var _ = Describe("Metrics", func() {
 		)
 	})
 
+	It("delegates SendSummary", func() {
+		metricSender.SendSummaryOutput.Ret0 <- nil
+		metrics.SendSummary("latency", 4, 1, 9, 16, "ms")
+		Eventually(metricSender.SendSummaryInput).Should(
+			BeCalled(With("latency", uint64(4), 1.0, 9.0, 16.0, "ms")),
+		)
+	})
+
+	It("delegates SendTaggedValue", func() {
+		metricSender.SendTaggedValueOutput.Ret0 <- nil
+		tags := map[string]string{"component": "router"}
+		metrics.SendTaggedValue("metric", 42.42, "answers", tags)
+		Eventually(metricSender.SendTaggedValueInput).Should(BeCalled(With("metric", 42.42, "answers", tags)))
+	})
+
+	It("delegates SendTaggedCounter", func() {
+		metricSender.SendTaggedCounterOutput.Ret0 <- nil
+		tags := map[string]string{"component": "router"}
+		metrics.SendTaggedCounter("count", 5, tags)
+		Eventually(metricSender.SendTaggedCounterInput).Should(BeCalled(With("count", uint64(5), tags)))
+	})
+
+	Context("with a MetricSender that implements only MetricSender", func() {
+		BeforeEach(func() {
+			metrics.Initialize(basicMetricSender{metricSender}, metricBatcher)
+			close(metricSender.SendValueOutput.Ret0)
+			close(metricSender.AddToCounterOutput.Ret0)
+		})
+
+		It("sends the mean of a summary as a value", func() {
+			Expect(metrics.SendSummary("latency", 4, 1, 9, 16, "ms")).To(Succeed())
+			Expect(metricSender.SendValueInput).To(BeCalled(With("latency", 4.0, "ms")))
+			Expect(metricSender.SendSummaryCalled).To(BeEmpty())
+		})
+
+		It("rejects invalid summaries", func() {
+			Expect(metrics.SendSummary("latency", 0, 1, 9, 16, "ms")).To(MatchError("Summary latency has a count of zero"))
+			Expect(metricSender.SendValueCalled).To(BeEmpty())
+		})
+
+		It("sends tagged values without their tags", func() {
+			Expect(metrics.SendTaggedValue("metric", 42.42, "answers", map[string]string{"component": "router"})).To(Succeed())
+			Expect(metricSender.SendValueInput).To(BeCalled(With("metric", 42.42, "answers")))
+		})
+
+		It("sends tagged counters without their tags", func() {
+			Expect(metrics.SendTaggedCounter("count", 5, map[string]string{"component": "router"})).To(Succeed())
+			Expect(metricSender.AddToCounterInput).To(BeCalled(With("count", uint64(5))))
+		})
+	})
+
 	Context("with a metrics package that is not initialized", func() {
 		BeforeEach(func() {
 			metrics.Initialize(nil, nil)
@@ -112,6 +163,21 @@ var _ = Describe("Metrics", func() {
 			Expect(err).ToNot(HaveOccurred())
 		})
 
+		It("SendSummary is a no-op", func() {
+			err := metrics.SendSummary("latency", 4, 1, 9, 16, "ms")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("SendTaggedValue is a no-op", func() {
+			err := metrics.SendTaggedValue("metric", 42.42, "answers", map[string]string{"component": "router"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("SendTaggedCounter is a no-op", func() {
+			err := metrics.SendTaggedCounter("count", 5, map[string]string{"component": "router"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
 		It("Value is a no-op", func() {
 			value := metrics.Value("metric", 42.42, "answers")
 			Expect(value).To(BeNil())
@@ -143,3 +209,9 @@ var _ = Describe("Metrics", func() {
 		})
 	})
 })
+
+// basicMetricSender hides every method of the wrapped sender that is not part
+// of metrics.MetricSender.
+type basicMetricSender struct {
+	metrics.MetricSender
+}
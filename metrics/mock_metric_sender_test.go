@@ -79,6 +79,35 @@ type mockMetricSender struct {
 	SendContainerMetricOutput struct {
 		Ret0 chan error
 	}
+	SendSummaryCalled chan bool
+	SendSummaryInput  struct {
+		Name          chan string
+		Count         chan uint64
+		Min, Max, Sum chan float64
+		Unit          chan string
+	}
+	SendSummaryOutput struct {
+		Ret0 chan error
+	}
+	SendTaggedValueCalled chan bool
+	SendTaggedValueInput  struct {
+		Name  chan string
+		Value chan float64
+		Unit  chan string
+		Tags  chan map[string]string
+	}
+	SendTaggedValueOutput struct {
+		Ret0 chan error
+	}
+	SendTaggedCounterCalled chan bool
+	SendTaggedCounterInput  struct {
+		Name  chan string
+		Delta chan uint64
+		Tags  chan map[string]string
+	}
+	SendTaggedCounterOutput struct {
+		Ret0 chan error
+	}
 }
 
 func newMockMetricSender() *mockMetricSender {
@@ -120,6 +149,25 @@ func newMockMetricSender() *mockMetricSender {
 	m.SendContainerMetricInput.MemoryBytes = make(chan uint64, 100)
 	m.SendContainerMetricInput.DiskBytes = make(chan uint64, 100)
 	m.SendContainerMetricOutput.Ret0 = make(chan error, 100)
+	m.SendSummaryCalled = make(chan bool, 100)
+	m.SendSummaryInput.Name = make(chan string, 100)
+	m.SendSummaryInput.Count = make(chan uint64, 100)
+	m.SendSummaryInput.Min = make(chan float64, 100)
+	m.SendSummaryInput.Max = make(chan float64, 100)
+	m.SendSummaryInput.Sum = make(chan float64, 100)
+	m.SendSummaryInput.Unit = make(chan string, 100)
+	m.SendSummaryOutput.Ret0 = make(chan error, 100)
+	m.SendTaggedValueCalled = make(chan bool, 100)
+	m.SendTaggedValueInput.Name = make(chan string, 100)
+	m.SendTaggedValueInput.Value = make(chan float64, 100)
+	m.SendTaggedValueInput.Unit = make(chan string, 100)
+	m.SendTaggedValueInput.Tags = make(chan map[string]string, 100)
+	m.SendTaggedValueOutput.Ret0 = make(chan error, 100)
+	m.SendTaggedCounterCalled = make(chan bool, 100)
+	m.SendTaggedCounterInput.Name = make(chan string, 100)
+	m.SendTaggedCounterInput.Delta = make(chan uint64, 100)
+	m.SendTaggedCounterInput.Tags = make(chan map[string]string, 100)
+	m.SendTaggedCounterOutput.Ret0 = make(chan error, 100)
 	return m
 }
 func (m *mockMetricSender) Send(event events.Event) error {
@@ -175,3 +223,28 @@ func (m *mockMetricSender) SendContainerMetric(applicationId string, instanceInd
 	m.SendContainerMetricInput.DiskBytes <- diskBytes
 	return <-m.SendContainerMetricOutput.Ret0
 }
+func (m *mockMetricSender) SendSummary(name string, count uint64, min, max, sum float64, unit string) error {
+	m.SendSummaryCalled <- true
+	m.SendSummaryInput.Name <- name
+	m.SendSummaryInput.Count <- count
+	m.SendSummaryInput.Min <- min
+	m.SendSummaryInput.Max <- max
+	m.SendSummaryInput.Sum <- sum
+	m.SendSummaryInput.Unit <- unit
+	return <-m.SendSummaryOutput.Ret0
+}
+func (m *mockMetricSender) SendTaggedValue(name string, value float64, unit string, tags map[string]string) error {
+	m.SendTaggedValueCalled <- true
+	m.SendTaggedValueInput.Name <- name
+	m.SendTaggedValueInput.Value <- value
+	m.SendTaggedValueInput.Unit <- unit
+	m.SendTaggedValueInput.Tags <- tags
+	return <-m.SendTaggedValueOutput.Ret0
+}
+func (m *mockMetricSender) SendTaggedCounter(name string, delta uint64, tags map[string]string) error {
+	m.SendTaggedCounterCalled <- true
+	m.SendTaggedCounterInput.Name <- name
+	m.SendTaggedCounterInput.Delta <- delta
+	m.SendTaggedCounterInput.Tags <- tags
+	return <-m.SendTaggedCounterOutput.Ret0
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	guardLock sync.RWMutex
+	guard     *throttle
+)
+
+// SetMinimumInterval guards against callers flooding the pipeline by
+// emitting the same metric in a tight loop. Once set, SendValue,
+// SendTaggedValue, SendSummary, IncrementCounter, AddToCounter and
+// SendTaggedCounter send a given name at most once per interval, and calls
+// arriving sooner are suppressed and counted. Suppressed values are dropped.
+// Suppressed counter increments are carried over: they are added to the next
+// counter event sent for that name, or sent on their own once the interval
+// has passed, so that counter totals stay correct when a burst stops.
+// Different names, and the same name with different tags, are throttled and
+// carried independently. SendTimer is only throttled when it sends each
+// sample as a value; batched timers are already aggregated. An interval of
+// zero or less removes the guard, which is the default, and any carried
+// increments are sent at once. It should be called before metrics are sent.
+func SetMinimumInterval(interval time.Duration) {
+	var next *throttle
+	if interval > 0 {
+		next = &throttle{
+			interval: interval,
+			lastSent: make(map[string]time.Time),
+			pending:  make(map[string]*carriedDelta),
+			flushes:  make(map[string]*time.Timer),
+		}
+	}
+
+	guardLock.Lock()
+	previous := guard
+	guard = next
+	guardLock.Unlock()
+
+	if previous != nil {
+		previous.flushAll()
+	}
+}
+
+type throttle struct {
+	lock     sync.Mutex
+	interval time.Duration
+	lastSent map[string]time.Time
+	pending  map[string]*carriedDelta
+	flushes  map[string]*time.Timer
+}
+
+// carriedDelta is the counter delta of suppressed calls for one series.
+type carriedDelta struct {
+	name  string
+	tags  map[string]string
+	delta uint64
+}
+
+// seriesKey identifies a name and tag set, independent of map order.
+func seriesKey(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return name + "\x00" + strings.Join(pairs, "\x00")
+}
+
+// allow reports whether the series may be sent now. If it may, it also
+// returns the counter delta carried over from suppressed calls, and resets
+// it.
+func (t *throttle) allow(name string, tags map[string]string, delta uint64) (bool, uint64) {
+	key := seriesKey(name, tags)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if last, ok := t.lastSent[key]; ok && now.Sub(last) < t.interval {
+		if delta > 0 {
+			carried, ok := t.pending[key]
+			if !ok {
+				carried = &carriedDelta{name: name, tags: copyTags(tags)}
+				t.pending[key] = carried
+			}
+			carried.delta += delta
+			t.scheduleFlush(key, t.interval-now.Sub(last))
+		}
+		return false, 0
+	}
+
+	t.lastSent[key] = now
+	var carried uint64
+	if pending, ok := t.pending[key]; ok {
+		carried = pending.delta
+		delete(t.pending, key)
+	}
+	if flush, ok := t.flushes[key]; ok {
+		flush.Stop()
+		delete(t.flushes, key)
+	}
+	return true, carried
+}
+
+// scheduleFlush arranges for the carried delta of a series to be sent after
+// wait, unless a send of that series picks it up first. It must be called
+// with the lock held.
+func (t *throttle) scheduleFlush(key string, wait time.Duration) {
+	if _, ok := t.flushes[key]; ok {
+		return
+	}
+	t.flushes[key] = time.AfterFunc(wait, func() {
+		t.lock.Lock()
+		delete(t.flushes, key)
+		carried, ok := t.pending[key]
+		delete(t.pending, key)
+		if ok {
+			t.lastSent[key] = time.Now()
+		}
+		t.lock.Unlock()
+
+		if ok {
+			sendCarried(carried)
+		}
+	})
+}
+
+// flushAll sends every carried delta at once.
+func (t *throttle) flushAll() {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = make(map[string]*carriedDelta)
+	for key, flush := range t.flushes {
+		flush.Stop()
+		delete(t.flushes, key)
+	}
+	t.lock.Unlock()
+
+	for _, carried := range pending {
+		sendCarried(carried)
+	}
+}
+
+func sendCarried(carried *carriedDelta) {
+	if metricSender == nil {
+		return
+	}
+	if len(carried.tags) > 0 {
+		sendTaggedCounter(carried.name, carried.delta, carried.tags)
+		return
+	}
+	metricSender.AddToCounter(carried.name, carried.delta)
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
+}
+
+// throttled reports whether a send of the series, adding delta to its
+// counter, should be suppressed. If not, it returns the delta to send,
+// including any carried over from suppressed calls.
+func throttled(name string, tags map[string]string, delta uint64) (bool, uint64) {
+	guardLock.RLock()
+	g := guard
+	guardLock.RUnlock()
+	if g == nil {
+		return false, delta
+	}
+
+	allowed, carried := g.allow(name, tags, delta)
+	if !allowed {
+		BatchIncrementCounter("metrics.suppressedEmissions")
+		return true, 0
+	}
+	return false, delta + carried
+}
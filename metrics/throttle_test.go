@@ -0,0 +1,137 @@
+package metrics_test
+
+import (
+	"time"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+)
+
+var _ = Describe("SetMinimumInterval", func() {
+	var (
+		metricSender  *mockMetricSender
+		metricBatcher *mockMetricBatcher
+	)
+
+	BeforeEach(func() {
+		metricSender = newMockMetricSender()
+		metricBatcher = newMockMetricBatcher()
+		metrics.Initialize(metricSender, metricBatcher)
+		close(metricSender.SendValueOutput.Ret0)
+		close(metricSender.IncrementCounterOutput.Ret0)
+		close(metricSender.AddToCounterOutput.Ret0)
+
+		metrics.SetMinimumInterval(50 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		metrics.SetMinimumInterval(0)
+	})
+
+	It("limits how often a name is sent and counts the suppressed emissions", func() {
+		start := time.Now()
+		for i := 0; i < 50; i++ {
+			Expect(metrics.SendValue("hot", float64(i), "count")).To(Succeed())
+			time.Sleep(5 * time.Millisecond)
+		}
+		elapsed := time.Since(start)
+
+		sent := len(metricSender.SendValueCalled)
+		Expect(sent).To(BeNumerically(">=", 2))
+		Expect(sent).To(BeNumerically("<=", int(elapsed/(50*time.Millisecond))+1))
+		Expect(metricBatcher.BatchIncrementCounterCalled).To(HaveLen(50 - sent))
+		Expect(metricBatcher.BatchIncrementCounterInput).To(BeCalled(With("metrics.suppressedEmissions")))
+	})
+
+	It("throttles different names independently", func() {
+		Expect(metrics.SendValue("first", 1, "count")).To(Succeed())
+		Expect(metrics.SendValue("second", 2, "count")).To(Succeed())
+		Expect(metrics.SendValue("first", 3, "count")).To(Succeed())
+
+		Expect(metricSender.SendValueCalled).To(HaveLen(2))
+		Expect(metricSender.SendValueInput).To(BeCalled(
+			With("first", 1.0, "count"),
+			With("second", 2.0, "count"),
+		))
+	})
+
+	It("sends suppressed counter increments once the interval has passed", func() {
+		Expect(metrics.IncrementCounter("requests")).To(Succeed())
+		Expect(metrics.IncrementCounter("requests")).To(Succeed())
+		Expect(metrics.AddToCounter("requests", 4)).To(Succeed())
+		Expect(metricSender.IncrementCounterInput).To(BeCalled(With("requests")))
+		Expect(metricSender.AddToCounterCalled).To(BeEmpty())
+
+		Eventually(metricSender.AddToCounterInput).Should(BeCalled(With("requests", uint64(5))))
+	})
+
+	It("delivers every counter increment of a burst", func() {
+		for i := 0; i < 40; i++ {
+			Expect(metrics.AddToCounter("requests", 2)).To(Succeed())
+			time.Sleep(time.Millisecond)
+		}
+
+		var total uint64
+		Eventually(func() uint64 {
+			for {
+				select {
+				case delta := <-metricSender.AddToCounterInput.Delta:
+					total += delta
+				default:
+					return total
+				}
+			}
+		}).Should(Equal(uint64(80)))
+	})
+
+	It("throttles summaries", func() {
+		close(metricSender.SendSummaryOutput.Ret0)
+		Expect(metrics.SendSummary("latency", 1, 1, 1, 1, "ms")).To(Succeed())
+		Expect(metrics.SendSummary("latency", 1, 1, 1, 1, "ms")).To(Succeed())
+
+		Expect(metricSender.SendSummaryCalled).To(HaveLen(1))
+	})
+
+	It("sends carried increments when the guard is removed", func() {
+		Expect(metrics.IncrementCounter("requests")).To(Succeed())
+		Expect(metrics.AddToCounter("requests", 3)).To(Succeed())
+
+		metrics.SetMinimumInterval(0)
+
+		Expect(metricSender.AddToCounterInput).To(BeCalled(With("requests", uint64(3))))
+	})
+
+	It("carries tagged counter increments with their tags", func() {
+		close(metricSender.SendTaggedCounterOutput.Ret0)
+		zone1 := map[string]string{"zone": "z1", "deployment": "cf"}
+		zone2 := map[string]string{"zone": "z2"}
+
+		Expect(metrics.SendTaggedCounter("requests", 1, zone1)).To(Succeed())
+		Expect(metrics.SendTaggedCounter("requests", 1, zone2)).To(Succeed())
+		Expect(metrics.IncrementCounter("requests")).To(Succeed())
+		Expect(metricSender.SendTaggedCounterCalled).To(HaveLen(2))
+		Expect(metricSender.IncrementCounterCalled).To(HaveLen(1))
+
+		Expect(metrics.SendTaggedCounter("requests", 4, map[string]string{"deployment": "cf", "zone": "z1"})).To(Succeed())
+		Expect(metrics.AddToCounter("requests", 2)).To(Succeed())
+
+		Eventually(metricSender.SendTaggedCounterInput).Should(BeCalled(With("requests", uint64(1), zone1)))
+		Eventually(metricSender.SendTaggedCounterInput).Should(BeCalled(With("requests", uint64(1), zone2)))
+		Eventually(metricSender.SendTaggedCounterInput).Should(BeCalled(With("requests", uint64(4), zone1)))
+		Eventually(metricSender.AddToCounterInput).Should(BeCalled(With("requests", uint64(2))))
+		Consistently(func() int { return len(metricSender.SendTaggedCounterCalled) }, 100*time.Millisecond).Should(Equal(3))
+	})
+
+	It("sends every emission once the guard is removed", func() {
+		metrics.SetMinimumInterval(0)
+
+		for i := 0; i < 3; i++ {
+			Expect(metrics.SendValue("hot", float64(i), "count")).To(Succeed())
+		}
+
+		Expect(metricSender.SendValueCalled).To(HaveLen(3))
+	})
+})
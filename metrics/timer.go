@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// A TimerOption configures a timer started with StartTimer.
+type TimerOption func(*timer)
+
+// WithTimerUnit sets the unit the elapsed duration is reported in. Supported
+// units are time.Nanosecond, time.Microsecond, time.Millisecond and
+// time.Second; any other value is ignored. The default is time.Millisecond.
+func WithTimerUnit(unit time.Duration) TimerOption {
+	return func(t *timer) {
+		if name, ok := timerUnitNames[unit]; ok {
+			t.unit = unit
+			t.unitName = name
+		}
+	}
+}
+
+// WithTimerTag adds a tag to the value metric emitted when the timer stops.
+func WithTimerTag(key, value string) TimerOption {
+	return func(t *timer) {
+		t.tags = append(t.tags, [2]string{key, value})
+	}
+}
+
+// WithBatchedTimer records the elapsed duration with SendTimer, so that it is
+// aggregated with the timer's other samples, instead of sending a value
+// metric for it. Units and tags do not apply to batched timers.
+func WithBatchedTimer() TimerOption {
+	return func(t *timer) {
+		t.batched = true
+	}
+}
+
+var timerUnitNames = map[time.Duration]string{
+	time.Nanosecond:  "ns",
+	time.Microsecond: "us",
+	time.Millisecond: "ms",
+	time.Second:      "s",
+}
+
+type timer struct {
+	name     string
+	start    time.Time
+	unit     time.Duration
+	unitName string
+	tags     [][2]string
+	batched  bool
+	once     sync.Once
+}
+
+// StartTimer starts timing an operation and returns a function that stops the
+// timer and sends the elapsed duration as a value metric with the given name.
+// Only the first call to the returned function sends a metric; later calls
+// are no-ops.
+//
+//	stop := metrics.StartTimer("db.query", metrics.WithTimerTag("table", "users"))
+//	defer stop()
+func StartTimer(name string, opts ...TimerOption) func() {
+	t := &timer{
+		name:     name,
+		unit:     time.Millisecond,
+		unitName: timerUnitNames[time.Millisecond],
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.start = time.Now()
+
+	return func() {
+		t.once.Do(t.stop)
+	}
+}
+
+func (t *timer) stop() {
+	elapsed := time.Since(t.start)
+	if t.batched {
+		SendTimer(t.name, elapsed)
+		return
+	}
+	chainer := Value(t.name, float64(elapsed)/float64(t.unit), t.unitName)
+	if chainer == nil {
+		return
+	}
+	for _, tag := range t.tags {
+		chainer = chainer.SetTag(tag[0], tag[1])
+	}
+	chainer.Send()
+}
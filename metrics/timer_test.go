@@ -0,0 +1,184 @@
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/metric_sender"
+	"github.com/cloudfoundry/dropsonde/metricbatcher"
+	"github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StartTimer", func() {
+	var fakeEmitter *fake.FakeEventEmitter
+
+	BeforeEach(func() {
+		fakeEmitter = fake.NewFakeEventEmitter("origin")
+		metrics.Initialize(metric_sender.NewMetricSender(fakeEmitter), newMockMetricBatcher())
+	})
+
+	It("sends the elapsed duration in milliseconds when stopped", func() {
+		stop := metrics.StartTimer("operation")
+		time.Sleep(20 * time.Millisecond)
+		stop()
+
+		envelopes := fakeEmitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(1))
+		metric := envelopes[0].GetValueMetric()
+		Expect(metric.GetName()).To(Equal("operation"))
+		Expect(metric.GetUnit()).To(Equal("ms"))
+		Expect(metric.GetValue()).To(BeNumerically(">=", 20))
+		Expect(metric.GetValue()).To(BeNumerically("<", 1000))
+	})
+
+	It("sends the duration in the chosen unit", func() {
+		stop := metrics.StartTimer("operation", metrics.WithTimerUnit(time.Microsecond))
+		time.Sleep(20 * time.Millisecond)
+		stop()
+
+		metric := fakeEmitter.GetEnvelopes()[0].GetValueMetric()
+		Expect(metric.GetUnit()).To(Equal("us"))
+		Expect(metric.GetValue()).To(BeNumerically(">=", 20000))
+	})
+
+	It("ignores unsupported units", func() {
+		stop := metrics.StartTimer("operation", metrics.WithTimerUnit(time.Hour))
+		stop()
+
+		Expect(fakeEmitter.GetEnvelopes()[0].GetValueMetric().GetUnit()).To(Equal("ms"))
+	})
+
+	It("attaches tags", func() {
+		stop := metrics.StartTimer("operation",
+			metrics.WithTimerTag("table", "users"),
+			metrics.WithTimerTag("op", "select"),
+		)
+		stop()
+
+		Expect(fakeEmitter.GetEnvelopes()[0].GetTags()).To(Equal(map[string]string{
+			"table": "users",
+			"op":    "select",
+		}))
+	})
+
+	It("only sends a metric the first time it is stopped", func() {
+		stop := metrics.StartTimer("operation")
+		stop()
+		stop()
+		stop()
+
+		Expect(fakeEmitter.GetEnvelopes()).To(HaveLen(1))
+	})
+
+	It("records the duration with the batcher when batched", func() {
+		batcher := metricbatcher.New(metric_sender.NewMetricSender(fakeEmitter), time.Hour)
+		metrics.Initialize(metric_sender.NewMetricSender(fakeEmitter), batcher)
+
+		stop := metrics.StartTimer("operation", metrics.WithBatchedTimer())
+		time.Sleep(20 * time.Millisecond)
+		stop()
+		Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+
+		metrics.Initialize(nil, nil)
+		values := make(map[string]float64)
+		for _, envelope := range fakeEmitter.GetEnvelopes() {
+			values[envelope.GetValueMetric().GetName()] = envelope.GetValueMetric().GetValue()
+		}
+		Expect(values).To(HaveKeyWithValue("operation.count", float64(1)))
+		Expect(values["operation.max"]).To(BeNumerically(">=", 20))
+	})
+
+	It("is a no-op when the metrics package is not initialized", func() {
+		metrics.Initialize(nil, nil)
+		stop := metrics.StartTimer("operation")
+
+		Expect(stop).ToNot(Panic())
+		Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("SendTimer", func() {
+	var fakeEmitter *fake.FakeEventEmitter
+
+	BeforeEach(func() {
+		fakeEmitter = fake.NewFakeEventEmitter("origin")
+	})
+
+	It("aggregates samples in a timer batcher", func() {
+		batcher := metricbatcher.New(metric_sender.NewMetricSender(fakeEmitter), time.Hour)
+		metrics.Initialize(metric_sender.NewMetricSender(fakeEmitter), batcher)
+
+		metrics.SendTimer("operation", 10*time.Millisecond)
+		metrics.SendTimer("operation", 30*time.Millisecond)
+		Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+
+		metrics.Initialize(nil, nil)
+		values := make(map[string]float64)
+		for _, envelope := range fakeEmitter.GetEnvelopes() {
+			values[envelope.GetValueMetric().GetName()] = envelope.GetValueMetric().GetValue()
+		}
+		Expect(values).To(Equal(map[string]float64{
+			"operation.count": 2,
+			"operation.min":   10,
+			"operation.max":   30,
+			"operation.mean":  20,
+			"operation.p95":   30,
+			"operation.p99":   30,
+		}))
+	})
+
+	It("sends each sample when the batcher cannot aggregate timers", func() {
+		metrics.Initialize(metric_sender.NewMetricSender(fakeEmitter), newMockMetricBatcher())
+
+		metrics.SendTimer("operation", 10*time.Millisecond)
+
+		envelopes := fakeEmitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(1))
+		Expect(envelopes[0].GetValueMetric().GetName()).To(Equal("operation"))
+		Expect(envelopes[0].GetValueMetric().GetValue()).To(Equal(float64(10)))
+		Expect(envelopes[0].GetValueMetric().GetUnit()).To(Equal("ms"))
+	})
+
+	It("is a no-op when the metrics package is not initialized", func() {
+		metrics.Initialize(nil, nil)
+
+		Expect(func() { metrics.SendTimer("operation", time.Millisecond) }).ToNot(Panic())
+		Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("BatchTimer", func() {
+	var fakeEmitter *fake.FakeEventEmitter
+
+	BeforeEach(func() {
+		fakeEmitter = fake.NewFakeEventEmitter("origin")
+	})
+
+	It("aggregates samples in a timer batcher", func() {
+		batcher := metricbatcher.New(metric_sender.NewMetricSender(fakeEmitter), time.Hour)
+		metrics.Initialize(metric_sender.NewMetricSender(fakeEmitter), batcher)
+
+		metrics.BatchTimer("operation", 10*time.Millisecond)
+		Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+
+		metrics.Initialize(nil, nil)
+		Expect(fakeEmitter.GetEnvelopes()).To(HaveLen(6))
+	})
+
+	It("discards samples when the batcher cannot aggregate timers", func() {
+		metrics.Initialize(metric_sender.NewMetricSender(fakeEmitter), newMockMetricBatcher())
+
+		metrics.BatchTimer("operation", 10*time.Millisecond)
+
+		Expect(fakeEmitter.GetEnvelopes()).To(BeEmpty())
+	})
+
+	It("is a no-op when the metrics package is not initialized", func() {
+		metrics.Initialize(nil, nil)
+
+		Expect(func() { metrics.BatchTimer("operation", time.Millisecond) }).ToNot(Panic())
+	})
+})
@@ -0,0 +1,189 @@
+package dropsonde
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/runtime_stats"
+	"github.com/cloudfoundry/dropsonde/sampling"
+)
+
+// An Option configures the default emitter created by InitializeWithOptions.
+type Option func(*config)
+
+type config struct {
+	tags         map[string]string
+	metricPrefix string
+	sampler      sampling.Sampler
+	httpSampler  sampling.Sampler
+	logSampler   sampling.Sampler
+	recoverPanic bool
+	emitTimeout  time.Duration
+	dropSummary  bool
+	clockOffset  time.Duration
+	offsetEvents bool
+	serializer   emitter.EnvelopeSerializer
+	bufferSize   int
+	collectors   []runtime_stats.Collector
+}
+
+// WithInstanceIndexTag tags every envelope with the instance index read from
+// the CF_INSTANCE_INDEX environment variable, under the "instance_index" key.
+// The variable is read once, when the option is applied. If it is unset or is
+// not a non-negative integer, no tag is added.
+func WithInstanceIndexTag() Option {
+	return func(c *config) {
+		index, err := strconv.Atoi(os.Getenv("CF_INSTANCE_INDEX"))
+		if err != nil || index < 0 {
+			return
+		}
+		c.tags["instance_index"] = strconv.Itoa(index)
+	}
+}
+
+// BuildSHA is the git SHA of the running build. It is typically set at link
+// time, e.g. with
+//
+//	go build -ldflags "-X github.com/cloudfoundry/dropsonde.BuildSHA=$(git rev-parse HEAD)"
+//
+// When it is not empty, the default emitter tags every envelope with it under
+// the "build_sha" key. WithBuildSHA takes precedence over it.
+var BuildSHA string
+
+// WithBuildSHA tags every envelope with the given build SHA under the
+// "build_sha" key, in place of BuildSHA. An empty sha is a no-op.
+func WithBuildSHA(sha string) Option {
+	return func(c *config) {
+		if sha == "" {
+			return
+		}
+		c.tags["build_sha"] = sha
+	}
+}
+
+// WithMetricPrefix namespaces every value metric and counter emitted through
+// the default emitter, including batched counters and runtime stats, by
+// prepending prefix and separator to its name. An empty prefix is a no-op.
+func WithMetricPrefix(prefix, separator string) Option {
+	return func(c *config) {
+		if prefix == "" {
+			return
+		}
+		c.metricPrefix = prefix + separator
+	}
+}
+
+// WithSampler applies sampler to every envelope sent through the default
+// emitter, covering HTTP events, logs and metrics alike. Use
+// sampling.ForEventType to restrict it to one kind of event.
+func WithSampler(sampler sampling.Sampler) Option {
+	return func(c *config) {
+		c.sampler = sampler
+	}
+}
+
+// WithHTTPSampler applies sampler only to the events sent by
+// dropsonde.InstrumentedHandler, dropsonde.InstrumentedRoundTripper and the
+// instrumented http.DefaultTransport. It is applied after any sampler set
+// with WithSampler.
+func WithHTTPSampler(sampler sampling.Sampler) Option {
+	return func(c *config) {
+		c.httpSampler = sampler
+	}
+}
+
+// WithLogSampler applies sampler only to the log messages sent through the
+// logs package. It is applied after any sampler set with WithSampler.
+func WithLogSampler(sampler sampling.Sampler) Option {
+	return func(c *config) {
+		c.logSampler = sampler
+	}
+}
+
+// WithPanicRecovery makes the default emitter recover and count panics raised
+// while marshaling or emitting a single envelope, rather than crashing the
+// process. See emitter.EventEmitter.SetPanicRecovery.
+func WithPanicRecovery() Option {
+	return func(c *config) {
+		c.recoverPanic = true
+	}
+}
+
+// WithEmitTimeout bounds how long an emit through the default emitter may
+// block on its transport. Emits that take longer are abandoned, counted as
+// dropped and return emitter.ErrTimeout. A timeout of zero or less leaves
+// emits unbounded, which is the default.
+//
+// With WithBufferedEmits, emits never block the caller, so the timeout
+// instead bounds each write made by the buffer's flush goroutine. Messages
+// whose write times out are still counted as dropped, but the error does not
+// reach the caller.
+func WithEmitTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.emitTimeout = timeout
+	}
+}
+
+// WithDropSummary emits, on every batch interval, a CounterEvent for each
+// emitter.DropReason with the number of envelopes dropped for that reason
+// since the previous interval, including reasons with no drops. See
+// emitter.DropCounterNames for the counter names.
+func WithDropSummary() Option {
+	return func(c *config) {
+		c.dropSummary = true
+	}
+}
+
+// WithClockOffset corrects for a skewed host clock by shifting the timestamp
+// of every envelope sent through the default emitter by offset, which may be
+// negative. Combine it with WithPayloadClockOffset to also shift the
+// timestamps carried inside HTTP and log events.
+func WithClockOffset(offset time.Duration) Option {
+	return func(c *config) {
+		c.clockOffset = offset
+	}
+}
+
+// WithPayloadClockOffset applies the WithClockOffset correction to the start
+// and stop timestamps of HttpStartStop events and the timestamps of
+// LogMessage events, as well as to envelope timestamps.
+func WithPayloadClockOffset() Option {
+	return func(c *config) {
+		c.offsetEvents = true
+	}
+}
+
+// WithSerializer encodes envelopes sent through the default emitter with
+// serializer instead of protobuf, for consumers that expect a bespoke wire
+// format. Envelopes it fails to encode are counted as dropped. See
+// emitter.EventEmitter.SetSerializer.
+func WithSerializer(serializer emitter.EnvelopeSerializer) Option {
+	return func(c *config) {
+		c.serializer = serializer
+	}
+}
+
+// WithBufferedEmits makes emits through the default emitter asynchronous:
+// envelopes are queued in a buffer of at most size messages and written to
+// the transport by a dedicated goroutine, so callers never block on it. When
+// the buffer is full the oldest message is discarded. The number discarded is
+// emitted on every batch interval as the emitter.BufferedDropCounterName
+// counter. A size of zero or less leaves emits synchronous, which is the
+// default.
+func WithBufferedEmits(size int) Option {
+	return func(c *config) {
+		c.bufferSize = size
+	}
+}
+
+// WithRuntimeCollectors registers collectors with the runtime stats that
+// Initialize starts, so that their gauges are emitted on the same interval as
+// the built-in runtime metrics. See runtime_stats for the collectors that are
+// provided.
+func WithRuntimeCollectors(collectors ...runtime_stats.Collector) Option {
+	return func(c *config) {
+		c.collectors = append(c.collectors, collectors...)
+	}
+}
@@ -0,0 +1,338 @@
+package dropsonde_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/logs"
+	"github.com/cloudfoundry/dropsonde/metric_sender"
+	"github.com/cloudfoundry/dropsonde/metricbatcher"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/dropsonde/runtime_stats"
+	"github.com/cloudfoundry/dropsonde/sampling"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	uuid "github.com/nu7hatch/gouuid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Options", func() {
+	var udpListener net.PacketConn
+
+	BeforeEach(func() {
+		var err error
+		udpListener, err = net.ListenPacket("udp4", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		udpListener.Close()
+	})
+
+	var initializeWith = func(opts ...dropsonde.Option) {
+		err := dropsonde.InitializeWithOptions(udpListener.LocalAddr().String(), []string{"test-origin"}, opts...)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	var emitAndReceive = func() *events.Envelope {
+		err := dropsonde.AutowiredEmitter().Emit(factories.NewValueMetric("options-test", 1, "count"))
+		Expect(err).ToNot(HaveOccurred())
+		return receiveValueMetric(udpListener, "options-test")
+	}
+
+	Describe("WithInstanceIndexTag", func() {
+		AfterEach(func() {
+			os.Unsetenv("CF_INSTANCE_INDEX")
+		})
+
+		It("tags envelopes with a valid instance index", func() {
+			os.Setenv("CF_INSTANCE_INDEX", "3")
+			initializeWith(dropsonde.WithInstanceIndexTag())
+
+			Expect(emitAndReceive().GetTags()).To(HaveKeyWithValue("instance_index", "3"))
+		})
+
+		It("skips the tag for an invalid instance index", func() {
+			os.Setenv("CF_INSTANCE_INDEX", "three")
+			initializeWith(dropsonde.WithInstanceIndexTag())
+
+			Expect(emitAndReceive().GetTags()).ToNot(HaveKey("instance_index"))
+		})
+
+		It("skips the tag when the instance index is unset", func() {
+			os.Unsetenv("CF_INSTANCE_INDEX")
+			initializeWith(dropsonde.WithInstanceIndexTag())
+
+			Expect(emitAndReceive().GetTags()).ToNot(HaveKey("instance_index"))
+		})
+	})
+
+	Describe("WithBuildSHA", func() {
+		AfterEach(func() {
+			dropsonde.BuildSHA = ""
+		})
+
+		It("tags envelopes with the build SHA", func() {
+			initializeWith(dropsonde.WithBuildSHA("8f2c1e4"))
+
+			Expect(emitAndReceive().GetTags()).To(HaveKeyWithValue("build_sha", "8f2c1e4"))
+		})
+
+		It("tags envelopes with the BuildSHA variable", func() {
+			dropsonde.BuildSHA = "b71d09a"
+			initializeWith()
+
+			Expect(emitAndReceive().GetTags()).To(HaveKeyWithValue("build_sha", "b71d09a"))
+		})
+
+		It("prefers the option over the BuildSHA variable", func() {
+			dropsonde.BuildSHA = "b71d09a"
+			initializeWith(dropsonde.WithBuildSHA("8f2c1e4"))
+
+			Expect(emitAndReceive().GetTags()).To(HaveKeyWithValue("build_sha", "8f2c1e4"))
+		})
+
+		It("skips the tag when the SHA is empty", func() {
+			initializeWith(dropsonde.WithBuildSHA(""))
+
+			Expect(emitAndReceive().GetTags()).ToNot(HaveKey("build_sha"))
+		})
+	})
+
+	Describe("WithMetricPrefix", func() {
+		It("prefixes value metrics", func() {
+			initializeWith(dropsonde.WithMetricPrefix("myapp", "."))
+
+			Expect(metrics.SendValue("adhoc", 1, "count")).To(Succeed())
+			Expect(receiveValueMetric(udpListener, "myapp.adhoc")).ToNot(BeNil())
+		})
+
+		It("prefixes batched counters", func() {
+			initializeWith(dropsonde.WithMetricPrefix("myapp", "."))
+
+			batcher := metricbatcher.New(metric_sender.NewMetricSender(dropsonde.AutowiredEmitter()), 10*time.Millisecond)
+			defer batcher.Close()
+
+			batcher.BatchIncrementCounter("batched")
+			Expect(receiveCounterEvent(udpListener, "myapp.batched").GetCounterEvent().GetDelta()).To(BeEquivalentTo(1))
+		})
+
+		It("prefixes runtime stats", func() {
+			initializeWith(dropsonde.WithMetricPrefix("myapp", "_"))
+
+			Expect(receiveValueMetric(udpListener, "myapp_numCPUS")).ToNot(BeNil())
+		})
+
+		It("leaves names unchanged for an empty prefix", func() {
+			initializeWith(dropsonde.WithMetricPrefix("", "."))
+
+			Expect(emitAndReceive().GetValueMetric().GetName()).To(Equal("options-test"))
+		})
+	})
+
+	Describe("WithSampler", func() {
+		It("samples envelopes sent through the default emitter", func() {
+			initializeWith(dropsonde.WithSampler(sampling.SamplerFunc(func(envelope *events.Envelope) bool {
+				return envelope.GetValueMetric().GetName() != "sampled-out"
+			})))
+
+			Expect(dropsonde.AutowiredEmitter().Emit(factories.NewValueMetric("sampled-out", 1, "count"))).To(Succeed())
+
+			Expect(dropsonde.AutowiredEmitter().Emit(factories.NewValueMetric("options-test", 1, "count"))).To(Succeed())
+
+			var names []string
+			receiveEnvelope(udpListener, func(envelope *events.Envelope) bool {
+				names = append(names, envelope.GetValueMetric().GetName())
+				return envelope.GetValueMetric().GetName() == "options-test"
+			})
+			Expect(names).ToNot(ContainElement("sampled-out"))
+		})
+	})
+
+	Describe("WithHTTPSampler and WithLogSampler", func() {
+		It("apply one sampler to HTTP events and logs but not to other envelopes", func() {
+			onlyMetrics := sampling.SamplerFunc(func(envelope *events.Envelope) bool {
+				return envelope.GetEventType() == events.Envelope_ValueMetric
+			})
+			initializeWith(dropsonde.WithHTTPSampler(onlyMetrics), dropsonde.WithLogSampler(onlyMetrics))
+
+			requestID, err := uuid.NewV4()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler := dropsonde.InstrumentedHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/sampled-out", nil))
+			Expect(logs.SendAppLog("app-id", "sampled-out", "src", "0")).To(Succeed())
+			Expect(dropsonde.AutowiredEmitter().Emit(factories.NewHttpStartStop(
+				httptest.NewRequest("GET", "/kept", nil), 200, 0, events.PeerType_Client, requestID,
+			))).To(Succeed())
+
+			var received []string
+			receiveEnvelope(udpListener, func(envelope *events.Envelope) bool {
+				if envelope.GetEventType() == events.Envelope_LogMessage {
+					received = append(received, string(envelope.GetLogMessage().GetMessage()))
+				}
+				if envelope.GetEventType() == events.Envelope_HttpStartStop {
+					received = append(received, envelope.GetHttpStartStop().GetUri())
+				}
+				return strings.HasSuffix(envelope.GetHttpStartStop().GetUri(), "/kept")
+			})
+			Expect(received).To(Equal([]string{"http://example.com/kept"}))
+		})
+	})
+
+	Describe("WithEmitTimeout", func() {
+		It("keeps emitting through the default emitter", func() {
+			initializeWith(dropsonde.WithEmitTimeout(time.Second))
+
+			Expect(emitAndReceive().GetValueMetric().GetName()).To(Equal("options-test"))
+		})
+	})
+
+	Describe("DescribeEmitter", func() {
+		It("describes each stage of the default emitter chain", func() {
+			initializeWith(dropsonde.WithEmitTimeout(time.Second), dropsonde.WithSampler(sampling.NewRateSampler(1, 0)))
+
+			var types []string
+			for _, stage := range dropsonde.DescribeEmitter() {
+				types = append(types, stage.Type)
+			}
+			Expect(types).To(Equal([]string{
+				"*sampling.Emitter",
+				"*emitter.EventEmitter",
+				"*emitter.TimeoutEmitter",
+				"*emitter.UDPEmitter",
+			}))
+			Expect(dropsonde.DescribeEmitter()[3].Config).To(HaveKeyWithValue("destination", udpListener.LocalAddr().String()))
+		})
+	})
+
+	Describe("WithBufferedEmits", func() {
+		It("keeps emitting through the default emitter", func() {
+			initializeWith(dropsonde.WithBufferedEmits(100))
+
+			Expect(emitAndReceive().GetValueMetric().GetName()).To(Equal("options-test"))
+		})
+
+		It("adds a buffering stage to the emitter chain", func() {
+			initializeWith(dropsonde.WithBufferedEmits(100))
+
+			Expect(dropsonde.DescribeEmitter()[1].Type).To(Equal("*emitter.BufferedEmitter"))
+		})
+	})
+
+	Describe("WithDropSummary", func() {
+		It("keeps emitting through the default emitter", func() {
+			initializeWith(dropsonde.WithDropSummary())
+
+			Expect(emitAndReceive().GetValueMetric().GetName()).To(Equal("options-test"))
+		})
+	})
+
+	Describe("WithPanicRecovery", func() {
+		It("keeps emitting through the default emitter", func() {
+			initializeWith(dropsonde.WithPanicRecovery())
+
+			Expect(emitAndReceive().GetValueMetric().GetName()).To(Equal("options-test"))
+		})
+	})
+
+	Describe("WithClockOffset", func() {
+		It("shifts envelope timestamps by the offset", func() {
+			initializeWith(dropsonde.WithClockOffset(-time.Hour))
+
+			before := time.Now().Add(-time.Hour).UnixNano()
+			timestamp := emitAndReceive().GetTimestamp()
+			after := time.Now().Add(-time.Hour).UnixNano()
+
+			Expect(timestamp).To(BeNumerically(">=", before))
+			Expect(timestamp).To(BeNumerically("<=", after))
+		})
+
+		It("shifts payload timestamps with WithPayloadClockOffset", func() {
+			initializeWith(dropsonde.WithClockOffset(time.Hour), dropsonde.WithPayloadClockOffset())
+
+			logMessage := factories.NewLogMessage(events.LogMessage_OUT, "options-test", "app-id", "App")
+			Expect(dropsonde.AutowiredEmitter().Emit(logMessage)).To(Succeed())
+
+			envelope := receiveEnvelope(udpListener, func(envelope *events.Envelope) bool {
+				return string(envelope.GetLogMessage().GetMessage()) == "options-test"
+			})
+			Expect(envelope.GetLogMessage().GetTimestamp()).To(Equal(logMessage.GetTimestamp() + int64(time.Hour)))
+		})
+	})
+
+	Describe("WithSerializer", func() {
+		It("writes the serializer's bytes to the wire", func() {
+			initializeWith(dropsonde.WithSerializer(func(envelope *events.Envelope) ([]byte, error) {
+				if envelope.GetValueMetric().GetName() != "options-test" {
+					return proto.Marshal(envelope)
+				}
+				return []byte("HDR1custom"), nil
+			}))
+
+			Expect(dropsonde.AutowiredEmitter().Emit(factories.NewValueMetric("options-test", 1, "count"))).To(Succeed())
+
+			buffer := make([]byte, 65536)
+			udpListener.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				n, _, err := udpListener.ReadFrom(buffer)
+				Expect(err).ToNot(HaveOccurred())
+				if string(buffer[:n]) == "HDR1custom" {
+					break
+				}
+			}
+		})
+	})
+
+	Describe("WithRuntimeCollectors", func() {
+		It("emits the collected gauges with the runtime stats", func() {
+			initializeWith(dropsonde.WithRuntimeCollectors(runtime_stats.CollectorFunc(func(*runtime.MemStats) []runtime_stats.Gauge {
+				return []runtime_stats.Gauge{{Name: "queueDepth", Value: 7}}
+			})))
+
+			envelope := receiveValueMetric(udpListener, "queueDepth")
+			Expect(envelope.GetValueMetric().GetValue()).To(BeEquivalentTo(7))
+			Expect(envelope.GetValueMetric().GetUnit()).To(Equal("count"))
+		})
+	})
+})
+
+// receiveValueMetric reads envelopes from conn until it finds the named value
+// metric, skipping the runtime stats that Initialize also emits.
+func receiveValueMetric(conn net.PacketConn, name string) *events.Envelope {
+	return receiveEnvelope(conn, func(envelope *events.Envelope) bool {
+		return envelope.GetValueMetric().GetName() == name
+	})
+}
+
+// receiveCounterEvent reads envelopes from conn until it finds the named
+// counter event.
+func receiveCounterEvent(conn net.PacketConn, name string) *events.Envelope {
+	return receiveEnvelope(conn, func(envelope *events.Envelope) bool {
+		return envelope.GetCounterEvent().GetName() == name
+	})
+}
+
+func receiveEnvelope(conn net.PacketConn, matches func(*events.Envelope) bool) *events.Envelope {
+	buffer := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		Expect(err).ToNot(HaveOccurred())
+
+		var envelope events.Envelope
+		Expect(proto.Unmarshal(buffer[:n], &envelope)).To(Succeed())
+		if matches(&envelope) {
+			return &envelope
+		}
+	}
+}
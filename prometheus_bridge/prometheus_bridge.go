@@ -0,0 +1,179 @@
+// Package prometheus_bridge mirrors metrics gathered from a Prometheus
+// registry into dropsonde envelopes.
+//
+// Use
+//
+//	emitter := dropsonde.AutowiredEmitter()
+//	bridge := prometheus_bridge.New(prometheus.DefaultGatherer, emitter, time.Minute)
+//	go bridge.Run(stopChan)
+//
+// Gauges and untyped metrics are emitted as ValueMetrics and counters as
+// CounterEvents whose delta is the increase since the previous gather. Metric
+// labels become envelope tags. Summaries and histograms are not mapped; they
+// are skipped and counted.
+package prometheus_bridge
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A Gatherer collects metric families. prometheus.Gatherer satisfies it.
+type Gatherer interface {
+	Gather() ([]*dto.MetricFamily, error)
+}
+
+type EventEmitter interface {
+	EmitEnvelope(*events.Envelope) error
+	Origin() string
+}
+
+// A Bridge periodically gathers metrics from a Gatherer and emits them.
+type Bridge struct {
+	gatherer Gatherer
+	emitter  EventEmitter
+	interval time.Duration
+
+	lock          sync.Mutex
+	counterTotals map[string]uint64
+}
+
+func New(gatherer Gatherer, emitter EventEmitter, interval time.Duration) *Bridge {
+	return &Bridge{
+		gatherer:      gatherer,
+		emitter:       emitter,
+		interval:      interval,
+		counterTotals: make(map[string]uint64),
+	}
+}
+
+// Run gathers and emits metrics immediately and then once per interval,
+// until stopChan is closed.
+func (b *Bridge) Run(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		if err := b.Emit(); err != nil {
+			log.Printf("PrometheusBridge: failed to gather metrics: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Emit gathers metrics once and emits them. Gathering errors are returned;
+// errors emitting individual envelopes are logged.
+func (b *Bridge) Emit() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	families, err := b.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var unmapped uint64
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			envelope := b.envelopeFor(family, metric)
+			if envelope == nil {
+				unmapped++
+				continue
+			}
+
+			if err := b.emitter.EmitEnvelope(envelope); err != nil {
+				log.Printf("PrometheusBridge: failed to emit: %v", err)
+			}
+		}
+	}
+
+	if unmapped > 0 {
+		metrics.BatchAddCounter("prometheusBridge.unmappedMetrics", unmapped)
+	}
+	return nil
+}
+
+func (b *Bridge) envelopeFor(family *dto.MetricFamily, metric *dto.Metric) *events.Envelope {
+	envelope := &events.Envelope{
+		Origin:    proto.String(b.emitter.Origin()),
+		Timestamp: proto.Int64(time.Now().UnixNano()),
+		Tags:      tagsFor(metric),
+	}
+
+	switch family.GetType() {
+	case dto.MetricType_GAUGE:
+		envelope.EventType = events.Envelope_ValueMetric.Enum()
+		envelope.ValueMetric = valueMetric(family.GetName(), metric.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		envelope.EventType = events.Envelope_ValueMetric.Enum()
+		envelope.ValueMetric = valueMetric(family.GetName(), metric.GetUntyped().GetValue())
+	case dto.MetricType_COUNTER:
+		envelope.EventType = events.Envelope_CounterEvent.Enum()
+		envelope.CounterEvent = b.counterEvent(family.GetName(), envelope.Tags, metric.GetCounter().GetValue())
+	default:
+		return nil
+	}
+	return envelope
+}
+
+func (b *Bridge) counterEvent(name string, tags map[string]string, value float64) *events.CounterEvent {
+	key := seriesKey(name, tags)
+	total := uint64(value)
+	delta := total
+	if previous := b.counterTotals[key]; total >= previous {
+		delta = total - previous
+	}
+	b.counterTotals[key] = total
+
+	return &events.CounterEvent{
+		Name:  proto.String(name),
+		Delta: proto.Uint64(delta),
+		Total: proto.Uint64(total),
+	}
+}
+
+func valueMetric(name string, value float64) *events.ValueMetric {
+	return &events.ValueMetric{
+		Name:  proto.String(name),
+		Value: proto.Float64(value),
+		Unit:  proto.String(""),
+	}
+}
+
+func tagsFor(metric *dto.Metric) map[string]string {
+	if len(metric.GetLabel()) == 0 {
+		return nil
+	}
+
+	tags := make(map[string]string, len(metric.GetLabel()))
+	for _, label := range metric.GetLabel() {
+		tags[label.GetName()] = label.GetValue()
+	}
+	return tags
+}
+
+func seriesKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{name}
+	for _, key := range keys {
+		parts = append(parts, key+"="+tags[key])
+	}
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,13 @@
+package prometheus_bridge_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPrometheusBridge(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PrometheusBridge Suite")
+}
@@ -0,0 +1,156 @@
+package prometheus_bridge_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/dropsonde/prometheus_bridge"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bridge", func() {
+	var (
+		gatherer    *fakeGatherer
+		fakeEmitter *fake.FakeEventEmitter
+		mockBatcher *mockMetricBatcher
+		bridge      *prometheus_bridge.Bridge
+	)
+
+	BeforeEach(func() {
+		gatherer = &fakeGatherer{}
+		fakeEmitter = fake.NewFakeEventEmitter("origin")
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+		bridge = prometheus_bridge.New(gatherer, fakeEmitter, 10*time.Millisecond)
+	})
+
+	It("emits gauges as value metrics with labels as tags", func() {
+		gatherer.families = []*dto.MetricFamily{
+			gauge("queue_depth", 12.5, "queue", "jobs"),
+		}
+
+		Expect(bridge.Emit()).To(Succeed())
+
+		envelopes := fakeEmitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(1))
+		Expect(envelopes[0].GetOrigin()).To(Equal("origin"))
+		Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(envelopes[0].GetValueMetric().GetName()).To(Equal("queue_depth"))
+		Expect(envelopes[0].GetValueMetric().GetValue()).To(Equal(12.5))
+		Expect(envelopes[0].GetTags()).To(Equal(map[string]string{"queue": "jobs"}))
+	})
+
+	It("emits counters as counter events with the increase since the last gather", func() {
+		gatherer.families = []*dto.MetricFamily{counter("requests_total", 10, "code", "200")}
+		Expect(bridge.Emit()).To(Succeed())
+		gatherer.families = []*dto.MetricFamily{counter("requests_total", 15, "code", "200")}
+		Expect(bridge.Emit()).To(Succeed())
+
+		envelopes := fakeEmitter.GetEnvelopes()
+		Expect(envelopes).To(HaveLen(2))
+		Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(envelopes[0].GetCounterEvent()).To(Equal(&events.CounterEvent{
+			Name:  proto.String("requests_total"),
+			Delta: proto.Uint64(10),
+			Total: proto.Uint64(10),
+		}))
+		Expect(envelopes[1].GetCounterEvent().GetDelta()).To(BeEquivalentTo(5))
+		Expect(envelopes[1].GetCounterEvent().GetTotal()).To(BeEquivalentTo(15))
+		Expect(envelopes[1].GetTags()).To(Equal(map[string]string{"code": "200"}))
+	})
+
+	It("tracks counters with different labels separately", func() {
+		gatherer.families = []*dto.MetricFamily{counter("requests_total", 10, "code", "200")}
+		Expect(bridge.Emit()).To(Succeed())
+		gatherer.families = []*dto.MetricFamily{counter("requests_total", 3, "code", "500")}
+		Expect(bridge.Emit()).To(Succeed())
+
+		Expect(fakeEmitter.GetEnvelopes()[1].GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+	})
+
+	It("treats a counter that went down as reset", func() {
+		gatherer.families = []*dto.MetricFamily{counter("requests_total", 10)}
+		Expect(bridge.Emit()).To(Succeed())
+		gatherer.families = []*dto.MetricFamily{counter("requests_total", 4)}
+		Expect(bridge.Emit()).To(Succeed())
+
+		Expect(fakeEmitter.GetEnvelopes()[1].GetCounterEvent().GetDelta()).To(BeEquivalentTo(4))
+	})
+
+	It("skips and counts metrics it cannot map", func() {
+		gatherer.families = []*dto.MetricFamily{
+			{
+				Name:   proto.String("latency"),
+				Type:   dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Histogram: &dto.Histogram{}}, {Histogram: &dto.Histogram{}}},
+			},
+			gauge("queue_depth", 1),
+		}
+
+		Expect(bridge.Emit()).To(Succeed())
+
+		Expect(fakeEmitter.GetEnvelopes()).To(HaveLen(1))
+		Eventually(mockBatcher.BatchAddCounterInput).Should(BeCalled(With("prometheusBridge.unmappedMetrics", uint64(2))))
+	})
+
+	It("returns gather errors", func() {
+		gatherer.err = errors.New("gather failed")
+
+		Expect(bridge.Emit()).To(MatchError("gather failed"))
+	})
+
+	It("emits periodically when run", func() {
+		gatherer.families = []*dto.MetricFamily{gauge("queue_depth", 1)}
+		stopChan := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			bridge.Run(stopChan)
+			close(done)
+		}()
+
+		Eventually(func() int { return len(fakeEmitter.GetEnvelopes()) }).Should(BeNumerically(">=", 2))
+		close(stopChan)
+		Eventually(done).Should(BeClosed())
+	})
+})
+
+type fakeGatherer struct {
+	families []*dto.MetricFamily
+	err      error
+}
+
+func (g *fakeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return g.families, g.err
+}
+
+func gauge(name string, value float64, labels ...string) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Label: labelPairs(labels), Gauge: &dto.Gauge{Value: proto.Float64(value)}}},
+	}
+}
+
+func counter(name string, value float64, labels ...string) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Label: labelPairs(labels), Counter: &dto.Counter{Value: proto.Float64(value)}}},
+	}
+}
+
+func labelPairs(labels []string) []*dto.LabelPair {
+	var pairs []*dto.LabelPair
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return pairs
+}
@@ -0,0 +1,137 @@
+package runtime_stats
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Gauge is a single value reported by a Collector. An empty Unit is
+// reported as "count".
+type Gauge struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+// A Collector produces gauges that are emitted alongside the built-in
+// runtime metrics, each time RuntimeStats samples them. Collect is called
+// from the RuntimeStats goroutine with the memory statistics read for that
+// interval. Collectors should use them rather than calling ReadMemStats,
+// which stops the world.
+type Collector interface {
+	Collect(stats *runtime.MemStats) []Gauge
+}
+
+// CollectorFunc adapts an ordinary function to a Collector.
+type CollectorFunc func(stats *runtime.MemStats) []Gauge
+
+func (f CollectorFunc) Collect(stats *runtime.MemStats) []Gauge {
+	return f(stats)
+}
+
+// NewGCPauseCollector reports the 50th, 95th and 99th percentile pause time
+// of the GC cycles completed since its previous collection, as
+// "memoryStats.gcPauseP50NS", "memoryStats.gcPauseP95NS" and
+// "memoryStats.gcPauseP99NS". The runtime only retains the last 256 pauses,
+// so at most that many are considered. Nothing is reported when no cycle
+// completed.
+func NewGCPauseCollector() Collector {
+	var lastNumGC *uint32
+	return CollectorFunc(func(stats *runtime.MemStats) []Gauge {
+		cycles := stats.NumGC
+		if lastNumGC != nil {
+			cycles -= *lastNumGC
+		}
+		numGC := stats.NumGC
+		lastNumGC = &numGC
+		if cycles == 0 {
+			return nil
+		}
+		if cycles > uint32(len(stats.PauseNs)) {
+			cycles = uint32(len(stats.PauseNs))
+		}
+
+		pauses := make(pauseTimes, 0, cycles)
+		for i := uint32(0); i < cycles; i++ {
+			pauses = append(pauses, stats.PauseNs[(stats.NumGC-i+255)%256])
+		}
+		sort.Sort(pauses)
+
+		return []Gauge{
+			{Name: "memoryStats.gcPauseP50NS", Value: float64(percentile(pauses, 0.50))},
+			{Name: "memoryStats.gcPauseP95NS", Value: float64(percentile(pauses, 0.95))},
+			{Name: "memoryStats.gcPauseP99NS", Value: float64(percentile(pauses, 0.99))},
+		}
+	})
+}
+
+type pauseTimes []uint64
+
+func (p pauseTimes) Len() int           { return len(p) }
+func (p pauseTimes) Less(i, j int) bool { return p[i] < p[j] }
+func (p pauseTimes) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// percentile returns the nearest-rank percentile p of the sorted values.
+func percentile(sorted pauseTimes, p float64) uint64 {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// NewHeapCollector reports the heap statistics that complement the default
+// memory metrics: "memoryStats.numBytesInUseHeap",
+// "memoryStats.numBytesIdleHeap" and "memoryStats.numBytesSysHeap". The
+// number of heap objects is emitted by default, as
+// "memoryStats.numHeapObjects".
+func NewHeapCollector() Collector {
+	return CollectorFunc(func(stats *runtime.MemStats) []Gauge {
+		return []Gauge{
+			{Name: "memoryStats.numBytesInUseHeap", Value: float64(stats.HeapInuse)},
+			{Name: "memoryStats.numBytesIdleHeap", Value: float64(stats.HeapIdle)},
+			{Name: "memoryStats.numBytesSysHeap", Value: float64(stats.HeapSys)},
+		}
+	})
+}
+
+// CountOpenFDs returns the number of file descriptors the process has open.
+// It is a variable so that tests can substitute a fake source.
+var CountOpenFDs = countOpenFDs
+
+// NewOpenFDsCollector reports the number of open file descriptors as
+// "processStats.numOpenFileDescriptors". Nothing is reported on platforms
+// where they cannot be counted.
+func NewOpenFDsCollector() Collector {
+	return CollectorFunc(func(*runtime.MemStats) []Gauge {
+		count, err := CountOpenFDs()
+		if err != nil {
+			return nil
+		}
+		return []Gauge{{Name: "processStats.numOpenFileDescriptors", Value: float64(count)}}
+	})
+}
+
+var (
+	processStartOnce sync.Once
+	processStart     time.Time
+)
+
+// NewUptimeCollector reports the time since the process started, in seconds,
+// as "processStats.uptime". The start is taken to be the first time a
+// RuntimeStats or uptime collector was created.
+func NewUptimeCollector() Collector {
+	markProcessStart()
+	return CollectorFunc(func(*runtime.MemStats) []Gauge {
+		return []Gauge{{Name: "processStats.uptime", Value: time.Since(processStart).Seconds(), Unit: "s"}}
+	})
+}
+
+func markProcessStart() {
+	processStartOnce.Do(func() {
+		processStart = time.Now()
+	})
+}
@@ -0,0 +1,31 @@
+package runtime_stats
+
+import (
+	"errors"
+	"time"
+)
+
+var errCPUUnsupported = errors.New("process CPU usage is not supported on this platform")
+
+// A CPUSample is the total CPU time, user and system, consumed by the process
+// as of the given wall clock time.
+type CPUSample struct {
+	Wall time.Time
+	CPU  time.Duration
+}
+
+// SampleCPU reads the CPU time consumed by the current process. It is a
+// variable so that tests can substitute a fake source.
+var SampleCPU = sampleCPU
+
+// cpuPercent returns the share of the available CPU time, across numCPU
+// CPUs, that was consumed between the two samples.
+func cpuPercent(previous, current CPUSample, numCPU int) (float64, bool) {
+	wall := current.Wall.Sub(previous.Wall)
+	if wall <= 0 || numCPU <= 0 {
+		return 0, false
+	}
+
+	used := current.CPU - previous.CPU
+	return 100 * float64(used) / (float64(wall) * float64(numCPU)), true
+}
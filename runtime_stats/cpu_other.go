@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package runtime_stats
+
+func sampleCPU() (CPUSample, error) {
+	return CPUSample{}, errCPUUnsupported
+}
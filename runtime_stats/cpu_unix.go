@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package runtime_stats
+
+import (
+	"syscall"
+	"time"
+)
+
+func sampleCPU() (CPUSample, error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return CPUSample{}, err
+	}
+
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	return CPUSample{Wall: time.Now(), CPU: cpu}, nil
+}
@@ -0,0 +1,18 @@
+package runtime_stats
+
+import "os"
+
+func countOpenFDs() (int, error) {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// The directory read holds a descriptor of its own.
+	return len(names) - 1, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package runtime_stats
+
+import "errors"
+
+func countOpenFDs() (int, error) {
+	return 0, errors.New("counting open file descriptors is not supported on this platform")
+}
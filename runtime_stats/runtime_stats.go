@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/gogo/protobuf/proto"
 )
 
 type EventEmitter interface {
@@ -16,22 +15,66 @@ type EventEmitter interface {
 type RuntimeStats struct {
 	emitter  EventEmitter
 	interval time.Duration
+
+	lastCPUSample  *CPUSample
+	lastGCSample   *gcSample
+	allowedMetrics map[string]bool
+	collectors     []Collector
+}
+
+type gcSample struct {
+	numGC        uint32
+	pauseTotalNs uint64
 }
 
+// ReadMemStats reads the allocator and garbage collector statistics. It is a
+// variable so that tests can substitute a fake source.
+var ReadMemStats = runtime.ReadMemStats
+
 func NewRuntimeStats(emitter EventEmitter, interval time.Duration) *RuntimeStats {
+	markProcessStart()
 	return &RuntimeStats{
 		emitter:  emitter,
 		interval: interval,
 	}
 }
 
+// SetAllowedMetrics limits the emitted metrics to those with the given
+// names, such as "numGoRoutines" or "memoryStats.numBytesAllocatedHeap".
+// Calling it with no names restores the default of emitting every metric. It
+// must be called before Run.
+func (rs *RuntimeStats) SetAllowedMetrics(names ...string) {
+	if len(names) == 0 {
+		rs.allowedMetrics = nil
+		return
+	}
+
+	rs.allowedMetrics = make(map[string]bool, len(names))
+	for _, name := range names {
+		rs.allowedMetrics[name] = true
+	}
+}
+
+// AddCollector registers a Collector whose gauges are emitted on every
+// interval, after the built-in metrics and subject to SetAllowedMetrics. It
+// must be called before Run.
+func (rs *RuntimeStats) AddCollector(collector Collector) {
+	rs.collectors = append(rs.collectors, collector)
+}
+
 func (rs *RuntimeStats) Run(stopChan <-chan struct{}) {
 	ticker := time.NewTicker(rs.interval)
 	defer ticker.Stop()
 	for {
 		rs.emit("numCPUS", float64(runtime.NumCPU()))
 		rs.emit("numGoRoutines", float64(runtime.NumGoroutine()))
-		rs.emitMemMetrics()
+		// Reading the memory statistics stops the world, so they are read
+		// once per interval and shared with the collectors.
+		stats := new(runtime.MemStats)
+		ReadMemStats(stats)
+		rs.emitMemMetrics(stats)
+		rs.emitCPUMetrics()
+		rs.emitCollectedMetrics(stats)
 
 		select {
 		case <-ticker.C:
@@ -41,23 +84,84 @@ func (rs *RuntimeStats) Run(stopChan <-chan struct{}) {
 	}
 }
 
-func (rs *RuntimeStats) emitMemMetrics() {
-	stats := new(runtime.MemStats)
-	runtime.ReadMemStats(stats)
-
+func (rs *RuntimeStats) emitMemMetrics(stats *runtime.MemStats) {
 	rs.emit("memoryStats.numBytesAllocatedHeap", float64(stats.HeapAlloc))
 	rs.emit("memoryStats.numBytesAllocatedStack", float64(stats.StackInuse))
 	rs.emit("memoryStats.numBytesAllocated", float64(stats.Alloc))
 	rs.emit("memoryStats.numMallocs", float64(stats.Mallocs))
 	rs.emit("memoryStats.numFrees", float64(stats.Frees))
 	rs.emit("memoryStats.lastGCPauseTimeNS", float64(stats.PauseNs[(stats.NumGC+255)%256]))
+	rs.emit("memoryStats.numHeapObjects", float64(stats.HeapObjects))
+	rs.emit("memoryStats.numBytesReleasedHeap", float64(stats.HeapReleased))
+	rs.emitGCMetrics(stats)
+}
+
+// emitGCMetrics emits the number of completed GC cycles and their total pause
+// time, along with the average pause of the cycles completed since the
+// previous sample. The average is not emitted for the first sample, or when
+// no cycle completed in between.
+func (rs *RuntimeStats) emitGCMetrics(stats *runtime.MemStats) {
+	rs.emit("memoryStats.numGC", float64(stats.NumGC))
+	rs.emit("memoryStats.pauseTotalNS", float64(stats.PauseTotalNs))
+
+	previous := rs.lastGCSample
+	rs.lastGCSample = &gcSample{numGC: stats.NumGC, pauseTotalNs: stats.PauseTotalNs}
+	if previous == nil || stats.NumGC <= previous.numGC {
+		return
+	}
+
+	cycles := stats.NumGC - previous.numGC
+	rs.emit("memoryStats.averageGCPauseTimeNS", float64(stats.PauseTotalNs-previous.pauseTotalNs)/float64(cycles))
+}
+
+// emitCPUMetrics emits the process CPU usage since the previous sample as
+// a percentage of the time available on all CPUs. Nothing is emitted for the
+// first sample, or on platforms where CPU usage cannot be read.
+func (rs *RuntimeStats) emitCPUMetrics() {
+	sample, err := SampleCPU()
+	if err != nil {
+		if err != errCPUUnsupported {
+			log.Printf("RuntimeStats: failed to sample CPU usage: %v", err)
+		}
+		return
+	}
+
+	previous := rs.lastCPUSample
+	rs.lastCPUSample = &sample
+	if previous == nil {
+		return
+	}
+
+	if percent, ok := cpuPercent(*previous, sample, runtime.NumCPU()); ok {
+		rs.emitWithUnit("cpuStats.processCpuPercent", percent, "percent")
+	}
+}
+
+func (rs *RuntimeStats) emitCollectedMetrics(stats *runtime.MemStats) {
+	for _, collector := range rs.collectors {
+		for _, gauge := range collector.Collect(stats) {
+			unit := gauge.Unit
+			if unit == "" {
+				unit = "count"
+			}
+			rs.emitWithUnit(gauge.Name, gauge.Value, unit)
+		}
+	}
 }
 
 func (rs *RuntimeStats) emit(name string, value float64) {
+	rs.emitWithUnit(name, value, "count")
+}
+
+func (rs *RuntimeStats) emitWithUnit(name string, value float64, unit string) {
+	if rs.allowedMetrics != nil && !rs.allowedMetrics[name] {
+		return
+	}
+
 	err := rs.emitter.Emit(&events.ValueMetric{
 		Name:  &name,
 		Value: &value,
-		Unit:  proto.String("count"),
+		Unit:  &unit,
 	})
 	if err != nil {
 		log.Printf("RuntimeStats: failed to emit: %v", err)
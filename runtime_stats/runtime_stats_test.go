@@ -5,6 +5,7 @@ import (
 
 	"errors"
 	"log"
+	"os"
 	"runtime"
 	"time"
 
@@ -15,6 +16,12 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+var (
+	defaultSampleCPU    = runtime_stats.SampleCPU
+	defaultReadMemStats = runtime_stats.ReadMemStats
+	defaultCountOpenFDs = runtime_stats.CountOpenFDs
+)
+
 var _ = Describe("RuntimeStats", func() {
 	var (
 		fakeEventEmitter  *fake.FakeEventEmitter
@@ -32,6 +39,10 @@ var _ = Describe("RuntimeStats", func() {
 	AfterEach(func() {
 		close(stopChan)
 		Eventually(runDone).Should(BeClosed())
+		runtime_stats.SampleCPU = defaultSampleCPU
+		runtime_stats.ReadMemStats = defaultReadMemStats
+		runtime_stats.CountOpenFDs = defaultCountOpenFDs
+		log.SetOutput(os.Stderr)
 	})
 
 	var perform = func() {
@@ -80,6 +91,276 @@ var _ = Describe("RuntimeStats", func() {
 		Eventually(getMetricNames).Should(ContainElement("memoryStats.numMallocs"))
 		Eventually(getMetricNames).Should(ContainElement("memoryStats.numFrees"))
 		Eventually(getMetricNames).Should(ContainElement("memoryStats.lastGCPauseTimeNS"))
+		Eventually(getMetricNames).Should(ContainElement("memoryStats.numHeapObjects"))
+		Eventually(getMetricNames).Should(ContainElement("memoryStats.numBytesReleasedHeap"))
+		Eventually(getMetricNames).Should(ContainElement("memoryStats.numGC"))
+		Eventually(getMetricNames).Should(ContainElement("memoryStats.pauseTotalNS"))
+	})
+
+	Describe("garbage collection", func() {
+		var samples []runtime.MemStats
+
+		getValues := func(name string) []float64 {
+			var values []float64
+			for _, event := range fakeEventEmitter.GetEvents() {
+				metric := event.(*events.ValueMetric)
+				if metric.GetName() == name {
+					values = append(values, metric.GetValue())
+				}
+			}
+			return values
+		}
+
+		BeforeEach(func() {
+			samples = nil
+			runtime_stats.ReadMemStats = func(stats *runtime.MemStats) {
+				*stats = samples[0]
+				if len(samples) > 1 {
+					samples = samples[1:]
+				}
+			}
+		})
+
+		It("emits the GC counters and heap statistics on each interval", func() {
+			samples = []runtime.MemStats{
+				{NumGC: 10, PauseTotalNs: 1000, HeapObjects: 50, HeapReleased: 4096},
+				{NumGC: 14, PauseTotalNs: 3000, HeapObjects: 70, HeapReleased: 8192},
+			}
+			perform()
+
+			Eventually(func() int { return len(getValues("memoryStats.numGC")) }).Should(BeNumerically(">=", 2))
+			Expect(getValues("memoryStats.numGC")[:2]).To(Equal([]float64{10, 14}))
+			Expect(getValues("memoryStats.pauseTotalNS")[:2]).To(Equal([]float64{1000, 3000}))
+			Expect(getValues("memoryStats.numHeapObjects")[:2]).To(Equal([]float64{50, 70}))
+			Expect(getValues("memoryStats.numBytesReleasedHeap")[:2]).To(Equal([]float64{4096, 8192}))
+		})
+
+		It("emits the average pause of the cycles completed since the previous interval", func() {
+			samples = []runtime.MemStats{
+				{NumGC: 10, PauseTotalNs: 1000},
+				{NumGC: 14, PauseTotalNs: 3000},
+				{NumGC: 15, PauseTotalNs: 3600},
+			}
+			perform()
+
+			Eventually(func() []float64 { return getValues("memoryStats.averageGCPauseTimeNS") }).Should(HaveLen(2))
+			Expect(getValues("memoryStats.averageGCPauseTimeNS")).To(Equal([]float64{500, 600}))
+		})
+
+		It("does not emit an average pause for the first interval or intervals without a cycle", func() {
+			samples = []runtime.MemStats{{NumGC: 10, PauseTotalNs: 1000}}
+			perform()
+
+			Eventually(func() int { return len(getValues("memoryStats.numGC")) }).Should(BeNumerically(">=", 3))
+			Expect(getValues("memoryStats.averageGCPauseTimeNS")).To(BeEmpty())
+		})
+	})
+
+	Describe("SetAllowedMetrics", func() {
+		It("only emits the allowed metrics", func() {
+			runtimeStats.SetAllowedMetrics("numGoRoutines", "memoryStats.numBytesAllocatedHeap", "memoryStats.lastGCPauseTimeNS")
+			perform()
+
+			Eventually(func() int { return len(fakeEventEmitter.GetMessages()) }).Should(BeNumerically(">=", 6))
+			allowed := []string{"numGoRoutines", "memoryStats.numBytesAllocatedHeap", "memoryStats.lastGCPauseTimeNS"}
+			for _, name := range getMetricNames() {
+				Expect(allowed).To(ContainElement(name))
+			}
+			Expect(getMetricNames()).To(ContainElement("memoryStats.lastGCPauseTimeNS"))
+		})
+
+		It("emits every metric when the list is empty", func() {
+			runtimeStats.SetAllowedMetrics("numGoRoutines")
+			runtimeStats.SetAllowedMetrics()
+			perform()
+
+			Eventually(getMetricNames).Should(ContainElement("numCPUS"))
+			Eventually(getMetricNames).Should(ContainElement("memoryStats.numFrees"))
+		})
+	})
+
+	Describe("process CPU usage", func() {
+		var results []interface{}
+
+		getCPUMetrics := func() []*events.ValueMetric {
+			var metrics []*events.ValueMetric
+			for _, event := range fakeEventEmitter.GetEvents() {
+				metric := event.(*events.ValueMetric)
+				if metric.GetName() == "cpuStats.processCpuPercent" {
+					metrics = append(metrics, metric)
+				}
+			}
+			return metrics
+		}
+
+		BeforeEach(func() {
+			log.SetOutput(GinkgoWriter)
+			results = nil
+			runtime_stats.SampleCPU = func() (runtime_stats.CPUSample, error) {
+				if len(results) == 0 {
+					return runtime_stats.CPUSample{}, errors.New("no more samples")
+				}
+				result := results[0]
+				results = results[1:]
+				if err, ok := result.(error); ok {
+					return runtime_stats.CPUSample{}, err
+				}
+				return result.(runtime_stats.CPUSample), nil
+			}
+		})
+
+		It("emits the CPU percentage across all CPUs since the previous sample", func() {
+			start := time.Now()
+			numCPU := time.Duration(runtime.NumCPU())
+			results = []interface{}{
+				runtime_stats.CPUSample{Wall: start, CPU: time.Second},
+				runtime_stats.CPUSample{Wall: start.Add(2 * time.Second), CPU: time.Second + numCPU*500*time.Millisecond},
+				runtime_stats.CPUSample{Wall: start.Add(3 * time.Second), CPU: time.Second + numCPU*1250*time.Millisecond},
+			}
+			perform()
+
+			Eventually(getCPUMetrics).Should(HaveLen(2))
+			metrics := getCPUMetrics()
+			Expect(metrics[0].GetValue()).To(BeNumerically("~", 25, 1e-9))
+			Expect(metrics[0].GetUnit()).To(Equal("percent"))
+			Expect(metrics[1].GetValue()).To(BeNumerically("~", 75, 1e-9))
+		})
+
+		It("does not emit for the first sample", func() {
+			results = []interface{}{runtime_stats.CPUSample{Wall: time.Now(), CPU: time.Second}}
+			perform()
+
+			Consistently(getCPUMetrics).Should(BeEmpty())
+		})
+
+		It("skips failed samples and measures from the last good one", func() {
+			start := time.Now()
+			numCPU := time.Duration(runtime.NumCPU())
+			results = []interface{}{
+				runtime_stats.CPUSample{Wall: start, CPU: 0},
+				errors.New("sample failed"),
+				runtime_stats.CPUSample{Wall: start.Add(4 * time.Second), CPU: numCPU * time.Second},
+			}
+			perform()
+
+			Eventually(getCPUMetrics).Should(HaveLen(1))
+			Expect(getCPUMetrics()[0].GetValue()).To(BeNumerically("~", 25, 1e-9))
+		})
+	})
+
+	Describe("collectors", func() {
+		getValues := func(name string) []float64 {
+			var values []float64
+			for _, event := range fakeEventEmitter.GetEvents() {
+				metric := event.(*events.ValueMetric)
+				if metric.GetName() == name {
+					values = append(values, metric.GetValue())
+				}
+			}
+			return values
+		}
+
+		It("emits the gauges of registered collectors on each interval", func() {
+			var calls float64
+			runtimeStats.AddCollector(runtime_stats.CollectorFunc(func(*runtime.MemStats) []runtime_stats.Gauge {
+				calls++
+				return []runtime_stats.Gauge{
+					{Name: "custom.calls", Value: calls},
+					{Name: "custom.latency", Value: 1.5, Unit: "ms"},
+				}
+			}))
+			perform()
+
+			Eventually(func() int { return len(getValues("custom.calls")) }).Should(BeNumerically(">=", 2))
+			Expect(getValues("custom.calls")[:2]).To(Equal([]float64{1, 2}))
+			Expect(fakeEventEmitter.GetEvents()).To(ContainElement(&events.ValueMetric{
+				Name:  proto.String("custom.latency"),
+				Value: proto.Float64(1.5),
+				Unit:  proto.String("ms"),
+			}))
+		})
+
+		It("applies the allowed metrics to collected gauges", func() {
+			runtimeStats.SetAllowedMetrics("numCPUS", "custom.allowed")
+			runtimeStats.AddCollector(runtime_stats.CollectorFunc(func(*runtime.MemStats) []runtime_stats.Gauge {
+				return []runtime_stats.Gauge{{Name: "custom.allowed"}, {Name: "custom.denied"}}
+			}))
+			perform()
+
+			Eventually(getMetricNames).Should(ContainElement("custom.allowed"))
+			Expect(getMetricNames()).ToNot(ContainElement("custom.denied"))
+		})
+
+		It("emits GC pause percentiles for the cycles completed since the previous interval", func() {
+			first := runtime.MemStats{NumGC: 4}
+			for i := uint64(1); i <= 4; i++ {
+				first.PauseNs[i-1] = i * 100
+			}
+			second := first
+			second.NumGC = 6
+			second.PauseNs[4] = 10000
+			second.PauseNs[5] = 20000
+			samples := []runtime.MemStats{first, second}
+			runtime_stats.ReadMemStats = func(stats *runtime.MemStats) {
+				*stats = samples[0]
+				if len(samples) > 1 {
+					samples = samples[1:]
+				}
+			}
+			runtimeStats.AddCollector(runtime_stats.NewGCPauseCollector())
+			perform()
+
+			Eventually(func() []float64 { return getValues("memoryStats.gcPauseP99NS") }).Should(HaveLen(2))
+			Consistently(func() []float64 { return getValues("memoryStats.gcPauseP99NS") }).Should(HaveLen(2))
+			Expect(getValues("memoryStats.gcPauseP50NS")).To(Equal([]float64{200, 10000}))
+			Expect(getValues("memoryStats.gcPauseP95NS")).To(Equal([]float64{400, 20000}))
+			Expect(getValues("memoryStats.gcPauseP99NS")).To(Equal([]float64{400, 20000}))
+		})
+
+		It("emits heap statistics", func() {
+			runtime_stats.ReadMemStats = func(stats *runtime.MemStats) {
+				*stats = runtime.MemStats{HeapInuse: 4096, HeapIdle: 1024, HeapSys: 8192}
+			}
+			runtimeStats.AddCollector(runtime_stats.NewHeapCollector())
+			perform()
+
+			Eventually(func() []float64 { return getValues("memoryStats.numBytesInUseHeap") }).ShouldNot(BeEmpty())
+			Expect(getValues("memoryStats.numBytesInUseHeap")[0]).To(BeEquivalentTo(4096))
+			Expect(getValues("memoryStats.numBytesIdleHeap")[0]).To(BeEquivalentTo(1024))
+			Expect(getValues("memoryStats.numBytesSysHeap")[0]).To(BeEquivalentTo(8192))
+		})
+
+		It("emits the number of open file descriptors", func() {
+			runtime_stats.CountOpenFDs = func() (int, error) { return 42, nil }
+			runtimeStats.AddCollector(runtime_stats.NewOpenFDsCollector())
+			perform()
+
+			Eventually(func() []float64 { return getValues("processStats.numOpenFileDescriptors") }).Should(ContainElement(BeEquivalentTo(42)))
+		})
+
+		It("does not emit open file descriptors when they cannot be counted", func() {
+			runtime_stats.CountOpenFDs = func() (int, error) { return 0, errors.New("unsupported") }
+			runtimeStats.AddCollector(runtime_stats.NewOpenFDsCollector())
+			perform()
+
+			Eventually(getMetricNames).Should(ContainElement("numCPUS"))
+			Consistently(getMetricNames).ShouldNot(ContainElement("processStats.numOpenFileDescriptors"))
+		})
+
+		It("emits the process uptime in seconds", func() {
+			runtimeStats.AddCollector(runtime_stats.NewUptimeCollector())
+			perform()
+
+			Eventually(func() []float64 { return getValues("processStats.uptime") }).ShouldNot(BeEmpty())
+			var uptime *events.ValueMetric
+			for _, event := range fakeEventEmitter.GetEvents() {
+				if metric := event.(*events.ValueMetric); metric.GetName() == "processStats.uptime" {
+					uptime = metric
+				}
+			}
+			Expect(uptime.GetValue()).To(BeNumerically(">", 0))
+			Expect(uptime.GetUnit()).To(Equal("s"))
+		})
 	})
 
 	It("logs an error if emitting fails", func() {
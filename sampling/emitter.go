@@ -0,0 +1,62 @@
+package sampling
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type EventEmitter interface {
+	Emit(events.Event) error
+	EmitEnvelope(*events.Envelope) error
+	Origin() string
+}
+
+// An Emitter wraps an EventEmitter and only forwards the envelopes its
+// sampler keeps. Envelopes that are sampled out are counted.
+type Emitter struct {
+	innerEmitter EventEmitter
+	sampler      Sampler
+}
+
+// NewEmitter creates an Emitter that samples envelopes before forwarding them
+// to innerEmitter.
+func NewEmitter(innerEmitter EventEmitter, sampler Sampler) *Emitter {
+	return &Emitter{innerEmitter: innerEmitter, sampler: sampler}
+}
+
+func (e *Emitter) Origin() string {
+	return e.innerEmitter.Origin()
+}
+
+func (e *Emitter) Emit(event events.Event) error {
+	envelope, err := emitter.Wrap(event, e.innerEmitter.Origin())
+	if err != nil {
+		return err
+	}
+	return e.EmitEnvelope(envelope)
+}
+
+func (e *Emitter) EmitEnvelope(envelope *events.Envelope) error {
+	if !e.sample(envelope) {
+		return nil
+	}
+	return e.innerEmitter.EmitEnvelope(envelope)
+}
+
+func (e *Emitter) sample(envelope *events.Envelope) bool {
+	if e.sampler.Sample(envelope) {
+		return true
+	}
+	metrics.BatchIncrementCounter("samplingEmitter.sampledOut")
+	emitter.CountDrop(emitter.DropSampled)
+	return false
+}
+
+func (e *Emitter) Describe() []emitter.StageDescription {
+	return emitter.DescribeStage(e, map[string]interface{}{
+		"sampler": fmt.Sprintf("%T", e.sampler),
+	}, nil, e.innerEmitter)
+}
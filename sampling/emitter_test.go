@@ -0,0 +1,88 @@
+package sampling_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry/dropsonde/emitter/fake"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/instrumented_handler"
+	"github.com/cloudfoundry/dropsonde/log_sender"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/dropsonde/sampling"
+	"github.com/cloudfoundry/sonde-go/events"
+	uuid "github.com/nu7hatch/gouuid"
+
+	. "github.com/apoydence/eachers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Emitter", func() {
+	var (
+		fakeEmitter    *fake.FakeEventEmitter
+		mockBatcher    *mockMetricBatcher
+		keptAppId      string
+		droppedAppId   string
+		sampledEmitter *sampling.Emitter
+	)
+
+	BeforeEach(func() {
+		fakeEmitter = fake.NewFakeEventEmitter("origin")
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+
+		sampler := sampling.SamplerFunc(func(envelope *events.Envelope) bool {
+			return sampling.AppIDKey(envelope) != droppedAppId
+		})
+		sampledEmitter = sampling.NewEmitter(fakeEmitter, sampler)
+
+		kept, _ := uuid.NewV4()
+		dropped, _ := uuid.NewV4()
+		keptAppId, droppedAppId = kept.String(), dropped.String()
+	})
+
+	It("applies one sampler to both HTTP and log events", func() {
+		handler := instrumented_handler.InstrumentedHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), sampledEmitter)
+		logSender := log_sender.NewLogSender(sampledEmitter)
+
+		for _, appId := range []string{keptAppId, droppedAppId} {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			req.Header.Set("X-CF-ApplicationID", appId)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(logSender.SendAppLog(appId, "hello", "App", "0")).To(Succeed())
+		}
+
+		var httpAppIds, logAppIds []string
+		for _, envelope := range fakeEmitter.GetEnvelopes() {
+			switch envelope.GetEventType() {
+			case events.Envelope_HttpStartStop:
+				httpAppIds = append(httpAppIds, sampling.AppIDKey(envelope))
+			case events.Envelope_LogMessage:
+				logAppIds = append(logAppIds, envelope.GetLogMessage().GetAppId())
+			}
+		}
+		Expect(httpAppIds).To(Equal([]string{keptAppId}))
+		Expect(logAppIds).To(Equal([]string{keptAppId}))
+	})
+
+	It("forwards sampled envelopes and counts the rest", func() {
+		Expect(sampledEmitter.EmitEnvelope(&events.Envelope{
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: factories.NewLogMessage(events.LogMessage_OUT, "hello", keptAppId, "App"),
+		})).To(Succeed())
+		Expect(sampledEmitter.EmitEnvelope(&events.Envelope{
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: factories.NewLogMessage(events.LogMessage_OUT, "hello", droppedAppId, "App"),
+		})).To(Succeed())
+
+		Expect(fakeEmitter.GetEnvelopes()).To(HaveLen(1))
+		Expect(fakeEmitter.GetEnvelopes()[0].GetLogMessage().GetAppId()).To(Equal(keptAppId))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(With("samplingEmitter.sampledOut")))
+	})
+
+	It("returns the inner emitter's origin", func() {
+		Expect(sampledEmitter.Origin()).To(Equal("origin"))
+	})
+})
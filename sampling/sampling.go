@@ -0,0 +1,149 @@
+// Package sampling provides a common interface for deciding which envelopes
+// are emitted, along with a few built-in samplers and an emitter that applies
+// them.
+//
+// Use
+//
+// Every emission path (InstrumentedHandler, InstrumentedRoundTripper, the
+// log sender and the metric sender) writes through an event emitter, so a
+// sampler applies to any of them by wrapping that emitter:
+//
+//		sampler := sampling.NewStatusSampler(500, sampling.NewRateSampler(0.01, time.Now().UnixNano()))
+//		httpSampler := sampling.ForEventType(events.Envelope_HttpStartStop, sampler)
+//		sampledEmitter := sampling.NewEmitter(eventEmitter, httpSampler)
+//		handler := instrumented_handler.InstrumentedHandler(myHandler, sampledEmitter)
+//
+// Use dropsonde.WithSampler to sample everything sent through the default
+// emitter, or dropsonde.WithHTTPSampler and dropsonde.WithLogSampler to sample
+// only HTTP events or only log messages.
+package sampling
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/envelope_extensions"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// A Sampler decides whether an envelope should be emitted. Samplers see every
+// envelope sent through the emitter they are attached to, and must be safe
+// for concurrent use.
+type Sampler interface {
+	Sample(*events.Envelope) bool
+}
+
+// SamplerFunc adapts an ordinary function to the Sampler interface.
+type SamplerFunc func(*events.Envelope) bool
+
+func (f SamplerFunc) Sample(envelope *events.Envelope) bool {
+	return f(envelope)
+}
+
+// ForEventType applies sampler only to envelopes of the given type; all other
+// envelopes are kept.
+func ForEventType(eventType events.Envelope_EventType, sampler Sampler) Sampler {
+	return SamplerFunc(func(envelope *events.Envelope) bool {
+		if envelope.GetEventType() != eventType {
+			return true
+		}
+		return sampler.Sample(envelope)
+	})
+}
+
+type rateSampler struct {
+	rate float64
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewRateSampler keeps each envelope independently with the given
+// probability, in the range [0, 1]. Samplers created with the same seed make
+// the same sequence of decisions.
+func NewRateSampler(rate float64, seed int64) Sampler {
+	return &rateSampler{rate: rate, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (s *rateSampler) Sample(*events.Envelope) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rand.Float64() < s.rate
+}
+
+type statusSampler struct {
+	minStatusCode int32
+	otherwise     Sampler
+}
+
+// NewStatusSampler keeps every HttpStartStop event whose status code is at
+// least minStatusCode, and leaves the decision for the remaining HTTP events
+// to otherwise. If otherwise is nil they are dropped. Envelopes that are not
+// HttpStartStop events are always kept.
+func NewStatusSampler(minStatusCode int, otherwise Sampler) Sampler {
+	return &statusSampler{minStatusCode: int32(minStatusCode), otherwise: otherwise}
+}
+
+func (s *statusSampler) Sample(envelope *events.Envelope) bool {
+	httpStartStop := envelope.GetHttpStartStop()
+	if httpStartStop == nil || httpStartStop.GetStatusCode() >= s.minStatusCode {
+		return true
+	}
+	if s.otherwise == nil {
+		return false
+	}
+	return s.otherwise.Sample(envelope)
+}
+
+type keySampler struct {
+	threshold uint64
+	key       func(*events.Envelope) string
+}
+
+// NewKeySampler deterministically keeps the given share, in the range
+// [0, 1], of the keys returned by key. Every envelope with the same key gets
+// the same decision, on every process, so related events are kept or dropped
+// together. Envelopes with an empty key are always kept.
+func NewKeySampler(rate float64, key func(*events.Envelope) string) Sampler {
+	return &keySampler{threshold: uint64(math.Max(0, math.Min(1, rate)) * (1 << 32)), key: key}
+}
+
+func (s *keySampler) Sample(envelope *events.Envelope) bool {
+	key := s.key(envelope)
+	if key == "" {
+		return true
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return uint64(hash.Sum32()) < s.threshold
+}
+
+// AppIDKey returns the application ID of HttpStartStop, LogMessage and
+// ContainerMetric events in a common format, for use with NewKeySampler. It
+// returns an empty string for events without one.
+func AppIDKey(envelope *events.Envelope) string {
+	appID := envelope_extensions.GetAppId(envelope)
+	if appID == envelope_extensions.SystemAppId {
+		return ""
+	}
+	return appID
+}
+
+// RequestIDKey returns the request ID of HttpStartStop events, formatted as
+// in the X-Vcap-Request-Id header, for use with NewKeySampler. It returns an
+// empty string for other events.
+func RequestIDKey(envelope *events.Envelope) string {
+	return envelope_extensions.GetRequestId(envelope)
+}
+
+// NewRequestSampler keeps the given share, in the range [0, 1], of
+// HttpStartStop events, deciding from a hash of the request ID alone. The
+// instrumented handler and round tripper propagate the request ID in the
+// X-Vcap-Request-Id header, so every component sampling at the same rate keeps
+// or drops all hops of a request together. Other envelopes are always kept.
+func NewRequestSampler(rate float64) Sampler {
+	return ForEventType(events.Envelope_HttpStartStop, NewKeySampler(rate, RequestIDKey))
+}
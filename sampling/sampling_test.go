@@ -0,0 +1,174 @@
+package sampling_test
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/dropsonde/sampling"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	uuid "github.com/nu7hatch/gouuid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Samplers", func() {
+	httpEnvelope := func(statusCode int) *events.Envelope {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		requestId, _ := uuid.NewV4()
+		return &events.Envelope{
+			Origin:        proto.String("origin"),
+			EventType:     events.Envelope_HttpStartStop.Enum(),
+			HttpStartStop: factories.NewHttpStartStop(req, statusCode, 0, events.PeerType_Server, requestId),
+		}
+	}
+
+	logEnvelope := func(appId string) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String("origin"),
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: factories.NewLogMessage(events.LogMessage_OUT, "hello", appId, "App"),
+		}
+	}
+
+	Describe("NewRateSampler", func() {
+		It("keeps envelopes at the configured rate", func() {
+			sampler := sampling.NewRateSampler(0.25, 1)
+
+			var kept int
+			for i := 0; i < 10000; i++ {
+				if sampler.Sample(logEnvelope("app")) {
+					kept++
+				}
+			}
+			Expect(kept).To(BeNumerically("~", 2500, 200))
+		})
+
+		It("keeps everything at a rate of one and nothing at zero", func() {
+			Expect(sampling.NewRateSampler(1, 1).Sample(logEnvelope("app"))).To(BeTrue())
+			Expect(sampling.NewRateSampler(0, 1).Sample(logEnvelope("app"))).To(BeFalse())
+		})
+	})
+
+	Describe("NewStatusSampler", func() {
+		It("keeps HTTP events at or above the status code", func() {
+			sampler := sampling.NewStatusSampler(500, nil)
+
+			Expect(sampler.Sample(httpEnvelope(500))).To(BeTrue())
+			Expect(sampler.Sample(httpEnvelope(503))).To(BeTrue())
+			Expect(sampler.Sample(httpEnvelope(200))).To(BeFalse())
+		})
+
+		It("defers other HTTP events to the fallback sampler", func() {
+			sampler := sampling.NewStatusSampler(500, sampling.NewRateSampler(1, 1))
+
+			Expect(sampler.Sample(httpEnvelope(200))).To(BeTrue())
+		})
+
+		It("keeps envelopes that are not HTTP events", func() {
+			sampler := sampling.NewStatusSampler(500, nil)
+
+			Expect(sampler.Sample(logEnvelope("app"))).To(BeTrue())
+		})
+	})
+
+	Describe("NewKeySampler", func() {
+		It("makes the same decision for the same key", func() {
+			sampler := sampling.NewKeySampler(0.5, sampling.AppIDKey)
+
+			for i := 0; i < 100; i++ {
+				appId := fmt.Sprintf("app-%d", i)
+				first := sampler.Sample(logEnvelope(appId))
+				for j := 0; j < 5; j++ {
+					Expect(sampler.Sample(logEnvelope(appId))).To(Equal(first))
+				}
+			}
+		})
+
+		It("keeps roughly the configured share of keys", func() {
+			sampler := sampling.NewKeySampler(0.3, sampling.AppIDKey)
+
+			var kept int
+			for i := 0; i < 10000; i++ {
+				if sampler.Sample(logEnvelope(fmt.Sprintf("app-%d", i))) {
+					kept++
+				}
+			}
+			Expect(kept).To(BeNumerically("~", 3000, 300))
+		})
+
+		It("keeps envelopes without a key", func() {
+			sampler := sampling.NewKeySampler(0, sampling.AppIDKey)
+
+			Expect(sampler.Sample(httpEnvelope(200))).To(BeTrue())
+			Expect(sampler.Sample(logEnvelope("app"))).To(BeFalse())
+		})
+	})
+
+	Describe("AppIDKey", func() {
+		It("formats HTTP and log application IDs the same way", func() {
+			appId, _ := uuid.NewV4()
+			envelope := httpEnvelope(200)
+			envelope.HttpStartStop.ApplicationId = factories.NewUUID(appId)
+
+			Expect(sampling.AppIDKey(envelope)).To(Equal(appId.String()))
+			Expect(sampling.AppIDKey(logEnvelope(appId.String()))).To(Equal(appId.String()))
+		})
+	})
+
+	Describe("NewRequestSampler", func() {
+		It("makes the same decision for a request ID on every instance", func() {
+			first := sampling.NewRequestSampler(0.5)
+			second := sampling.NewRequestSampler(0.5)
+
+			for i := 0; i < 100; i++ {
+				envelope := httpEnvelope(200)
+				hop := httpEnvelope(503)
+				hop.HttpStartStop.RequestId = envelope.HttpStartStop.RequestId
+
+				Expect(second.Sample(hop)).To(Equal(first.Sample(envelope)))
+			}
+		})
+
+		It("keeps roughly the configured share of requests", func() {
+			sampler := sampling.NewRequestSampler(0.3)
+
+			var kept int
+			for i := 0; i < 10000; i++ {
+				if sampler.Sample(httpEnvelope(200)) {
+					kept++
+				}
+			}
+			Expect(kept).To(BeNumerically("~", 3000, 300))
+		})
+
+		It("keeps envelopes that are not HTTP events", func() {
+			sampler := sampling.NewRequestSampler(0)
+
+			Expect(sampler.Sample(httpEnvelope(200))).To(BeFalse())
+			Expect(sampler.Sample(logEnvelope("app"))).To(BeTrue())
+		})
+	})
+
+	Describe("RequestIDKey", func() {
+		It("formats the request ID as in the X-Vcap-Request-Id header", func() {
+			requestId, _ := uuid.NewV4()
+			envelope := httpEnvelope(200)
+			envelope.HttpStartStop.RequestId = factories.NewUUID(requestId)
+
+			Expect(sampling.RequestIDKey(envelope)).To(Equal(requestId.String()))
+			Expect(sampling.RequestIDKey(logEnvelope("app"))).To(BeEmpty())
+		})
+	})
+
+	Describe("ForEventType", func() {
+		It("only applies the sampler to the given event type", func() {
+			sampler := sampling.ForEventType(events.Envelope_HttpStartStop, sampling.NewRateSampler(0, 1))
+
+			Expect(sampler.Sample(httpEnvelope(200))).To(BeFalse())
+			Expect(sampler.Sample(logEnvelope("app"))).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,39 @@
+package signature_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/cloudfoundry/dropsonde/signature"
+)
+
+var benchmarkMessage = make([]byte, 512)
+
+func BenchmarkSignMessage(b *testing.B) {
+	secret := []byte("benchmark-secret")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		signature.SignMessage(benchmarkMessage, secret)
+	}
+}
+
+func BenchmarkSignMessageUnpooled(b *testing.B) {
+	secret := []byte("benchmark-secret")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(benchmarkMessage)
+		_ = append(mac.Sum(nil), benchmarkMessage...)
+	}
+}
+
+func BenchmarkSignMessageParallel(b *testing.B) {
+	secret := []byte("benchmark-secret")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			signature.SignMessage(benchmarkMessage, secret)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package signature_test
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"sync"
 
 	. "github.com/apoydence/eachers"
 	. "github.com/onsi/ginkgo"
@@ -86,3 +87,132 @@ var _ = Describe("Verifier", func() {
 		})
 	})
 })
+
+var _ = Describe("Verifier with multiple secrets", func() {
+	var (
+		inputChan   chan []byte
+		outputChan  chan []byte
+		runComplete chan struct{}
+
+		mockBatcher *mockMetricBatcher
+	)
+
+	BeforeEach(func() {
+		inputChan = make(chan []byte, 10)
+		outputChan = make(chan []byte, 10)
+		runComplete = make(chan struct{})
+
+		mockBatcher = newMockMetricBatcher()
+		metrics.Initialize(nil, mockBatcher)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+		Eventually(runComplete).Should(BeClosed())
+	})
+
+	var run = func(verifier *signature.Verifier) {
+		go func() {
+			verifier.Run(inputChan, outputChan)
+			close(runComplete)
+		}()
+	}
+
+	It("accepts messages signed with any of the secrets", func() {
+		run(signature.NewVerifier("new-secret", "old-secret"))
+
+		inputChan <- signature.SignMessage([]byte{1}, []byte("new-secret"))
+		Eventually(outputChan).Should(Receive(Equal([]byte{1})))
+		inputChan <- signature.SignMessage([]byte{2}, []byte("old-secret"))
+		Eventually(outputChan).Should(Receive(Equal([]byte{2})))
+		inputChan <- signature.SignMessage([]byte{3}, []byte("retired-secret"))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("counts messages signed with a secondary secret", func() {
+		run(signature.NewVerifier("new-secret", "old-secret"))
+
+		inputChan <- signature.SignMessage([]byte{1}, []byte("new-secret"))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("signatureVerifier.validSignatures"),
+		))
+		Consistently(mockBatcher.BatchIncrementCounterInput).ShouldNot(BeCalled())
+
+		inputChan <- signature.SignMessage([]byte{2}, []byte("old-secret"))
+		Eventually(mockBatcher.BatchIncrementCounterInput).Should(BeCalled(
+			With("signatureVerifier.secondarySignatures"),
+		))
+	})
+
+	It("rejects every message without secrets", func() {
+		run(signature.NewVerifier())
+
+		inputChan <- signature.SignMessage([]byte{1}, []byte(""))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("SignMessage", func() {
+	expectedSignature := func(message, secret []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(message)
+		return mac.Sum(nil)
+	}
+
+	It("prepends the signature to the message", func() {
+		message := []byte{1, 2, 3}
+		signedMessage := signature.SignMessage(message, []byte("secret"))
+
+		Expect(signedMessage).To(HaveLen(signature.SIGNATURE_LENGTH + len(message)))
+		Expect(signedMessage[:signature.SIGNATURE_LENGTH]).To(Equal(expectedSignature(message, []byte("secret"))))
+		Expect(signedMessage[signature.SIGNATURE_LENGTH:]).To(Equal(message))
+	})
+
+	It("signs with the current secret across key rotations", func() {
+		message := []byte("some message")
+		for _, secret := range []string{"key-1", "key-2", "key-1", "key-1", "key-3"} {
+			signedMessage := signature.SignMessage(message, []byte(secret))
+			Expect(signedMessage[:signature.SIGNATURE_LENGTH]).To(Equal(expectedSignature(message, []byte(secret))))
+		}
+	})
+
+	It("signs correctly when used concurrently with different secrets", func() {
+		secrets := []string{"key-1", "key-2", "key-3"}
+		var wg sync.WaitGroup
+		results := make(chan bool, 300)
+		for i := 0; i < 300; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				secret := []byte(secrets[i%len(secrets)])
+				message := []byte{byte(i)}
+				signedMessage := signature.SignMessage(message, secret)
+				results <- hmac.Equal(signedMessage[:signature.SIGNATURE_LENGTH], expectedSignature(message, secret))
+			}(i)
+		}
+		wg.Wait()
+		close(results)
+
+		for result := range results {
+			Expect(result).To(BeTrue())
+		}
+	})
+
+	It("produces messages the verifier accepts", func() {
+		metrics.Initialize(nil, newMockMetricBatcher())
+		inputChan := make(chan []byte, 1)
+		outputChan := make(chan []byte, 1)
+		runComplete := make(chan struct{})
+		verifier := signature.NewVerifier("shared-secret")
+		go func() {
+			verifier.Run(inputChan, outputChan)
+			close(runComplete)
+		}()
+
+		inputChan <- signature.SignMessage([]byte{4, 5, 6}, []byte("shared-secret"))
+		Eventually(outputChan).Should(Receive(Equal([]byte{4, 5, 6})))
+
+		close(inputChan)
+		Eventually(runComplete).Should(BeClosed())
+	})
+})
@@ -8,7 +8,9 @@ package signature
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"hash"
 	"log"
+	"sync"
 
 	"github.com/cloudfoundry/dropsonde/metrics"
 )
@@ -18,14 +20,20 @@ const SIGNATURE_LENGTH = 32
 // A SignatureVerifier is a self-instrumenting pipeline object that validates
 // and removes signatures.
 type Verifier struct {
-	sharedSecret string
+	sharedSecrets []string
+	hashers       []hmacPool
 }
 
 // NewSignatureVerifier returns a SignatureVerifier with the provided
-// shared signing secret.
-func NewVerifier(sharedSecret string) *Verifier {
+// shared signing secrets, in order of preference. The first is the primary
+// secret, which signers should use; messages signed with any of them are
+// accepted. This lets a secret be rotated gradually: add the new secret as
+// the primary, move signers over to it, then remove the old one. A verifier
+// without secrets rejects every message.
+func NewVerifier(sharedSecrets ...string) *Verifier {
 	return &Verifier{
-		sharedSecret: sharedSecret,
+		sharedSecrets: sharedSecrets,
+		hashers:       make([]hmacPool, len(sharedSecrets)),
 	}
 }
 
@@ -33,6 +41,9 @@ func NewVerifier(sharedSecret string) *Verifier {
 // verifies the signature, and sends the message (sans signature) to outputChan.
 // Invalid messages are dropped and nothing is sent to outputChan. Thus a reader
 // of outputChan is guaranteed to receive only messages with a valid signature.
+// Messages signed with a secret other than the primary are also counted as
+// signatureVerifier.secondarySignatures, so that operators can tell when an
+// old secret is no longer in use.
 //
 // Run blocks on sending to outputChan, so the channel must be drained for the
 // function to continue consuming from inputChan.
@@ -44,29 +55,85 @@ func (v *Verifier) Run(inputChan <-chan []byte, outputChan chan<- []byte) {
 		}
 
 		signature, message := signedMessage[:SIGNATURE_LENGTH], signedMessage[SIGNATURE_LENGTH:]
-		if v.verifyMessage(message, signature) {
-			outputChan <- message
-			metrics.BatchIncrementCounter("signatureVerifier.validSignatures")
-		} else {
+		index := v.verifyMessage(message, signature)
+		if index < 0 {
 			log.Print("signatureVerifier: invalid signature")
+			continue
+		}
+
+		outputChan <- message
+		metrics.BatchIncrementCounter("signatureVerifier.validSignatures")
+		if index > 0 {
+			metrics.BatchIncrementCounter("signatureVerifier.secondarySignatures")
 		}
 	}
 }
 
-func (v *Verifier) verifyMessage(message, signature []byte) bool {
-	expectedMAC := generateSignature(message, []byte(v.sharedSecret))
-	return hmac.Equal(signature, expectedMAC)
+// verifyMessage returns the index of the secret that signature was made
+// with, or -1 if none of them match.
+func (v *Verifier) verifyMessage(message, signature []byte) int {
+	var buffer [SIGNATURE_LENGTH]byte
+	for i, secret := range v.sharedSecrets {
+		expectedMAC := v.hashers[i].sum(buffer[:0], message, []byte(secret))
+		if hmac.Equal(signature, expectedMAC) {
+			return i
+		}
+	}
+	return -1
 }
 
+var signers hmacPool
+
 // SignMessage returns a message signed with the provided secret, with the
 // signature prepended to the original message.
+//
+// HMAC instances are pooled for reuse across calls with the same secret. The
+// pool is replaced when a different secret is passed, so callers that rotate
+// their secret should expect the first messages after a rotation to be
+// slower.
 func SignMessage(message, secret []byte) []byte {
-	signature := generateSignature(message, secret)
-	return append(signature, message...)
+	signedMessage := make([]byte, 0, SIGNATURE_LENGTH+len(message))
+	signedMessage = signers.sum(signedMessage, message, secret)
+	return append(signedMessage, message...)
 }
 
-func generateSignature(message, secret []byte) []byte {
-	mac := hmac.New(sha256.New, secret)
+// An hmacPool provides reusable HMAC-SHA256 instances for the most recently
+// used secret.
+type hmacPool struct {
+	lock   sync.RWMutex
+	secret string
+	pool   *sync.Pool
+}
+
+// sum appends the signature of message to b and returns the resulting slice.
+func (p *hmacPool) sum(b, message, secret []byte) []byte {
+	pool := p.poolFor(secret)
+	mac := pool.Get().(hash.Hash)
+	mac.Reset()
 	mac.Write(message)
-	return mac.Sum(nil)
+	b = mac.Sum(b)
+	pool.Put(mac)
+	return b
+}
+
+func (p *hmacPool) poolFor(secret []byte) *sync.Pool {
+	p.lock.RLock()
+	pool, current := p.pool, p.secret
+	p.lock.RUnlock()
+	if pool != nil && current == string(secret) {
+		return pool
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pool == nil || p.secret != string(secret) {
+		key := string(secret)
+		p.secret = key
+		p.pool = &sync.Pool{
+			New: func() interface{} {
+				return hmac.New(sha256.New, []byte(key))
+			},
+		}
+	}
+	return p.pool
 }